@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+var (
+	port         = flag.Int("port", 8081, "port to listen on")
+	host         = flag.String("host", "localhost", "interface to listen on")
+	seed         = flag.Int64("seed", 1, "seed of the synthetic history")
+	venues       = flag.Int("venues", 200, "number of venues")
+	checkins     = flag.Int("checkins", 2000, "number of checkins")
+	years        = flag.Int("years", 5, "years of history ending at -until")
+	until        = flag.String("until", "", "end of the history (YYYY-MM-DD), defaults to today")
+	shoutRate    = flag.Float64("shout-rate", 0.01, "fraction of checkins without a venue")
+	listItems    = flag.Int("list-items", 10, "venues in each of the saved, liked and custom lists, 0 for no lists")
+	tips         = flag.Int("tips", 20, "tips left at visited venues")
+	photos       = flag.Int("photos", 30, "checkin photos taken at visited venues")
+	historyLimit = flag.Int("history-limit", 0, "cap unpaged venuehistory responses to exercise the paged fallback")
+	clientId     = flag.String("client-id", fsqfake.DefaultClientId, "accepted OAuth client id")
+	clientSecret = flag.String("client-secret", fsqfake.DefaultClientSecret, "accepted OAuth client secret")
+	token        = flag.String("token", fsqfake.DefaultToken, "access token issued and accepted")
+)
+
+func main() {
+	flag.Parse()
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if *until != "" {
+		var err error
+		if to, err = time.Parse("2006-01-02", *until); err != nil {
+			log.Fatalf("invalid -until: %v", err)
+		}
+	}
+	data := fsqfake.Generate(fsqfake.GenerateOptions{
+		Seed:      *seed,
+		Venues:    *venues,
+		Checkins:  *checkins,
+		From:      to.AddDate(-*years, 0, 0),
+		To:        to,
+		ShoutRate: *shoutRate,
+		ListItems: *listItems,
+		Tips:      *tips,
+		Photos:    *photos,
+	})
+
+	server := fsqfake.NewServer(data)
+	server.ClientId = *clientId
+	server.ClientSecret = *clientSecret
+	server.Token = *token
+	server.HistoryLimit = *historyLimit
+
+	base := fmt.Sprintf("http://%s:%d", *host, *port)
+	log.Printf("serving %d venues and %d checkins on %s", len(data.Venues), len(data.Checkins), base)
+	log.Printf("point the exporters at it with %s=%s %s=%s %s=%s",
+		kmlapi.ConfigEnvName(kmlapi.ConfigBaseURL), base,
+		kmlapi.ConfigEnvName(kmlapi.ConfigClientId), *clientId,
+		kmlapi.ConfigEnvName(kmlapi.ConfigClientSecret), *clientSecret)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", *host, *port), server))
+}
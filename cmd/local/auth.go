@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+	"github.com/spf13/viper"
+)
+
+const (
+	CallbackHost = "callback.host"
+	CallbackPort = "callback.port"
+	CallbackPath = "callback.path"
+	AuthTimeout  = "auth.timeout"
+)
+
+var successPage = template.Must(template.New("success").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>fs4map authorized</title></head>
+<body style="font-family: sans-serif; margin: 3em;">
+<h1>Authorization complete</h1>
+<p>The Foursquare access token was saved. You can close this tab and return to the terminal.</p>
+</body>
+</html>
+`))
+
+type authOptions struct {
+	host      string
+	port      int
+	path      string
+	timeout   time.Duration
+	noBrowser bool
+	paste     bool
+}
+
+func bindAuthFlags(fs *flag.FlagSet) *authOptions {
+	opts := &authOptions{}
+	fs.StringVar(&opts.host, "callback-host", "", "interface the OAuth callback listener binds to (default: host of client.redirect.url)")
+	fs.IntVar(&opts.port, "callback-port", 0, "port of the OAuth callback listener (default: port of client.redirect.url)")
+	fs.StringVar(&opts.path, "callback-path", "", "path of the OAuth callback (default: path of client.redirect.url)")
+	fs.DurationVar(&opts.timeout, "auth-timeout", 0, "give up waiting for the authorization after this long (default 5m)")
+	fs.BoolVar(&opts.noBrowser, "no-browser", false, "print the authorization URL instead of opening a browser")
+	fs.BoolVar(&opts.paste, "paste", false, "headless mode: paste the redirected URL instead of running a callback listener")
+	return opts
+}
+
+// resolve fills unset options from the config and from client.redirect.url,
+// and makes sure the listener will actually receive the redirect.
+func (o *authOptions) resolve() error {
+	redirect, err := url.Parse(viper.GetString(ClientRedirectUrl))
+	if err != nil || redirect.Host == "" {
+		return fmt.Errorf("%s must be an absolute URL, got %q", ClientRedirectUrl, viper.GetString(ClientRedirectUrl))
+	}
+	redirectPort := redirect.Port()
+	if redirectPort == "" {
+		redirectPort = "80"
+		if redirect.Scheme == "https" {
+			redirectPort = "443"
+		}
+	}
+	redirectPath := redirect.Path
+	if redirectPath == "" {
+		redirectPath = "/"
+	}
+
+	if o.host == "" {
+		o.host = viper.GetString(CallbackHost)
+	}
+	if o.host == "" {
+		o.host = redirect.Hostname()
+	}
+	if o.port == 0 {
+		o.port = viper.GetInt(CallbackPort)
+	}
+	if o.port == 0 {
+		if o.port, err = strconv.Atoi(redirectPort); err != nil {
+			return fmt.Errorf("invalid port in %s: %v", ClientRedirectUrl, err)
+		}
+	}
+	if o.path == "" {
+		o.path = viper.GetString(CallbackPath)
+	}
+	if o.path == "" {
+		o.path = redirectPath
+	}
+	if o.timeout == 0 {
+		o.timeout = viper.GetDuration(AuthTimeout)
+	}
+	if o.timeout == 0 {
+		o.timeout = 5 * time.Minute
+	}
+
+	if o.paste {
+		return nil
+	}
+	// A listener behind a reverse proxy may use another port, but the path
+	// has to match or the redirect never reaches the handler.
+	if o.path != redirectPath {
+		return fmt.Errorf("callback path %q does not match %s %q", o.path, ClientRedirectUrl, redirect.String())
+	}
+	if strconv.Itoa(o.port) != redirectPort {
+		log.Printf("WARN: callback port %d differs from %s %q, make sure the redirect is forwarded", o.port, ClientRedirectUrl, redirect.String())
+	}
+	return nil
+}
+
+func openBrowser(target string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+	return cmd.Start()
+}
+
+type callbackResult struct {
+	token kmlapi.FSQToken
+	err   error
+}
+
+// callbackError describes a redirect without a code, with the error and
+// error_description Foursquare sends when the authorization was refused.
+func callbackError(q url.Values) error {
+	reason := q.Get("error")
+	if reason == "" {
+		return errors.New("the authorization redirect has no code parameter")
+	}
+	if desc := q.Get("error_description"); desc != "" {
+		reason += ": " + desc
+	}
+	return fmt.Errorf("Foursquare refused the authorization: %s", reason)
+}
+
+// authorize runs the OAuth dance and saves the resulting token in store.
+func authorize(store kmlapi.TokenStore, opts *authOptions) (kmlapi.FSQToken, error) {
+	if err := kmlapi.RequireConfig(viper.GetViper(), ClientId, ClientSecret, ClientRedirectUrl); err != nil {
+		return "", err
+	}
+	if err := opts.resolve(); err != nil {
+		return "", err
+	}
+
+	oauth := kmlapi.NewOAuthFlow(viper.GetString(ClientId),
+		viper.GetString(ClientSecret),
+		viper.GetString(ClientRedirectUrl),
+		opts.timeout,
+	)
+	// The state never leaves this process, so it needs no binding.
+	authUrl, err := oauth.AuthURL("")
+	if err != nil {
+		return "", err
+	}
+
+	if opts.paste {
+		return authorizeByPaste(store, oauth, authUrl)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(opts.host, strconv.Itoa(opts.port)))
+	if err != nil {
+		return "", fmt.Errorf("can not start the OAuth callback listener: %w (use -paste on headless machines)", err)
+	}
+
+	results := make(chan callbackResult, 1)
+	deliver := func(res callbackResult) {
+		select {
+		case results <- res:
+		default:
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(opts.path, func(w http.ResponseWriter, r *http.Request) {
+		codeStr := r.URL.Query().Get("code")
+		if codeStr == "" {
+			err := callbackError(r.URL.Query())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			deliver(callbackResult{err: err})
+			return
+		}
+		authToken, err := oauth.Exchange(r.URL.Query().Get("state"), "", codeStr)
+		if errors.Is(err, kmlapi.ErrInvalidState) {
+			log.Printf("rejected callback: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "authentication failed", http.StatusBadGateway)
+			deliver(callbackResult{err: fmt.Errorf("can not exchange the authorization code: %w", err)})
+			return
+		}
+		token := kmlapi.NewToken(authToken)
+		if err := store.Save(token); err != nil {
+			log.Printf("failed to store token: %v", err)
+			http.Error(w, "failed to persist token", http.StatusInternalServerError)
+			deliver(callbackResult{err: err})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		successPage.Execute(w, nil)
+		deliver(callbackResult{token: token})
+	})
+
+	server := &http.Server{Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("Waiting for the OAuth callback on http://%s%s", listener.Addr(), opts.path)
+	fmt.Fprintln(os.Stderr, authUrl)
+	if !opts.noBrowser {
+		if err := openBrowser(authUrl); err != nil {
+			log.Printf("could not open a browser (%v), open the URL above manually", err)
+		}
+	}
+
+	select {
+	case res := <-results:
+		if res.err == nil {
+			log.Println("Token saved successfully")
+		}
+		return res.token, res.err
+	case err := <-serveErr:
+		return "", err
+	case <-time.After(opts.timeout):
+		return "", fmt.Errorf("no authorization received within %s", opts.timeout)
+	}
+}
+
+// authorizeByPaste lets the user open the URL on any machine and paste the
+// URL the browser was redirected to, which carries both code and state.
+func authorizeByPaste(store kmlapi.TokenStore, oauth *kmlapi.OAuthFlow, authUrl string) (kmlapi.FSQToken, error) {
+	fmt.Fprintln(os.Stderr, "Open this URL in a browser and authorize the application:")
+	fmt.Fprintln(os.Stderr, authUrl)
+	fmt.Fprint(os.Stderr, "Paste the URL you were redirected to: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	redirected, err := url.Parse(strings.TrimSpace(line))
+	if err != nil {
+		return "", fmt.Errorf("invalid redirected URL: %w", err)
+	}
+	q := redirected.Query()
+	if q.Get("code") == "" {
+		return "", callbackError(q)
+	}
+
+	authToken, err := oauth.Exchange(q.Get("state"), "", q.Get("code"))
+	if err != nil {
+		return "", err
+	}
+	token := kmlapi.NewToken(authToken)
+	if err := store.Save(token); err != nil {
+		return "", err
+	}
+	log.Println("Token saved successfully")
+	return token, nil
+}
+
+// requireToken returns the token from the environment or the store, running
+// the authorization first when there is none.
+func requireToken(opts *authOptions) (kmlapi.FSQToken, error) {
+	if token := envToken(); token != "" {
+		return token, nil
+	}
+	store, err := newTokenStore()
+	if err != nil {
+		return "", err
+	}
+	token, err := loadToken(store)
+	if err != nil || token != "" {
+		return token, err
+	}
+	return authorize(store, opts)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+type cassetteOptions struct {
+	record string
+	replay string
+
+	recorder *kmlapi.Recorder
+	replayer *kmlapi.Replayer
+}
+
+func bindCassetteFlags(fs *flag.FlagSet) *cassetteOptions {
+	opts := &cassetteOptions{}
+	fs.StringVar(&opts.record, "record", "", "save the sanitized API traffic into this cassette file, e.g. for a bug report")
+	fs.StringVar(&opts.replay, "replay", "", "serve the API responses from this cassette file instead of Foursquare")
+	return opts
+}
+
+// start installs the recording or replaying transport. A replay reuses the
+// recorded export window unless the flags choose another one. The category
+// and details caches are bypassed so a cassette holds every request of the
+// run.
+func (c *cassetteOptions) start(params *kmlapi.ExportParams) error {
+	if c.record != "" && c.replay != "" {
+		return errors.New("-record and -replay are mutually exclusive")
+	}
+	if c.record != "" || c.replay != "" {
+		kmlapi.SetCategoryCache(kmlapi.CategoryCache{})
+		kmlapi.SetDetailsCache(kmlapi.DetailsCache{})
+	}
+	if c.record != "" {
+		c.recorder = kmlapi.NewRecorder(http.DefaultTransport)
+		kmlapi.SetTransport(c.recorder)
+	}
+	if c.replay == "" {
+		return nil
+	}
+	cassette, err := kmlapi.LoadCassette(c.replay)
+	if err != nil {
+		return err
+	}
+	c.replayer = kmlapi.NewReplayer(cassette)
+	kmlapi.SetTransport(c.replayer)
+	if params != nil && params.From == "" && params.To == "" && params.Last == "" {
+		params.From = cassette.Meta["from"]
+		params.To = cassette.Meta["to"]
+	}
+	log.Printf("Replaying %d responses recorded at %s", len(cassette.Interactions), cassette.RecordedAt.Format(DatePattern))
+	return nil
+}
+
+func (c *cassetteOptions) token(auth *authOptions) (kmlapi.FSQToken, error) {
+	if c.replayer != nil {
+		return kmlapi.ReplayToken, nil
+	}
+	return requireToken(auth)
+}
+
+// finish saves the recording, also after a failed run since that is the
+// capture a bug report needs.
+func (c *cassetteOptions) finish(opts *kmlapi.ExportOptions) {
+	if c.replayer != nil {
+		if unused := c.replayer.Unused(); len(unused) > 0 {
+			log.Printf("WARN: %d recorded responses were not requested, first: %s", len(unused), unused[0])
+		}
+		return
+	}
+	if c.recorder == nil {
+		return
+	}
+	if opts != nil && opts.After != nil && opts.Before != nil {
+		c.recorder.SetMeta("from", strconv.FormatInt(opts.After.Unix(), 10))
+		c.recorder.SetMeta("to", strconv.FormatInt(opts.Before.Unix(), 10))
+	}
+	if err := c.recorder.Cassette().Save(c.record); err != nil {
+		log.Printf("WARN: can not save the cassette: %v", err)
+		return
+	}
+	log.Printf("API traffic saved to %s", c.record)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+	"github.com/spf13/viper"
+)
+
+// bindExportFlags registers the date range and filter flags shared by the
+// commands that fetch the history.
+func bindExportFlags(fs *flag.FlagSet, params *kmlapi.ExportParams) {
+	fs.StringVar(&params.To, "to", "", "end date (YYYY-MM-DD, RFC 3339 or unix seconds), defaults to now")
+	fs.StringVar(&params.From, "from", "", "start date (YYYY-MM-DD, RFC 3339 or unix seconds), defaults to 10 years before -to")
+	fs.StringVar(&params.Last, "last", "", "relative window ending at -to, e.g. 90d, 6m or 2y")
+	fs.StringVar(&params.Categories, "category", "", "comma separated top-level category names or ids to include")
+	fs.StringVar(&params.MinVisits, "min-visits", "", "only include venues visited at least this many times")
+	fs.StringVar(&params.Name, "name", "", "only include venues whose name contains this text")
+	fs.StringVar(&params.Countries, "country", "", "comma separated country names or codes to include")
+	fs.StringVar(&params.Cities, "city", "", "comma separated city names to include")
+	fs.StringVar(&params.Lists, "lists", "", "export the user's lists as separate folders: off, include (with the visited venues) or only")
+	fs.BoolFunc("tips", "attach the user's tips to the venues", func(s string) error {
+		params.Tips = s
+		return nil
+	})
+	fs.BoolFunc("photos", "attach the user's checkin photos to the venues, packed as thumbnails with -format kmz", func(s string) error {
+		params.Photos = s
+		return nil
+	})
+	fs.StringVar(&params.Locale, "locale", "", "language of the category names and labels, e.g. de or pt-BR (default from foursquare.locale)")
+}
+
+func printStats(w io.Writer, stats kmlapi.ExportStats) {
+	fmt.Fprintln(w, "Export stats:")
+	fmt.Fprintf(w, "  Venues fetched: %d\n", stats.VenuesFetched)
+	fmt.Fprintf(w, "  Venues exported: %d\n", stats.VenuesExported)
+	fmt.Fprintf(w, "  Unknown-category venues: %d\n", stats.UnknownCategoryVenues)
+	fmt.Fprintf(w, "  Checkins raw fetched: %d\n", stats.CheckinsRawFetched)
+	fmt.Fprintf(w, "  Checkins retained after cleaning/dedupe: %d\n", stats.CheckinsUniqueRetained)
+	fmt.Fprintf(w, "  Checkins matched to exported venues: %d\n", stats.CheckinsMatchedToVenues)
+	fmt.Fprintf(w, "  Checkins unmatched to venue details: %d\n", stats.CheckinsUnmatchedToVenues)
+	fmt.Fprintf(w, "  Unmatched checkin venue IDs: %d\n", stats.UnmatchedVenueIDs)
+	fmt.Fprintf(w, "  Checkins skipped (missing venue/time): %d\n", stats.CheckinsMissingVenueOrTime)
+	fmt.Fprintf(w, "  Checkins deduplicated (venue/time): %d\n", stats.CheckinsDeduplicatedByVenueTs)
+	if stats.TipsAttached > 0 || stats.PhotosAttached > 0 {
+		fmt.Fprintf(w, "  Tips attached: %d\n", stats.TipsAttached)
+		fmt.Fprintf(w, "  Photos attached: %d\n", stats.PhotosAttached)
+	}
+	if stats.ThumbnailsPacked > 0 {
+		fmt.Fprintf(w, "  Thumbnails packed: %d\n", stats.ThumbnailsPacked)
+	}
+	if stats.ListsFetched > 0 {
+		fmt.Fprintf(w, "  Lists fetched: %d\n", stats.ListsFetched)
+		fmt.Fprintf(w, "  List items exported: %d\n", stats.ListItemsExported)
+	}
+}
+
+func runAuth(args []string) error {
+	fs := flag.NewFlagSet("auth", flag.ExitOnError)
+	auth := bindAuthFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := kmlapi.RequireConfig(viper.GetViper(), ClientId, ClientSecret, ClientRedirectUrl); err != nil {
+		return err
+	}
+	store, err := newTokenStore()
+	if err != nil {
+		return err
+	}
+	if _, err = authorize(store, auth); err != nil {
+		return err
+	}
+	// The new token supersedes a plaintext one left in the config.
+	if err := clearLegacyToken(); err != nil {
+		log.Printf("WARN: %s could not be removed from the config: %v", ClientToken, err)
+	}
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var params kmlapi.ExportParams
+	bindExportFlags(fs, &params)
+	fs.StringVar(&params.Format, "format", "kml", "output format: kml, kmz, geojson or csv")
+	fs.BoolFunc("split", "write a KML file per outermost group and list plus an index.kml linking them, into a directory named after the output file (a single archive with -format kmz)", func(s string) error {
+		params.Split = s
+		return nil
+	})
+	fs.StringVar(&params.MaxPlacemarks, "max-placemarks", "", "split files holding more placemarks than this, implies -split")
+	fs.BoolFunc("superoverlay", "split the venues into a quadtree of tiles that load as Google Earth zooms in, each with at most -max-placemarks placemarks (default "+strconv.Itoa(kmlapi.DefaultTilePlacemarks)+"), implies -split", func(s string) error {
+		params.Superoverlay = s
+		return nil
+	})
+	fs.StringVar(&params.Density, "density", "", "export the checkin density instead of the venues, in square or hex cells")
+	fs.StringVar(&params.CellSize, "cell-size", "", "width of the density cells in degrees (default "+strconv.FormatFloat(kmlapi.DefaultCellSize, 'f', -1, 64)+")")
+	fs.StringVar(&params.DensityBy, "density-by", "", "split the density into a layer per year or category")
+	fs.StringVar(&params.Cluster, "cluster", "", "group nearby venues into clusters when zoomed out: grid or dbscan")
+	fs.StringVar(&params.ClusterRadius, "cluster-radius", "", "cluster radius in meters below the deepest zoom level, doubling with every level above (default "+strconv.FormatFloat(kmlapi.DefaultClusterRadius, 'f', -1, 64)+")")
+	fs.StringVar(&params.ClusterZooms, "cluster-zooms", "", "comma separated zoom levels to cluster below (default "+strings.ReplaceAll(strings.Trim(fmt.Sprint(kmlapi.DefaultClusterZooms), "[]"), " ", ",")+")")
+	fs.StringVar(&params.GroupBy, "group-by", "", "folders of the venues: "+strings.Join(kmlapi.GroupingNames, ", ")+", or levels joined by >, e.g. country>first-visit (default category)")
+	output := bindOutputFlags(fs)
+	auth := bindAuthFlags(fs)
+	cassette := bindCassetteFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := cassette.start(&params); err != nil {
+		return err
+	}
+
+	opts, err := params.Options(time.Now())
+	if err != nil {
+		return err
+	}
+	if opts.Split && opts.Format == kmlapi.FormatKML {
+		return runSplitExport(opts, output, auth, cassette)
+	}
+	// With the export on stdout everything else goes to stderr.
+	info := os.Stdout
+	var outputFile string
+	if output.stdout() {
+		info = os.Stderr
+	} else {
+		if outputFile, err = output.path(opts); err != nil {
+			return err
+		}
+		skip, err := output.checkTarget(outputFile)
+		if err != nil {
+			return err
+		}
+		if skip {
+			log.Printf("%s already exists, skipping the export", outputFile)
+			return nil
+		}
+	}
+	token, err := cassette.token(auth)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	defer cassette.finish(&opts)
+	stats, err := kmlapi.Export(context.Background(), token, opts, &out, newProgressRenderer(info))
+	if err != nil {
+		return err
+	}
+
+	if output.stdout() {
+		if _, err := out.WriteTo(os.Stdout); err != nil {
+			return err
+		}
+		printStats(info, stats)
+		return nil
+	}
+	written, err := output.writeAtomic(outputFile, &out)
+	if err != nil {
+		return err
+	}
+	printStats(info, stats)
+	if !written {
+		log.Printf("%s appeared during the export, left untouched", outputFile)
+		return nil
+	}
+	fmt.Fprintf(info, "  Output file: %s\n", outputFile)
+	return nil
+}
+
+// runSplitExport writes the parts of a split KML export as separate files,
+// so each can be imported on its own.
+func runSplitExport(opts kmlapi.ExportOptions, output *outputOptions, auth *authOptions, cassette *cassetteOptions) error {
+	dir, err := output.splitDir(opts)
+	if err != nil {
+		return err
+	}
+	skip, err := output.checkTarget(dir)
+	if err != nil {
+		return err
+	}
+	if skip {
+		log.Printf("%s already exists, skipping the export", dir)
+		return nil
+	}
+	if err := checkSplitDir(dir); err != nil {
+		return err
+	}
+	token, err := cassette.token(auth)
+	if err != nil {
+		return err
+	}
+
+	defer cassette.finish(&opts)
+	parts, stats, err := kmlapi.ExportSplit(context.Background(), token, opts, newProgressRenderer(os.Stdout))
+	if err != nil {
+		return err
+	}
+	if err := output.writeParts(dir, parts); err != nil {
+		return err
+	}
+	printStats(os.Stdout, stats)
+	fmt.Printf("  Output files: %d in %s\n", len(parts), dir)
+	fmt.Printf("  Index: %s\n", filepath.Join(dir, kmlapi.IndexName))
+	return nil
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var params kmlapi.ExportParams
+	bindExportFlags(fs, &params)
+	top := fs.Int("top", 10, "number of categories and venues to rank")
+	auth := bindAuthFlags(fs)
+	cassette := bindCassetteFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := cassette.start(&params); err != nil {
+		return err
+	}
+
+	opts, err := params.Options(time.Now())
+	if err != nil {
+		return err
+	}
+	token, err := cassette.token(auth)
+	if err != nil {
+		return err
+	}
+	defer cassette.finish(&opts)
+
+	ds, _, err := kmlapi.FetchDatasetWithOptions(context.Background(), token, opts, newProgressRenderer(os.Stdout))
+	if err != nil {
+		return err
+	}
+	ds = ds.Filter(opts.Filter)
+	summary := kmlapi.Summarize(ds, *top)
+
+	fmt.Printf("History %s - %s:\n", opts.After.Format(DatePattern), opts.Before.Format(DatePattern))
+	fmt.Printf("  Venues: %d (%d with checkins)\n", summary.Venues, summary.VisitedVenues)
+	fmt.Printf("  Checkins: %d\n", summary.Checkins)
+	if summary.Checkins > 0 {
+		fmt.Printf("  First checkin (UTC): %s\n", summary.FirstVisit.Format(time.RFC3339))
+		fmt.Printf("  Last checkin (UTC): %s\n", summary.LastVisit.Format(time.RFC3339))
+	}
+
+	years := make([]int, 0, len(summary.CheckinsPerYear))
+	for year := range summary.CheckinsPerYear {
+		years = append(years, year)
+	}
+	sort.Ints(years)
+	if len(years) > 0 {
+		fmt.Println("Checkins per year:")
+		for _, year := range years {
+			fmt.Printf("  %d: %d\n", year, summary.CheckinsPerYear[year])
+		}
+	}
+	if len(summary.TopCategories) > 0 {
+		fmt.Println("Top categories:")
+		for _, c := range summary.TopCategories {
+			fmt.Printf("  %5d  %s\n", c.Count, c.Name)
+		}
+	}
+	if len(summary.TopCountries) > 0 {
+		fmt.Println("Top countries:")
+		for _, c := range summary.TopCountries {
+			fmt.Printf("  %5d  %s\n", c.Count, c.Name)
+		}
+	}
+	if len(summary.TopCities) > 0 {
+		fmt.Println("Top cities:")
+		for _, c := range summary.TopCities {
+			fmt.Printf("  %5d  %s\n", c.Count, c.Name)
+		}
+	}
+	if len(summary.TopVenues) > 0 {
+		fmt.Println("Top venues:")
+		for _, v := range summary.TopVenues {
+			fmt.Printf("  %5d  %s\n", v.Count, v.Name)
+		}
+	}
+	if len(ds.Lists) > 0 {
+		fmt.Println("Lists:")
+		for _, l := range ds.Lists {
+			fmt.Printf("  %5d  %s\n", len(l.Items), l.Name)
+		}
+	}
+	return nil
+}
+
+func printCategories(cats []kmlapi.GlobalCategory, depth int, maxDepth int) {
+	if maxDepth > 0 && depth >= maxDepth {
+		return
+	}
+	for _, c := range cats {
+		fmt.Printf("%s%s (%s)\n", strings.Repeat("  ", depth), c.Name, c.Id)
+		printCategories(c.Children, depth+1, maxDepth)
+	}
+}
+
+func runCategories(args []string) error {
+	fs := flag.NewFlagSet("categories", flag.ExitOnError)
+	depth := fs.Int("depth", 0, "maximum depth to print, 0 for the whole tree")
+	asJSON := fs.Bool("json", false, "print the tree as JSON, the format of the bundled taxonomy snapshots")
+	locale := fs.String("locale", "", "language of the category names (default from foursquare.locale)")
+	auth := bindAuthFlags(fs)
+	cassette := bindCassetteFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := cassette.start(nil); err != nil {
+		return err
+	}
+
+	token, err := cassette.token(auth)
+	if err != nil {
+		return err
+	}
+	defer cassette.finish(nil)
+	if *locale != "" {
+		if *locale, err = kmlapi.ParseLocale(*locale); err != nil {
+			return fmt.Errorf("invalid -locale: %w", err)
+		}
+	}
+	cats, err := kmlapi.CurrentBackend().Categories(context.Background(), token, *locale)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cats)
+	}
+	printCategories(cats, 0, *depth)
+	return nil
+}
+
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	warn := func(name string, msg string) {
+		fmt.Printf("warn %s: %s\n", name, msg)
+	}
+
+	if path := viper.ConfigFileUsed(); path != "" {
+		fmt.Printf("Config file: %s\n", path)
+	} else {
+		fmt.Printf("Config file: none, using %s_* environment variables\n", kmlapi.ConfigEnvPrefix)
+	}
+	for _, key := range []string{ClientId, ClientSecret, ClientRedirectUrl} {
+		check(key, kmlapi.RequireConfig(viper.GetViper(), key))
+	}
+	if viper.GetString(ClientRedirectUrl) != "" {
+		check("callback listener settings", (&authOptions{}).resolve())
+	}
+	// An invalid backend already fails loading the config.
+	backend := kmlapi.CurrentBackend()
+	fmt.Printf("Backend: %s\n", backend.Name())
+	// The history is read from the v2 checkins whatever the backend, which
+	// only serves the venue details and categories.
+	checkFoursquare := func(token kmlapi.FSQToken) {
+		now := time.Now()
+		_, _, err := kmlapi.FetchCheckins(token, &now, &now, nil)
+		check("token accepted by Foursquare", err)
+		_, err = backend.Categories(context.Background(), token, "")
+		check(backend.Name()+" backend categories", err)
+	}
+
+	if token := envToken(); token != "" {
+		fmt.Printf("Token: from %s\n", kmlapi.ConfigEnvName(ClientToken))
+		checkFoursquare(token)
+	} else {
+		legacy := kmlapi.NewToken(viper.GetString(ClientToken))
+		if legacy != "" {
+			warn("plaintext token", ClientToken+" is still set in the config, run auth to replace it or logout to remove it")
+		}
+		store, err := newTokenStore()
+		check("token passphrase", err)
+		if err == nil {
+			token, err := storedToken(store)
+			switch {
+			case errors.Is(err, kmlapi.ErrNoToken) && legacy != "":
+				// The next command imports it, so check that one.
+				token, err = legacy, nil
+			case errors.Is(err, kmlapi.ErrNoToken):
+				err = errors.New("no token stored, run auth")
+			}
+			check("stored token", err)
+			if err == nil {
+				checkFoursquare(token)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func runLogout(args []string) error {
+	fs := flag.NewFlagSet("logout", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := logout(); err != nil {
+		return err
+	}
+	log.Println("Stored token removed")
+	return nil
+}
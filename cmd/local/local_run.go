@@ -3,15 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/jdevelop/fs4map/kmlapi"
-	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/viper"
 )
 
@@ -21,19 +20,27 @@ type TopLevel map[string]string
 type Root map[string]string
 
 const (
-	ClientId          = "client.id"
-	ClientRedirectUrl = "client.redirect.url"
-	ClientToken       = "client.token"
-	ClientSecret      = "client.secret"
+	ClientId          = kmlapi.ConfigClientId
+	ClientRedirectUrl = kmlapi.ConfigClientRedirectUrl
+	ClientToken       = kmlapi.ConfigToken
+	ClientSecret      = kmlapi.ConfigClientSecret
 	DatePattern       = "2006-01-02"
 )
 
-var (
-	before     = time.Now()
-	after      = before.Add(-(10 * Year)) // could fail
-	flagBefore = flag.String("to", before.Format(DatePattern), "start date")
-	flagAfter  = flag.String("from", after.Format(DatePattern), "end date")
-)
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"auth", "run the OAuth authorization and store the access token", runAuth},
+	{"export", "export visited venues to a file (default command)", runExport},
+	{"stats", "print history statistics without writing a file", runStats},
+	{"categories", "print the Foursquare category tree", runCategories},
+	{"doctor", "validate the configuration and the stored token", runDoctor},
+	{"logout", "wipe the stored access token", runLogout},
+}
 
 func renderProgressBar(fetched int, total int) string {
 	const width = 30
@@ -53,129 +60,89 @@ func renderProgressBar(fetched int, total int) string {
 	return fmt.Sprintf("[%s%s] %d/%d", strings.Repeat("=", filled), strings.Repeat(" ", width-filled), fetched, total)
 }
 
-func main() {
-
-	flag.Parse()
-
-	viper.SetConfigName("config")
-	viper.AddConfigPath("$HOME/.kmlexport")
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatal(err)
-	}
-	var token = viper.GetString(ClientToken)
-
-	if token == "" {
-
-		authUrl := kmlapi.PreAuthenticate(viper.GetString(ClientId), viper.GetString(ClientRedirectUrl))
-
-		svc := httprouter.New()
-
-		var wait sync.WaitGroup
-		wait.Add(1)
-
-		svc.GET("/api/export", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-			codeStr := r.URL.Query().Get("code")
-			if codeStr == "" {
-				http.Error(w, "missing code query parameter", http.StatusBadRequest)
-				return
-			}
-			authToken, err := kmlapi.Authenticate(viper.GetString(ClientId),
-				viper.GetString(ClientSecret),
-				codeStr,
-				viper.GetString(ClientRedirectUrl),
-			)
-			if err != nil {
-				log.Printf("authenticate failed: %v", err)
-				http.Error(w, "authentication failed", http.StatusBadGateway)
-				return
-			}
-			token = authToken
-			viper.Set(ClientToken, token)
-			if err := viper.WriteConfig(); err != nil {
-				log.Printf("failed to write config: %v", err)
-				http.Error(w, "failed to persist token", http.StatusInternalServerError)
-				return
-			}
-			log.Println("Token saved successfully")
-			w.WriteHeader(http.StatusNoContent)
-			wait.Done()
-		})
-
-		log.Println("Started server on :8080")
-
-		go http.ListenAndServe(":8080", svc)
-
-		println(authUrl)
-		wait.Wait()
+func formatETA(d time.Duration) string {
+	if d <= 0 {
+		return ""
 	}
+	return fmt.Sprintf(" ETA %s", d.Round(time.Second))
+}
 
-	if v, err := time.Parse(DatePattern, *flagBefore); err == nil {
-		before = v
-	} else {
-		log.Println("using default end time", before)
-	}
-	if v, err := time.Parse(DatePattern, *flagAfter); err == nil {
-		after = v
-	} else {
-		log.Println("using default start time", after)
+// newProgressRenderer draws one progress bar line per stage and prints
+// retries and warnings on their own lines without breaking the bar.
+func newProgressRenderer(w io.Writer) kmlapi.ProgressListener {
+	barOpen := false
+	closeBar := func() {
+		if barOpen {
+			fmt.Fprintln(w)
+			barOpen = false
+		}
 	}
-
-	currentStage := ""
-	k, stats, err := kmlapi.BuildKMLWithProgressAndStats(kmlapi.NewToken(token), &before, &after, func(stage string, fetched int, total int) {
-		if stage != currentStage {
-			if currentStage != "" {
-				fmt.Println()
+	return kmlapi.ProgressListenerFunc(func(e kmlapi.ProgressEvent) {
+		switch e.Kind {
+		case kmlapi.PageFetched:
+			fmt.Fprintf(w, "\r%s: %s page %d (%s)%s", e.Stage, renderProgressBar(e.Fetched, e.Total),
+				e.Page, e.Duration.Round(time.Millisecond), formatETA(e.ETA()))
+			barOpen = true
+		case kmlapi.StageFinished:
+			if e.Page == 0 {
+				closeBar()
+				fmt.Fprintf(w, "%s: done in %s\n", e.Stage, e.Elapsed.Round(time.Millisecond))
+				return
 			}
-			currentStage = stage
-			fmt.Printf("%s: ", stage)
-		}
-		fmt.Printf("\r%s: %s", stage, renderProgressBar(fetched, total))
-		if total > 0 && fetched >= total {
-			fmt.Println()
+			fmt.Fprintf(w, "\r%s: %s %d pages in %s\n", e.Stage, renderProgressBar(e.Fetched, e.Total),
+				e.Page, e.Elapsed.Round(time.Millisecond))
+			barOpen = false
+		case kmlapi.RetryScheduled:
+			closeBar()
+			log.Printf("%s: retry %d in %s: %v", e.Stage, e.Attempt, e.Delay, e.Err)
+		case kmlapi.Warning:
+			closeBar()
+			log.Printf("WARN: %s", e.Message)
 		}
 	})
-	if err != nil {
-		log.Fatal(err)
-	}
+}
 
-	w, err := os.Create(fmt.Sprintf("export-%s-%s.kml", after.Format(DatePattern), before.Format(DatePattern)))
-	if err != nil {
-		log.Fatal(err)
+func usage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", prog)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", prog)
+	fmt.Fprintf(os.Stderr, "Config keys can be set with %s_* environment variables, e.g. %s.\n", kmlapi.ConfigEnvPrefix, kmlapi.ConfigEnvName(ClientId))
+}
 
-	if err := k.WriteIndent(w, "", "  "); err != nil {
-		log.Fatal(err)
-	}
-	if err := w.Sync(); err != nil {
-		log.Fatal(err)
-	}
-	if err := w.Close(); err != nil {
-		log.Fatal(err)
-	}
+// parseFlags adds the -config flag every command shares, parses args and
+// loads the config.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	configPath := fs.String("config", os.Getenv(kmlapi.ConfigPathEnv), "config file (default $HOME/.kmlexport/config.*)")
+	fs.Parse(args)
+	return kmlapi.LoadConfig(viper.GetViper(), *configPath)
+}
 
-	if stats.UnmatchedVenueIDs > 0 {
-		log.Printf("WARN: %d venue IDs from checkins were not present in fetched venue details (%d checkins unmatched)",
-			stats.UnmatchedVenueIDs, stats.CheckinsUnmatchedToVenues)
-	}
-	if stats.CheckinsMissingVenueOrTime > 0 {
-		log.Printf("WARN: skipped %d checkins with missing venue.id or createdAt", stats.CheckinsMissingVenueOrTime)
+func main() {
+	args := os.Args[1:]
+	name := "export"
+	// Plain flags without a command keep the pre-subcommand behaviour.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	if stats.CheckinsDeduplicatedByVenueTs > 0 {
-		log.Printf("WARN: deduplicated %d checkins by (venue.id, createdAt)", stats.CheckinsDeduplicatedByVenueTs)
+	if name == "help" {
+		usage()
+		return
 	}
 
-	fmt.Println("Export stats:")
-	fmt.Printf("  Venues fetched: %d\n", stats.VenuesFetched)
-	fmt.Printf("  Venues exported: %d\n", stats.VenuesExported)
-	fmt.Printf("  Unknown-category venues: %d\n", stats.UnknownCategoryVenues)
-	fmt.Printf("  Checkins raw fetched: %d\n", stats.CheckinsRawFetched)
-	fmt.Printf("  Checkins retained after cleaning/dedupe: %d\n", stats.CheckinsUniqueRetained)
-	fmt.Printf("  Checkins matched to exported venues: %d\n", stats.CheckinsMatchedToVenues)
-	fmt.Printf("  Checkins unmatched to venue details: %d\n", stats.CheckinsUnmatchedToVenues)
-	fmt.Printf("  Unmatched checkin venue IDs: %d\n", stats.UnmatchedVenueIDs)
-	fmt.Printf("  Checkins skipped (missing venue/time): %d\n", stats.CheckinsMissingVenueOrTime)
-	fmt.Printf("  Checkins deduplicated (venue/time): %d\n", stats.CheckinsDeduplicatedByVenueTs)
-	fmt.Printf("  Output file: %s\n", fmt.Sprintf("export-%s-%s.kml", after.Format(DatePattern), before.Format(DatePattern)))
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+const (
+	DefaultNameTemplate  = "export-{from}-{to}.{ext}"
+	outputFilePermission = 0644
+)
+
+var errOutputExists = errors.New("output file already exists, use -force to overwrite or -no-clobber to skip")
+
+type outputOptions struct {
+	out       string
+	template  string
+	force     bool
+	noClobber bool
+}
+
+func bindOutputFlags(fs *flag.FlagSet) *outputOptions {
+	opts := &outputOptions{}
+	fs.StringVar(&opts.out, "out", "", `output file or directory, "-" for stdout (default: the working directory)`)
+	fs.StringVar(&opts.template, "name-template", DefaultNameTemplate, "file name used when -out is a directory; placeholders {from}, {to}, {format}, {ext}")
+	fs.BoolVar(&opts.force, "force", false, "overwrite an existing output file")
+	fs.BoolVar(&opts.noClobber, "no-clobber", false, "leave an existing output file alone and exit successfully")
+	return opts
+}
+
+func (o *outputOptions) stdout() bool {
+	return o.out == "-"
+}
+
+// path expands the placeholders and resolves the final output file. An -out
+// naming an existing directory, or ending with a separator, gets the
+// template appended.
+func (o *outputOptions) path(opts kmlapi.ExportOptions) (string, error) {
+	if o.force && o.noClobber {
+		return "", errors.New("-force and -no-clobber are mutually exclusive")
+	}
+	expand := strings.NewReplacer(
+		"{from}", opts.After.Format(DatePattern),
+		"{to}", opts.Before.Format(DatePattern),
+		"{format}", string(opts.Format),
+		"{ext}", opts.OutputFormat().Extension(),
+	).Replace
+
+	name := expand(o.template)
+	if name == "" || strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("invalid -name-template %q: must produce a plain file name", o.template)
+	}
+	out := expand(o.out)
+	if out == "" {
+		return name, nil
+	}
+	if strings.HasSuffix(out, string(filepath.Separator)) {
+		return filepath.Join(out, name), nil
+	}
+	if info, err := os.Stat(out); err == nil && info.IsDir() {
+		return filepath.Join(out, name), nil
+	}
+	return out, nil
+}
+
+// checkTarget runs before the export is fetched, so a cron job with
+// -no-clobber does not spend API calls on a file it will not write. It
+// reports whether the export should be skipped.
+func (o *outputOptions) checkTarget(path string) (bool, error) {
+	if info, err := os.Stat(filepath.Dir(path)); err != nil {
+		return false, fmt.Errorf("output directory: %w", err)
+	} else if !info.IsDir() {
+		return false, fmt.Errorf("output directory %s is not a directory", filepath.Dir(path))
+	}
+	if o.force {
+		return false, nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		if o.noClobber {
+			return true, nil
+		}
+		return false, fmt.Errorf("%s: %w", path, errOutputExists)
+	}
+	return false, nil
+}
+
+// writeAtomic writes the content into a temporary file next to path and
+// moves it into place, so readers of a published directory never see a
+// partial export. Without -force an existing file is never replaced, even
+// if it appeared while the export was running.
+func (o *outputOptions) writeAtomic(path string, content io.WriterTo) (bool, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".export-*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := content.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Chmod(outputFilePermission); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if o.force {
+		return true, os.Rename(tmp.Name(), path)
+	}
+	// A hard link fails if the target exists, unlike rename.
+	err = os.Link(tmp.Name(), path)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsExist(err):
+		if o.noClobber {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", path, errOutputExists)
+	}
+	// Filesystems without hard links fall back to a checked rename.
+	if _, statErr := os.Stat(path); statErr == nil {
+		if o.noClobber {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", path, errOutputExists)
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// splitDir is the directory a split KML export is written into: the output
+// file without its extension.
+func (o *outputOptions) splitDir(opts kmlapi.ExportOptions) (string, error) {
+	if o.stdout() {
+		return "", errors.New("a split KML export is a directory, use -format kmz to write it to stdout")
+	}
+	path, err := o.path(opts)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)), nil
+}
+
+// checkSplitDir makes sure a split directory -force writes over holds
+// nothing but an earlier split export, since the parts it no longer has are
+// removed.
+func checkSplitDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && (filepath.Ext(e.Name()) == ".kml" || isExportTemp(e.Name())) {
+			continue
+		}
+		return fmt.Errorf("%s holds %s, which is not part of a split export; remove it or choose another -out", dir, e.Name())
+	}
+	return nil
+}
+
+// isExportTemp reports whether name is a temporary file of writeAtomic left
+// behind by an interrupted export.
+func isExportTemp(name string) bool {
+	return strings.HasPrefix(name, ".export-") && strings.HasSuffix(name, ".tmp")
+}
+
+// writeParts writes the files of a split export into dir, the index last so
+// a viewer never opens an index pointing at missing parts, and then removes
+// the parts of an earlier export the index no longer links to.
+func (o *outputOptions) writeParts(dir string, parts []kmlapi.Part) error {
+	names := make(map[string]bool, len(parts))
+	for i, p := range parts {
+		if (i == 0) != (p.Name == kmlapi.IndexName) || (i > 0 && kmlapi.ReservedPartName(p.Name)) {
+			return fmt.Errorf("split export part %q takes the name of the index", p.Name)
+		}
+		if names[p.Name] || filepath.Base(p.Name) != p.Name || filepath.Ext(p.Name) != ".kml" {
+			return fmt.Errorf("invalid split export part name %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// The directory was checked before the export, its files belong to it.
+	files := &outputOptions{force: true}
+	for i := len(parts) - 1; i >= 0; i-- {
+		var buf bytes.Buffer
+		if err := parts[i].KML.WriteIndent(&buf, "", "  "); err != nil {
+			return err
+		}
+		if _, err := files.writeAtomic(filepath.Join(dir, parts[i].Name), &buf); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && filepath.Ext(e.Name()) == ".kml" && !names[e.Name()] {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
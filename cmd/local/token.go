@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+	"github.com/spf13/viper"
+)
+
+const (
+	TokenFile           = "token.file"
+	TokenPassphraseFile = "token.passphrase_file"
+	TokenMaxAge         = "token.max_age"
+	TokenPassphraseEnv  = "KMLEXPORT_TOKEN_PASSPHRASE"
+)
+
+// tokenPassphrase looks for the store passphrase in the environment, then in
+// the configured passphrase file, and finally asks on an interactive stdin.
+func tokenPassphrase() (string, error) {
+	if v := os.Getenv(TokenPassphraseEnv); v != "" {
+		return v, nil
+	}
+	if path := viper.GetString(TokenPassphraseFile); path != "" {
+		content, err := os.ReadFile(os.ExpandEnv(path))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("no token passphrase: set %s or %s", TokenPassphraseEnv, TokenPassphraseFile)
+	}
+	fmt.Fprint(os.Stderr, "Token store passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func tokenFilePath() string {
+	if path := viper.GetString(TokenFile); path != "" {
+		return os.ExpandEnv(path)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".kmlexport", "token.enc")
+}
+
+func newTokenStore() (kmlapi.TokenStore, error) {
+	passphrase, err := tokenPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return kmlapi.NewFileTokenStore(tokenFilePath(), passphrase), nil
+}
+
+// envToken returns the access token passed through the environment. It is
+// used as is and never written to the token store.
+func envToken() kmlapi.FSQToken {
+	return kmlapi.NewToken(os.Getenv(kmlapi.ConfigEnvName(ClientToken)))
+}
+
+// clearLegacyToken removes the plaintext client.token from the config file.
+// The file is rewritten from its own contents only, since the global config
+// also holds the defaults and the KMLEXPORT_* overrides.
+func clearLegacyToken() error {
+	path := viper.ConfigFileUsed()
+	if viper.GetString(ClientToken) == "" || envToken() != "" || path == "" {
+		return nil
+	}
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		return err
+	}
+	viper.Set(ClientToken, "")
+	if file.GetString(ClientToken) == "" {
+		return nil
+	}
+	file.Set(ClientToken, "")
+	return file.WriteConfig()
+}
+
+// loadToken returns the stored token, importing a plaintext client.token
+// from the config on first use. An expired or missing token yields "".
+func loadToken(store kmlapi.TokenStore) (kmlapi.FSQToken, error) {
+	stored, err := store.Load()
+	if errors.Is(err, kmlapi.ErrNoToken) {
+		legacy := viper.GetString(ClientToken)
+		if legacy == "" || envToken() != "" {
+			return "", nil
+		}
+		if err := store.Save(kmlapi.NewToken(legacy)); err != nil {
+			return "", err
+		}
+		if err := clearLegacyToken(); err != nil {
+			log.Printf("WARN: token imported but %s could not be removed from the config: %v", ClientToken, err)
+		} else {
+			log.Printf("Imported %s from the config into %s", ClientToken, tokenFilePath())
+		}
+		return kmlapi.NewToken(legacy), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if stored.Expired(viper.GetDuration(TokenMaxAge), time.Now()) {
+		log.Printf("Stored token is older than %s, authorization required", viper.GetDuration(TokenMaxAge))
+		return "", nil
+	}
+	return stored.Token, nil
+}
+
+// storedToken returns the stored token, or kmlapi.ErrNoToken when there is
+// none. Unlike loadToken it imports nothing and leaves the config alone, for
+// doctor.
+func storedToken(store kmlapi.TokenStore) (kmlapi.FSQToken, error) {
+	stored, err := store.Load()
+	if err != nil {
+		return "", err
+	}
+	if maxAge := viper.GetDuration(TokenMaxAge); stored.Expired(maxAge, time.Now()) {
+		return "", fmt.Errorf("stored token is older than %s, run auth", maxAge)
+	}
+	return stored.Token, nil
+}
+
+func logout() error {
+	if err := kmlapi.NewFileTokenStore(tokenFilePath(), "").Clear(); err != nil {
+		return err
+	}
+	return clearLegacyToken()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+var (
+	errNoFeed       = errors.New("unknown or revoked feed")
+	errTooManyFeeds = errors.New("too many live feeds for this session, revoke one first")
+)
+
+// feedRetry is the wait after a failed feed export before the next attempt;
+// it doubles with every failure in a row, up to the refresh interval.
+const feedRetry = time.Minute
+
+// Feed re-exports the history with the parameters it was created with, so
+// relative windows like last=30d move along, and keeps the latest export.
+type Feed struct {
+	ID        string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	query url.Values
+	// session lends its access token to the exports, so the feed ends with
+	// it.
+	session string
+
+	mu       sync.Mutex
+	latest   *ExportResult
+	etag     string
+	builtAt  time.Time
+	failedAt time.Time
+	failures int
+	lastErr  error
+	building *Job
+}
+
+// FeedStore keeps the live feeds. A feed is addressed by a signed key that
+// authenticates it on its own, since Google Earth sends no session cookie;
+// the access token stays in the session that created the feed. Keys are
+// signed with a key of their own, as they end up in URLs that get logged.
+type FeedStore struct {
+	mu       sync.Mutex
+	feeds    map[string]*Feed
+	ttl      time.Duration
+	refresh  time.Duration
+	max      int
+	signKey  []byte
+	sessions *SessionStore
+	jobs     *JobManager
+}
+
+// NewFeedStore keeps feeds for ttl, at most maxPerSession for a session.
+func NewFeedStore(sessions *SessionStore, jobs *JobManager, ttl time.Duration, refresh time.Duration, maxPerSession int) *FeedStore {
+	return &FeedStore{
+		feeds:    make(map[string]*Feed),
+		ttl:      ttl,
+		refresh:  refresh,
+		max:      maxPerSession,
+		signKey:  sessions.subKey("feed-key-signature"),
+		sessions: sessions,
+		jobs:     jobs,
+	}
+}
+
+// Refresh is how often the feed is exported again, and how often Google
+// Earth is told to reload it.
+func (s *FeedStore) Refresh() time.Duration {
+	return s.refresh
+}
+
+// Create stores a feed of the history of session exported with the
+// parameters of query, and returns it with its key. The feed expires with
+// the session at the latest.
+func (s *FeedStore) Create(session Session, query url.Values) (*Feed, string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	if session.ExpiresAt.Before(expires) {
+		expires = session.ExpiresAt
+	}
+	feed := &Feed{ID: id, CreatedAt: now, ExpiresAt: expires, query: query, session: session.ID}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owned := 0
+	for _, f := range s.feeds {
+		if f.session == session.ID && now.Before(f.ExpiresAt) {
+			owned++
+		}
+	}
+	if owned >= s.max {
+		return nil, "", errTooManyFeeds
+	}
+	s.feeds[id] = feed
+	return feed, signID(s.signKey, id), nil
+}
+
+// Lookup returns the feed of key unless it expired or was revoked.
+func (s *FeedStore) Lookup(key string) (*Feed, error) {
+	id, ok := verifyID(s.signKey, key)
+	if !ok {
+		return nil, errNoFeed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	feed, ok := s.feeds[id]
+	if ok && time.Now().After(feed.ExpiresAt) {
+		delete(s.feeds, id)
+		ok = false
+	}
+	if !ok {
+		return nil, errNoFeed
+	}
+	return feed, nil
+}
+
+// Revoke drops the feed of key and reports whether it existed.
+func (s *FeedStore) Revoke(key string) bool {
+	feed, err := s.Lookup(key)
+	if err != nil {
+		return false
+	}
+	s.drop(feed)
+	return true
+}
+
+// RevokeSession drops every feed of the session, on logout.
+func (s *FeedStore) RevokeSession(session string) {
+	s.mu.Lock()
+	var owned []*Feed
+	for _, f := range s.feeds {
+		if f.session == session {
+			owned = append(owned, f)
+		}
+	}
+	s.mu.Unlock()
+	for _, f := range owned {
+		s.drop(f)
+	}
+}
+
+func (s *FeedStore) drop(f *Feed) {
+	s.mu.Lock()
+	delete(s.feeds, f.ID)
+	s.mu.Unlock()
+	s.jobs.CancelOwner(f.owner())
+}
+
+func (f *Feed) owner() string {
+	return "feed:" + f.ID
+}
+
+// retryAt is when an export may be attempted again after failures in a row.
+func (f *Feed) retryAt(refresh time.Duration) time.Time {
+	wait := feedRetry << min(f.failures-1, 16)
+	if wait > refresh {
+		wait = refresh
+	}
+	return f.failedAt.Add(wait)
+}
+
+// Latest returns the export of f, exporting it again once it is older than
+// the refresh interval. Concurrent requests share one export, which runs
+// as a job next to the others. A failed export falls back to the previous
+// one, and the next attempt backs off so polling viewers do not start an
+// export each.
+func (s *FeedStore) Latest(ctx context.Context, f *Feed) (*ExportResult, string, time.Time, error) {
+	f.mu.Lock()
+	if f.latest != nil && time.Since(f.builtAt) < s.refresh {
+		defer f.mu.Unlock()
+		return f.latest, f.etag, f.builtAt, nil
+	}
+	job := f.building
+	if job == nil && f.failures > 0 && time.Now().Before(f.retryAt(s.refresh)) {
+		defer f.mu.Unlock()
+		if f.latest == nil {
+			return nil, "", time.Time{}, f.lastErr
+		}
+		return f.latest, f.etag, f.builtAt, nil
+	}
+	if job == nil {
+		var err error
+		if job, err = s.jobs.Start(f.owner(), s.export(f)); err != nil {
+			f.mu.Unlock()
+			return nil, "", time.Time{}, err
+		}
+		f.building = job
+	}
+	f.mu.Unlock()
+
+	_, err := job.Wait(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil && (f.latest == nil || ctx.Err() != nil) {
+		return nil, "", time.Time{}, err
+	}
+	if err != nil {
+		log.Printf("feed %s: export failed, serving the one of %s: %v", f.ID, f.builtAt.Format(time.RFC3339), err)
+	}
+	return f.latest, f.etag, f.builtAt, nil
+}
+
+// export runs the export of f and keeps it, even when the request waiting
+// for it has gone away.
+func (s *FeedStore) export(f *Feed) ExportFunc {
+	return func(ctx context.Context, listener kmlapi.ProgressListener) (result *ExportResult, err error) {
+		defer func() {
+			f.mu.Lock()
+			f.building = nil
+			// A revoked feed cancels its job, which is no upstream failure.
+			if err != nil && ctx.Err() == nil {
+				f.failures++
+				f.failedAt = time.Now()
+				f.lastErr = err
+			}
+			f.mu.Unlock()
+		}()
+		opts, err := kmlapi.ParseExportOptions(f.query, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		_, token, err := s.sessions.Get(f.session)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if _, err := kmlapi.Export(ctx, token, opts, &buf,
+			kmlapi.MultiListener(listener, kmlapi.ProgressListenerFunc(logProgress))); err != nil {
+			return nil, err
+		}
+		result = &ExportResult{
+			Body:        buf.Bytes(),
+			ContentType: opts.OutputFormat().ContentType(),
+			Filename:    "latest." + opts.OutputFormat().Extension(),
+		}
+		sum := sha256.Sum256(result.Body)
+
+		f.mu.Lock()
+		f.latest = result
+		f.etag = fmt.Sprintf("%q", hex.EncodeToString(sum[:16]))
+		f.builtAt = time.Now()
+		f.failures = 0
+		f.lastErr = nil
+		f.mu.Unlock()
+		return result, nil
+	}
+}
+
+func (s *FeedStore) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for id, feed := range s.feeds {
+				if now.After(feed.ExpiresAt) {
+					delete(s.feeds, id)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+// fakeFoursquare serves an fsqfake dataset for the exports of the test. It
+// counts the exports by their categories request, which can be held back
+// until release is closed, and fails every API request while failing is
+// set.
+type fakeFoursquare struct {
+	*httptest.Server
+	exports atomic.Int32
+	failing atomic.Bool
+	hold    chan struct{}
+}
+
+func withFakeFoursquare(t *testing.T) *fakeFoursquare {
+	t.Helper()
+	opts := fsqfake.DefaultGenerateOptions()
+	opts.Venues, opts.Checkins = 20, 100
+	fake := fsqfake.NewServer(fsqfake.Generate(opts))
+	f := &fakeFoursquare{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/venues/categories" {
+			f.exports.Add(1)
+			if hold := f.hold; hold != nil {
+				<-hold
+			}
+		}
+		if f.failing.Load() && r.URL.Path != "/oauth2/authenticate" && r.URL.Path != "/oauth2/access_token" {
+			http.Error(w, `{"meta":{"code":401,"errorType":"invalid_auth"}}`, http.StatusUnauthorized)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	kmlapi.SetBaseURL(f.URL)
+	t.Cleanup(func() {
+		f.Close()
+		kmlapi.SetEndpoints(kmlapi.DefaultAPIBase, kmlapi.DefaultOAuth2Base)
+	})
+	return f
+}
+
+func newTestFeeds(t *testing.T, refresh time.Duration, maxPerSession int) (*FeedStore, *SessionStore, Session) {
+	t.Helper()
+	sessions := newTestSessions(t)
+	session, err := sessions.Create(httptest.NewRecorder(), kmlapi.NewToken(fsqfake.DefaultToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFeedStore(sessions, NewJobManager(2, time.Minute), 24*time.Hour, refresh, maxPerSession), sessions, session
+}
+
+func latest(t *testing.T, feeds *FeedStore, f *Feed) (*ExportResult, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, _, _, err := feeds.Latest(ctx, f)
+	return result, err
+}
+
+func TestFeedStoreSharesOneExport(t *testing.T) {
+	fsq := withFakeFoursquare(t)
+	fsq.hold = make(chan struct{})
+	feeds, _, session := newTestFeeds(t, time.Hour, 5)
+	f, _, err := feeds.Create(session, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*ExportResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = latest(t, feeds, f)
+		}(i)
+	}
+	for fsq.exports.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(fsq.hold)
+	wg.Wait()
+
+	if n := fsq.exports.Load(); n != 1 {
+		t.Fatalf("expected the requests to share one export, got %d", n)
+	}
+	for _, result := range results {
+		if result == nil || result != results[0] || len(result.Body) == 0 {
+			t.Fatalf("expected every request to get the export, got %v", results)
+		}
+	}
+	if again, _ := latest(t, feeds, f); again != results[0] || fsq.exports.Load() != 1 {
+		t.Fatal("expected a fresh export to be served as it is")
+	}
+}
+
+func TestFeedStoreFallsBackAndBacksOff(t *testing.T) {
+	fsq := withFakeFoursquare(t)
+	feeds, _, session := newTestFeeds(t, time.Hour, 5)
+	f, _, _ := feeds.Create(session, url.Values{})
+	first, err := latest(t, feeds, f)
+	if err != nil {
+		t.Fatalf("Latest returned error: %v", err)
+	}
+
+	fsq.failing.Store(true)
+	f.mu.Lock()
+	f.builtAt = f.builtAt.Add(-2 * time.Hour)
+	f.mu.Unlock()
+	if stale, err := latest(t, feeds, f); err != nil || stale != first {
+		t.Fatalf("expected the previous export when the export fails, got %v", err)
+	}
+	if n := fsq.exports.Load(); n != 2 {
+		t.Fatalf("expected the outdated export to be exported again, got %d exports", n)
+	}
+
+	if stale, err := latest(t, feeds, f); err != nil || stale != first || fsq.exports.Load() != 2 {
+		t.Fatalf("expected no export while backing off, got %d exports, %v", fsq.exports.Load(), err)
+	}
+
+	fsq.failing.Store(false)
+	f.mu.Lock()
+	f.failedAt = f.failedAt.Add(-2 * feedRetry)
+	f.mu.Unlock()
+	fresh, err := latest(t, feeds, f)
+	if err != nil || fresh == first || fsq.exports.Load() != 3 {
+		t.Fatalf("expected a new export after the back off, got %d exports, %v", fsq.exports.Load(), err)
+	}
+	if f.failures != 0 || f.lastErr != nil {
+		t.Fatalf("expected a successful export to reset the failures, got %d %v", f.failures, f.lastErr)
+	}
+}
+
+func TestFeedStoreReportsFailureWithoutExport(t *testing.T) {
+	fsq := withFakeFoursquare(t)
+	fsq.failing.Store(true)
+	feeds, _, session := newTestFeeds(t, time.Hour, 5)
+	f, _, _ := feeds.Create(session, url.Values{})
+
+	_, err := latest(t, feeds, f)
+	if err == nil {
+		t.Fatal("expected the failed export to be reported")
+	}
+	if _, again := latest(t, feeds, f); again == nil || again.Error() != err.Error() || fsq.exports.Load() != 1 {
+		t.Fatalf("expected the failure again while backing off, got %v after %d exports", again, fsq.exports.Load())
+	}
+}
+
+func TestFeedStoreFollowsItsSession(t *testing.T) {
+	withFakeFoursquare(t)
+	feeds, sessions, session := newTestFeeds(t, time.Hour, 2)
+
+	f, key, err := feeds.Create(session, url.Values{})
+	if err != nil || f.ExpiresAt.After(session.ExpiresAt) {
+		t.Fatalf("expected the feed to expire with its session, got %v %v", f, err)
+	}
+	if _, _, err := feeds.Create(session, url.Values{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := feeds.Create(session, url.Values{}); !errors.Is(err, errTooManyFeeds) {
+		t.Fatalf("expected the feeds of a session to be capped, got %v", err)
+	}
+	if got, err := feeds.Lookup(key); err != nil || got != f {
+		t.Fatalf("expected the feed of the key, got %v", err)
+	}
+	if _, err := feeds.Lookup(key + "x"); !errors.Is(err, errNoFeed) {
+		t.Fatalf("expected a forged key to be rejected, got %v", err)
+	}
+	if _, err := feeds.Lookup(sessions.sign(f.ID)); !errors.Is(err, errNoFeed) {
+		t.Fatalf("expected a session signature not to be a feed key, got %v", err)
+	}
+	if _, ok := sessions.verify(key); ok {
+		t.Fatal("expected a feed key not to be a session cookie")
+	}
+
+	feeds.RevokeSession(session.ID)
+	if _, err := feeds.Lookup(key); !errors.Is(err, errNoFeed) {
+		t.Fatalf("expected the feeds to end with the session, got %v", err)
+	}
+
+	// A feed whose session is gone has no token to export with.
+	other, _ := sessions.Create(httptest.NewRecorder(), kmlapi.NewToken(fsqfake.DefaultToken))
+	orphan, _, _ := feeds.Create(other, url.Values{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/logout", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: sessions.sign(other.ID)})
+	sessions.Destroy(rec, req)
+	if _, err := latest(t, feeds, orphan); !errors.Is(err, errNoSession) {
+		t.Fatalf("expected no export without the session, got %v", err)
+	}
+}
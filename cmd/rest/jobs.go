@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCanceled  JobState = "canceled"
+)
+
+var (
+	errJobNotFinished = errors.New("job has not finished")
+	errTooManyJobs    = errors.New("too many exports in progress for this session, wait for one to finish")
+	errQueueFull      = errors.New("too many exports waiting, try again later")
+)
+
+// Defaults of the job limits, see JobManager.SetLimits.
+const (
+	DefaultMaxOwnerJobs  = 3
+	DefaultMaxQueuedJobs = 20
+)
+
+// maxJobEvents bounds the events a job keeps for clients to catch up on.
+// Beyond it the older events are compacted to the latest of each stage.
+const maxJobEvents = 200
+
+type ExportResult struct {
+	Body        []byte
+	ContentType string
+	Filename    string
+}
+
+// ExportFunc runs a single export and returns the rendered document.
+type ExportFunc func(ctx context.Context, listener kmlapi.ProgressListener) (*ExportResult, error)
+
+type StageProgress struct {
+	Fetched int     `json:"fetched"`
+	Total   int     `json:"total"`
+	Page    int     `json:"page"`
+	Percent float64 `json:"percent"`
+	Done    bool    `json:"done"`
+}
+
+type JobStatus struct {
+	ID         string                   `json:"id"`
+	State      JobState                 `json:"state"`
+	CreatedAt  time.Time                `json:"created_at"`
+	StartedAt  *time.Time               `json:"started_at,omitempty"`
+	FinishedAt *time.Time               `json:"finished_at,omitempty"`
+	Stage      string                   `json:"stage,omitempty"`
+	Progress   map[string]StageProgress `json:"progress"`
+	Stats      kmlapi.ExportStats       `json:"stats"`
+	Warnings   []string                 `json:"warnings,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+}
+
+// JobEvent is a progress event with its position in the job, which
+// clients resume from.
+type JobEvent struct {
+	Seq int
+	kmlapi.ProgressEvent
+}
+
+type Job struct {
+	mu         sync.Mutex
+	id         string
+	owner      string
+	state      JobState
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	stage      string
+	progress   map[string]StageProgress
+	stats      kmlapi.ExportStats
+	warnings   []string
+	err        error
+	result     *ExportResult
+	cancel     context.CancelFunc
+	events     []JobEvent
+	seq        int
+	// dropped is the last position compacted away, 0 while none was.
+	dropped int
+	changed chan struct{}
+	done    chan struct{}
+}
+
+// notify wakes up everyone waiting in Events. Callers must hold j.mu.
+func (j *Job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Events returns the kept progress events after position from, the last
+// position compacted away, which a client behind it needs the full status
+// for, whether the job has finished, and a channel that is closed on the
+// next change.
+func (j *Job) Events(from int) ([]JobEvent, int, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var events []JobEvent
+	for _, e := range j.events {
+		if e.Seq > from {
+			events = append(events, e)
+		}
+	}
+	return events, j.dropped, j.finished(), j.changed
+}
+
+// record keeps e, compacting the older half of the events to the latest of
+// each stage once there are more than maxJobEvents. Callers must hold j.mu.
+func (j *Job) record(e kmlapi.ProgressEvent) {
+	j.seq++
+	j.events = append(j.events, JobEvent{Seq: j.seq, ProgressEvent: e})
+	if len(j.events) <= maxJobEvents {
+		return
+	}
+	older, recent := j.events[:len(j.events)-maxJobEvents/2], j.events[len(j.events)-maxJobEvents/2:]
+	latest := make(map[string]int)
+	for i, e := range older {
+		latest[e.Stage] = i
+	}
+	kept := make([]JobEvent, 0, len(latest)+len(recent))
+	for i, e := range older {
+		if latest[e.Stage] == i {
+			kept = append(kept, e)
+		} else {
+			j.dropped = max(j.dropped, e.Seq)
+		}
+	}
+	j.events = append(kept, recent...)
+}
+
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Owner is the ID of the session that started the job.
+func (j *Job) Owner() string {
+	return j.owner
+}
+
+func (j *Job) OnProgress(e kmlapi.ProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.notify()
+	j.record(e)
+	switch e.Kind {
+	case kmlapi.StageStarted:
+		j.stage = e.Stage
+		j.progress[e.Stage] = StageProgress{}
+	case kmlapi.PageFetched, kmlapi.StageFinished:
+		j.progress[e.Stage] = StageProgress{
+			Fetched: e.Fetched,
+			Total:   e.Total,
+			Page:    e.Page,
+			Percent: e.Percent(),
+			Done:    e.Kind == kmlapi.StageFinished,
+		}
+	case kmlapi.Warning:
+		j.warnings = append(j.warnings, e.Message)
+	case kmlapi.StatsSnapshot:
+		j.stats = *e.Stats
+	}
+}
+
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := JobStatus{
+		ID:        j.id,
+		State:     j.state,
+		CreatedAt: j.createdAt,
+		Stage:     j.stage,
+		Progress:  make(map[string]StageProgress, len(j.progress)),
+		Stats:     j.stats,
+		Warnings:  append([]string(nil), j.warnings...),
+	}
+	for stage, p := range j.progress {
+		status.Progress[stage] = p
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		status.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	if j.err != nil {
+		status.Error = j.err.Error()
+	}
+	return status
+}
+
+// Result returns the rendered export once the job has succeeded.
+func (j *Job) Result() (*ExportResult, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch j.state {
+	case JobSucceeded:
+		return j.result, nil
+	case JobFailed, JobCanceled:
+		return nil, j.err
+	default:
+		return nil, errJobNotFinished
+	}
+}
+
+// Wait blocks until the job has finished, or ctx is done, and returns its
+// result.
+func (j *Job) Wait(ctx context.Context) (*ExportResult, error) {
+	select {
+	case <-j.done:
+		return j.Result()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (j *Job) finished() bool {
+	return j.state == JobSucceeded || j.state == JobFailed || j.state == JobCanceled
+}
+
+func (j *Job) finish(result *ExportResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.notify()
+	defer close(j.done)
+	j.finishedAt = time.Now()
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.state = JobCanceled
+		j.err = err
+	case err != nil:
+		j.state = JobFailed
+		j.err = err
+	default:
+		j.state = JobSucceeded
+		j.result = result
+	}
+}
+
+// JobManager runs exports in the background with at most concurrency of
+// them in flight, and forgets finished jobs after retention. It refuses new
+// jobs of an owner with too many unfinished ones, and any new job while too
+// many wait for a slot.
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	slots     chan struct{}
+	retention time.Duration
+	maxOwner  int
+	maxQueued int
+}
+
+func NewJobManager(concurrency int, retention time.Duration) *JobManager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &JobManager{
+		jobs:      make(map[string]*Job),
+		slots:     make(chan struct{}, concurrency),
+		retention: retention,
+		maxOwner:  DefaultMaxOwnerJobs,
+		maxQueued: DefaultMaxQueuedJobs,
+	}
+}
+
+// SetLimits caps the queued or running jobs of an owner at perOwner, and the
+// jobs waiting for a slot at queued. Non-positive values keep the defaults.
+func (m *JobManager) SetLimits(perOwner int, queued int) {
+	if perOwner <= 0 {
+		perOwner = DefaultMaxOwnerJobs
+	}
+	if queued <= 0 {
+		queued = DefaultMaxQueuedJobs
+	}
+	m.mu.Lock()
+	m.maxOwner, m.maxQueued = perOwner, queued
+	m.mu.Unlock()
+}
+
+// admit reports why owner may not start another job, nil when it may. The
+// caller holds m.mu.
+func (m *JobManager) admit(owner string) error {
+	owned, queued := 0, 0
+	for _, job := range m.jobs {
+		job.mu.Lock()
+		unfinished, waiting := !job.finished(), job.state == JobQueued
+		job.mu.Unlock()
+		if unfinished && job.owner == owner {
+			owned++
+		}
+		if waiting {
+			queued++
+		}
+	}
+	if owned >= m.maxOwner {
+		return errTooManyJobs
+	}
+	if queued >= m.maxQueued {
+		return errQueueFull
+	}
+	return nil
+}
+
+func newJobID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Start queues run as a job of owner. It returns errTooManyJobs or
+// errQueueFull when the job is refused.
+func (m *JobManager) Start(owner string, run ExportFunc) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		id:        id,
+		owner:     owner,
+		state:     JobQueued,
+		createdAt: time.Now(),
+		progress:  make(map[string]StageProgress),
+		cancel:    cancel,
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if err := m.admit(owner); err != nil {
+		m.mu.Unlock()
+		cancel()
+		return nil, err
+	}
+	m.jobs[id] = job
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		select {
+		case m.slots <- struct{}{}:
+		case <-ctx.Done():
+			job.finish(nil, ctx.Err())
+			return
+		}
+		defer func() { <-m.slots }()
+
+		job.mu.Lock()
+		job.state = JobRunning
+		job.startedAt = time.Now()
+		job.notify()
+		job.mu.Unlock()
+
+		result, err := run(ctx, job)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		job.finish(result, err)
+	}()
+
+	return job, nil
+}
+
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// Cancel stops a queued or running job. Finished jobs are dropped together
+// with their results. It reports whether the job existed.
+func (m *JobManager) Cancel(id string) bool {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return false
+	}
+	job.mu.Lock()
+	done := job.finished()
+	job.mu.Unlock()
+	if done {
+		delete(m.jobs, id)
+	}
+	m.mu.Unlock()
+
+	job.cancel()
+	return true
+}
+
+// CancelOwner cancels and drops every job started by owner.
+func (m *JobManager) CancelOwner(owner string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, job := range m.jobs {
+		if job.owner == owner {
+			job.cancel()
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *JobManager) reap(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		expired := job.finished() && now.Sub(job.finishedAt) > m.retention
+		job.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// Reap periodically drops expired jobs until ctx is done.
+func (m *JobManager) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.reap(now)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+// blockingExport runs until release is closed, or the job is canceled.
+func blockingExport(started chan<- struct{}, release <-chan struct{}) ExportFunc {
+	return func(ctx context.Context, listener kmlapi.ProgressListener) (*ExportResult, error) {
+		listener.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.StageStarted, Stage: "checkins"})
+		started <- struct{}{}
+		select {
+		case <-release:
+			return &ExportResult{Body: []byte("<kml/>"), Filename: "export.kml"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func waitJob(t *testing.T, job *Job) (*ExportResult, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := job.Wait(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("job %s did not finish", job.ID())
+	}
+	return result, err
+}
+
+func TestJobManagerQueuesAndCancels(t *testing.T) {
+	jobs := NewJobManager(1, time.Minute)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+
+	first, _ := jobs.Start("alice", blockingExport(started, release))
+	<-started
+	second, _ := jobs.Start("alice", blockingExport(started, release))
+	if state := second.Status().State; state != JobQueued {
+		t.Fatalf("expected the second job to wait for a slot, got %s", state)
+	}
+	if _, err := second.Result(); !errors.Is(err, errJobNotFinished) {
+		t.Fatalf("expected no result yet, got %v", err)
+	}
+
+	if !jobs.Cancel(second.ID()) {
+		t.Fatal("expected the queued job to be canceled")
+	}
+	if _, err := waitJob(t, second); !errors.Is(err, context.Canceled) || second.Status().State != JobCanceled {
+		t.Fatalf("expected the queued job canceled, got %s %v", second.Status().State, err)
+	}
+
+	status := first.Status()
+	if status.State != JobRunning || status.Stage != "checkins" || status.StartedAt == nil {
+		t.Fatalf("unexpected status of the running job %+v", status)
+	}
+	close(release)
+	result, err := waitJob(t, first)
+	if err != nil || string(result.Body) != "<kml/>" || first.Status().State != JobSucceeded {
+		t.Fatalf("unexpected result %v %v", result, err)
+	}
+
+	// Canceling a finished job drops it with its result.
+	if !jobs.Cancel(first.ID()) {
+		t.Fatal("expected the finished job to exist")
+	}
+	if _, ok := jobs.Get(first.ID()); ok {
+		t.Fatal("expected the finished job to be dropped")
+	}
+	if jobs.Cancel("unknown") {
+		t.Fatal("expected an unknown job not to be canceled")
+	}
+}
+
+func TestJobManagerCancelOwner(t *testing.T) {
+	jobs := NewJobManager(2, time.Minute)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	defer close(release)
+
+	mine, _ := jobs.Start("alice", blockingExport(started, release))
+	theirs, _ := jobs.Start("bob", blockingExport(started, release))
+	<-started
+	<-started
+
+	jobs.CancelOwner("alice")
+	if _, err := waitJob(t, mine); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the job of alice canceled, got %v", err)
+	}
+	if _, ok := jobs.Get(mine.ID()); ok {
+		t.Fatal("expected the job of alice to be dropped")
+	}
+	if _, ok := jobs.Get(theirs.ID()); !ok || theirs.Status().State != JobRunning {
+		t.Fatal("expected the job of bob to keep running")
+	}
+}
+
+func TestJobManagerReap(t *testing.T) {
+	jobs := NewJobManager(1, time.Minute)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+
+	done, _ := jobs.Start("alice", blockingExport(started, release))
+	<-started
+	close(release)
+	waitJob(t, done)
+	running, _ := jobs.Start("alice", blockingExport(started, make(chan struct{})))
+	<-started
+	defer jobs.Cancel(running.ID())
+
+	jobs.reap(time.Now())
+	if _, ok := jobs.Get(done.ID()); !ok {
+		t.Fatal("expected a job to be kept within the retention")
+	}
+	jobs.reap(time.Now().Add(2 * time.Minute))
+	if _, ok := jobs.Get(done.ID()); ok {
+		t.Fatal("expected a job to be reaped after the retention")
+	}
+	if _, ok := jobs.Get(running.ID()); !ok {
+		t.Fatal("expected a running job never to be reaped")
+	}
+}
+
+func TestJobCompactsEvents(t *testing.T) {
+	job := &Job{progress: make(map[string]StageProgress), changed: make(chan struct{})}
+	job.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.StageStarted, Stage: "categories"})
+	job.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.StageFinished, Stage: "categories"})
+	total := 3 * maxJobEvents
+	for i := 1; i <= total; i++ {
+		job.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.PageFetched, Stage: "checkins", Page: i})
+	}
+
+	events, dropped, _, _ := job.Events(0)
+	if len(events) > maxJobEvents+2 {
+		t.Fatalf("expected at most %d events kept, got %d", maxJobEvents+2, len(events))
+	}
+	if dropped == 0 {
+		t.Fatal("expected the compacted events to be reported")
+	}
+	if events[0].Stage != "categories" || events[0].Kind != kmlapi.StageFinished {
+		t.Fatalf("expected the latest event of a quiet stage to be kept, got %+v", events[0])
+	}
+	last := events[len(events)-1]
+	if last.Seq != total+2 || last.Page != total {
+		t.Fatalf("expected the latest event last, got %+v", last)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Seq <= events[i-1].Seq {
+			t.Fatalf("expected the events in order, got %d after %d", events[i].Seq, events[i-1].Seq)
+		}
+	}
+	if p := job.Status().Progress["checkins"]; p.Page != total {
+		t.Fatalf("expected the status to follow every event, got %+v", p)
+	}
+
+	if recent, _, _, _ := job.Events(last.Seq - 1); len(recent) != 1 || recent[0].Seq != last.Seq {
+		t.Fatalf("expected to resume after a position, got %+v", recent)
+	}
+}
+
+func TestJobManagerLimitsQueuedJobs(t *testing.T) {
+	jobs := NewJobManager(1, time.Minute)
+	jobs.SetLimits(2, 2)
+	started, release := make(chan struct{}, 4), make(chan struct{})
+	defer close(release)
+
+	running, _ := jobs.Start("alice", blockingExport(started, release))
+	<-started
+	if _, err := jobs.Start("alice", blockingExport(started, release)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Start("alice", blockingExport(started, release)); !errors.Is(err, errTooManyJobs) {
+		t.Fatalf("expected the jobs of a session to be capped, got %v", err)
+	}
+	if _, err := jobs.Start("bob", blockingExport(started, release)); err != nil {
+		t.Fatalf("expected another session to queue a job, got %v", err)
+	}
+	if _, err := jobs.Start("carol", blockingExport(started, release)); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected the queue to be capped, got %v", err)
+	}
+
+	// A finished job no longer counts against its session.
+	jobs.Cancel(running.ID())
+	waitJob(t, running)
+	if _, err := jobs.Start("alice", blockingExport(started, release)); errors.Is(err, errTooManyJobs) {
+		t.Fatalf("expected the finished job not to count, got %v", err)
+	}
+}
@@ -1,90 +1,473 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/jdevelop/fs4map/kmlapi"
 	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/viper"
+	"github.com/twpayne/go-kml"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
 var (
-	port   = flag.Int("port", 8080, "port to listen on")
-	host   = flag.String("host", "localhost", "port to listen on")
-	prefix = flag.String("prefix", "/api/", "url prefix, must end with /")
+	port         = flag.Int("port", 8080, "port to listen on")
+	host         = flag.String("host", "localhost", "port to listen on")
+	prefix       = flag.String("prefix", "/api/", "url prefix, must end with /")
+	maxJobs      = flag.Int("max-jobs", 2, "maximum number of exports running at the same time")
+	maxOwnerJobs = flag.Int("max-session-jobs", DefaultMaxOwnerJobs, "maximum number of queued or running exports of a session")
+	maxQueued    = flag.Int("max-queued-jobs", DefaultMaxQueuedJobs, "maximum number of exports waiting for one of -max-jobs")
+	jobRetention = flag.Duration("job-retention", time.Hour, "how long finished export results are kept")
+	stateTTL     = flag.Duration("state-ttl", kmlapi.DefaultStateTTL, "how long an issued OAuth state stays valid")
+	maxStates    = flag.Int("max-states", kmlapi.DefaultMaxStates, "maximum number of sign ins waiting for their OAuth callback")
+	sessionTTL   = flag.Duration("session-ttl", 24*time.Hour, "how long a signed in session stays valid")
+	secureCookie = flag.Bool("secure-cookies", false, "mark session cookies as HTTPS only")
+	loginTarget  = flag.String("login-redirect", "", "where to send the browser after sign in, JSON response if empty")
+	corsOrigin   = flag.String("allowed-origin", "*", "value of Access-Control-Allow-Origin; set the front-end origin to allow cookies cross-origin")
+	feedTTL      = flag.Duration("feed-ttl", 30*24*time.Hour, "how long a live Google Earth feed stays valid")
+	feedRefresh  = flag.Duration("feed-refresh", time.Hour, "how often a live feed is exported again and reloaded by Google Earth")
+	maxFeeds     = flag.Int("max-feeds", 5, "maximum number of live feeds of a session")
+	publicURL    = flag.String("public-url", "", "scheme and host the server is reached at, for the links of live feeds (default from the request; set it behind a proxy)")
+	configPath   = flag.String("config", os.Getenv(kmlapi.ConfigPathEnv), "config file (default $HOME/.kmlexport/config.*, optional when KMLEXPORT_* variables are set)")
 )
 
-func main() {
+type SessionResponse struct {
+	Authenticated bool      `json:"authenticated"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
 
-	flag.Parse()
+type FeedResponse struct {
+	ID             string    `json:"id"`
+	Link           string    `json:"link"`
+	Latest         string    `json:"latest"`
+	RefreshSeconds float64   `json:"refresh_seconds"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
 
-	viper.SetConfigName("config")
-	viper.AddConfigPath("$HOME/.kmlexport")
-	if err := viper.ReadInConfig(); err != nil {
-		log.Printf("failed to read config: %v", err)
-		return
+type PreauthResponse struct {
+	Url string `json:"auth"`
+}
+
+type JobResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Events string `json:"events"`
+	Result string `json:"result"`
+}
+
+func allowOrigin(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", *corsOrigin)
+	if *corsOrigin != "*" {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
 	}
+}
 
-	authUrl := kmlapi.PreAuthenticate(viper.GetString("client.id"), viper.GetString("client.redirect.url"))
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	allowOrigin(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
 
-	println(authUrl)
+// publicBase is the scheme and host Google Earth reaches the server at.
+// Without -public-url it trusts the Host and X-Forwarded-Proto headers of
+// the request, which only a proxy that sets them makes safe.
+func publicBase(r *http.Request) string {
+	if *publicURL != "" {
+		return strings.TrimSuffix(*publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
 
-	type PreauthResponse struct {
-		Url string `json:"auth"`
+func logProgress(e kmlapi.ProgressEvent) {
+	switch e.Kind {
+	case kmlapi.StageStarted:
+		log.Printf("export stage=%s started", e.Stage)
+	case kmlapi.PageFetched:
+		if e.Total > 0 {
+			log.Printf("export progress stage=%s page=%d fetched=%d total=%d (%.1f%%) took=%s eta=%s",
+				e.Stage, e.Page, e.Fetched, e.Total, e.Percent(), e.Duration.Round(time.Millisecond), e.ETA().Round(time.Second))
+			return
+		}
+		log.Printf("export progress stage=%s page=%d fetched=%d took=%s", e.Stage, e.Page, e.Fetched, e.Duration.Round(time.Millisecond))
+	case kmlapi.StageFinished:
+		log.Printf("export stage=%s finished fetched=%d pages=%d elapsed=%s", e.Stage, e.Fetched, e.Page, e.Elapsed.Round(time.Millisecond))
+	case kmlapi.RetryScheduled:
+		log.Printf("export retry stage=%s attempt=%d delay=%s err=%v", e.Stage, e.Attempt, e.Delay, e.Err)
+	case kmlapi.Warning:
+		log.Printf("export warning stage=%s: %s", e.Stage, e.Message)
+	case kmlapi.StatsSnapshot:
+		log.Printf("export stats %+v", *e.Stats)
 	}
+}
 
+// newRouter serves the API under -prefix.
+func newRouter(oauth *kmlapi.OAuthFlow, sessions *SessionStore, jobs *JobManager, feeds *FeedStore) *httprouter.Router {
 	svc := httprouter.New()
 
+	// Every call issues a fresh single-use state bound to a cookie of the
+	// calling browser, so the URL must be fetched by the browser that is
+	// redirected, right before redirecting it.
 	svc.GET(*prefix+"preauth", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		binding, err := sessions.BindState(w, *stateTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		authUrl, err := oauth.AuthURL(binding)
+		if errors.Is(err, kmlapi.ErrTooManyStates) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		allowOrigin(w)
+		w.Header().Set("Cache-Control", "no-store")
 		w.Header().Add("Content-Type", "application/json")
 		enc := json.NewEncoder(w)
 		enc.Encode(PreauthResponse{Url: authUrl})
 	})
 
-	svc.GET(*prefix+"export", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		tokenStr := r.URL.Query().Get("code")
-		if tokenStr == "" {
+	// signIn exchanges the OAuth code exactly once and keeps the access token
+	// in a new session; later exports only need the session cookie.
+	signIn := func(w http.ResponseWriter, r *http.Request) (Session, kmlapi.FSQToken, bool) {
+		token, err := oauth.Exchange(r.Form.Get("state"), sessions.StateBinding(w, r), r.Form.Get("code"))
+		if errors.Is(err, kmlapi.ErrInvalidState) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return Session{}, "", false
+		}
+		if err != nil {
+			log.Printf("authenticate failed: %v", err)
+			http.Error(w, "Can not fetch checkins", http.StatusBadGateway)
+			return Session{}, "", false
+		}
+		session, err := sessions.Create(w, kmlapi.NewToken(token))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return Session{}, "", false
+		}
+		return session, kmlapi.NewToken(token), true
+	}
+
+	svc.GET(*prefix+"callback", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("code") == "" {
 			http.Error(w, "missing code query parameter", http.StatusBadRequest)
 			return
 		}
+		session, _, ok := signIn(w, r)
+		if !ok {
+			return
+		}
+		if *loginTarget != "" {
+			http.Redirect(w, r, *loginTarget, http.StatusSeeOther)
+			return
+		}
+		writeJSON(w, http.StatusOK, SessionResponse{Authenticated: true, ExpiresAt: session.ExpiresAt})
+	})
+
+	svc.GET(*prefix+"session", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		session, _, err := sessions.Lookup(r)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, SessionResponse{})
+			return
+		}
+		writeJSON(w, http.StatusOK, SessionResponse{Authenticated: true, ExpiresAt: session.ExpiresAt})
+	})
 
-		before := time.Now()
-		after := before.Add(-(7 * kmlapi.Year))
+	svc.POST(*prefix+"logout", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if session, _, err := sessions.Lookup(r); err == nil {
+			jobs.CancelOwner(session.ID)
+			feeds.RevokeSession(session.ID)
+		}
+		sessions.Destroy(w, r)
+		allowOrigin(w)
+		w.WriteHeader(http.StatusNoContent)
+	})
 
-		token, err := kmlapi.Authenticate(viper.GetString("client.id"),
-			viper.GetString("client.secret"),
-			tokenStr,
-			viper.GetString("client.redirect.url"),
-		)
+	startExport := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
+		opts, err := kmlapi.ParseExportOptions(r.Form, time.Now())
 		if err != nil {
-			http.Error(w, "Can not fetch checkins", 500)
-		} else {
-			k, err := kmlapi.BuildKMLWithProgress(kmlapi.NewToken(token), &before, &after, func(stage string, fetched int, total int) {
-				if total > 0 {
-					log.Printf("export progress stage=%s fetched=%d total=%d (%.1f%%)", stage, fetched, total, (float64(fetched)*100.0)/float64(total))
-					return
-				}
-				log.Printf("export progress stage=%s fetched=%d", stage, fetched)
-			})
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var session Session
+		var token kmlapi.FSQToken
+		if r.Form.Get("code") != "" {
+			var ok bool
+			if session, token, ok = signIn(w, r); !ok {
 				return
 			}
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Content-Disposition", "attachment; filename=kml-export.kml")
-			w.Header().Add("Content-Type", "application/vnd.google-earth.kml+xml")
-			k.WriteIndent(w, "", "  ")
+		} else if session, token, err = sessions.Lookup(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		job, err := jobs.Start(session.ID, func(ctx context.Context, listener kmlapi.ProgressListener) (*ExportResult, error) {
+			var buf bytes.Buffer
+			_, err := kmlapi.Export(ctx, token, opts, &buf,
+				kmlapi.MultiListener(listener, kmlapi.ProgressListenerFunc(logProgress)))
+			if err != nil {
+				return nil, err
+			}
+			return &ExportResult{
+				Body:        buf.Bytes(),
+				ContentType: opts.OutputFormat().ContentType(),
+				Filename: fmt.Sprintf("export-%s-%s.%s",
+					opts.After.Format(kmlapi.DatePattern), opts.Before.Format(kmlapi.DatePattern), opts.OutputFormat().Extension()),
+			}, nil
+		})
+		if errors.Is(err, errTooManyJobs) || errors.Is(err, errQueueFull) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		statusUrl := *prefix + "jobs/" + job.ID()
+		w.Header().Set("Location", statusUrl)
+		writeJSON(w, http.StatusAccepted, JobResponse{
+			ID:     job.ID(),
+			Status: statusUrl,
+			Events: statusUrl + "/events",
+			Result: statusUrl + "/result",
+		})
+	}
+
+	// Starting an export is a side effect, which GET must not have, so only
+	// POST starts one; a prefetch, crawler or link preview must not. POST
+	// export is kept for existing clients.
+	svc.POST(*prefix+"jobs", startExport)
+	svc.POST(*prefix+"export", startExport)
+	svc.GET(*prefix+"export", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		allowOrigin(w)
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "start exports with POST "+*prefix+"jobs", http.StatusMethodNotAllowed)
+	})
+
+	// sessionJob resolves the job only for the session that started it.
+	sessionJob := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (*Job, bool) {
+		session, _, err := sessions.Lookup(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return nil, false
+		}
+		job, ok := jobs.Get(ps.ByName("id"))
+		if !ok || job.Owner() != session.ID {
+			http.NotFound(w, r)
+			return nil, false
+		}
+		return job, true
+	}
+
+	svc.GET(*prefix+"jobs/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		job, ok := sessionJob(w, r, ps)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, job.Status())
+	})
+
+	svc.GET(*prefix+"jobs/:id/events", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		job, ok := sessionJob(w, r, ps)
+		if !ok {
+			return
+		}
+		streamJobEvents(w, r, job, *prefix+"jobs/"+job.ID()+"/result")
+	})
+
+	svc.GET(*prefix+"jobs/:id/result", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		job, ok := sessionJob(w, r, ps)
+		if !ok {
+			return
+		}
+		result, err := job.Result()
+		if err != nil {
+			writeJSON(w, http.StatusConflict, job.Status())
+			return
+		}
+		allowOrigin(w)
+		w.Header().Set("Content-Disposition", "attachment; filename="+result.Filename)
+		w.Header().Add("Content-Type", result.ContentType)
+		w.Write(result.Body)
+	})
+
+	svc.DELETE(*prefix+"jobs/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		allowOrigin(w)
+		job, ok := sessionJob(w, r, ps)
+		if !ok {
+			return
+		}
+		if !jobs.Cancel(job.ID()) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// A feed takes the export parameters; its link is a small KML that has
+	// Google Earth reload the latest export every -feed-refresh. It lives as
+	// long as the session that created it, -feed-ttl at most.
+	svc.POST(*prefix+"feeds", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		session, _, err := sessions.Lookup(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		opts, err := kmlapi.ParseExportOptions(r.Form, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if format := opts.OutputFormat(); format != kmlapi.FormatKML && format != kmlapi.FormatKMZ {
+			http.Error(w, "live feeds are KML or KMZ", http.StatusBadRequest)
+			return
+		}
+		feed, key, err := feeds.Create(session, r.Form)
+		if errors.Is(err, errTooManyFeeds) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		feedUrl := publicBase(r) + *prefix + "feeds/" + key
+		w.Header().Set("Location", feedUrl+"/link.kml")
+		writeJSON(w, http.StatusCreated, FeedResponse{
+			ID:             feed.ID,
+			Link:           feedUrl + "/link.kml",
+			Latest:         feedUrl + "/latest",
+			RefreshSeconds: feeds.Refresh().Seconds(),
+			ExpiresAt:      feed.ExpiresAt,
+		})
+	})
+
+	svc.GET(*prefix+"feeds/:key/link.kml", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if _, err := feeds.Lookup(ps.ByName("key")); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		link := kml.KML(kml.NetworkLink(
+			kml.Name("Foursquare history"),
+			kml.Link(
+				kml.Href(publicBase(r)+*prefix+"feeds/"+ps.ByName("key")+"/latest"),
+				kml.RefreshMode("onInterval"),
+				kml.RefreshInterval(feeds.Refresh().Seconds()),
+			),
+		))
+		allowOrigin(w)
+		w.Header().Set("Content-Disposition", "attachment; filename=fs4map-live.kml")
+		w.Header().Set("Content-Type", kmlapi.FormatKML.ContentType())
+		link.WriteIndent(w, "", "  ")
+	})
+
+	svc.GET(*prefix+"feeds/:key/latest", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		feed, err := feeds.Lookup(ps.ByName("key"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		result, etag, builtAt, err := feeds.Latest(r.Context(), feed)
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("feed %s failed: %v", feed.ID, err)
+			http.Error(w, "Can not fetch checkins", http.StatusBadGateway)
+			return
+		}
+		allowOrigin(w)
+		w.Header().Set("Content-Type", result.ContentType)
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, result.Filename, builtAt, bytes.NewReader(result.Body))
+	})
+
+	// The key is all it takes to revoke a feed, as it is to read it.
+	svc.DELETE(*prefix+"feeds/:key", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !feeds.Revoke(ps.ByName("key")) {
+			http.NotFound(w, r)
+			return
 		}
+		allowOrigin(w)
+		w.WriteHeader(http.StatusNoContent)
 	})
 
-	if err := http.ListenAndServe(fmt.Sprintf("%1s:%2d", *host, *port), svc); err != nil {
+	return svc
+}
+
+func main() {
+
+	flag.Parse()
+
+	if err := kmlapi.LoadConfig(viper.GetViper(), *configPath); err != nil {
+		log.Fatalf("failed to read config: %v", err)
+	}
+	if err := kmlapi.RequireConfig(viper.GetViper(), kmlapi.ConfigClientId, kmlapi.ConfigClientSecret, kmlapi.ConfigClientRedirectUrl); err != nil {
+		log.Fatal(err)
+	}
+	if path := viper.ConfigFileUsed(); path != "" {
+		log.Printf("using config %s", path)
+	}
+
+	oauth := kmlapi.NewOAuthFlow(viper.GetString(kmlapi.ConfigClientId),
+		viper.GetString(kmlapi.ConfigClientSecret),
+		viper.GetString(kmlapi.ConfigClientRedirectUrl),
+		*stateTTL,
+	)
+	oauth.States.SetLimit(*maxStates)
+	log.Printf("authorization URLs are issued by %spreauth", *prefix)
+
+	sessions, err := NewSessionStore(viper.GetString("session.secret"), *sessionTTL, *prefix, *secureCookie)
+	if err != nil {
+		log.Printf("failed to initialize sessions: %v", err)
+		return
+	}
+	go sessions.Reap(context.Background(), time.Minute)
+
+	jobs := NewJobManager(*maxJobs, *jobRetention)
+	jobs.SetLimits(*maxOwnerJobs, *maxQueued)
+	go jobs.Reap(context.Background(), time.Minute)
+
+	feeds := NewFeedStore(sessions, jobs, *feedTTL, *feedRefresh, *maxFeeds)
+	go feeds.Reap(context.Background(), time.Minute)
+	if *publicURL == "" {
+		log.Printf("live feed links are built from the request Host, set -public-url when behind a proxy")
+	}
+
+	if err := http.ListenAndServe(fmt.Sprintf("%1s:%2d", *host, *port), newRouter(oauth, sessions, jobs, feeds)); err != nil {
 		log.Printf("server stopped: %v", err)
 	}
 
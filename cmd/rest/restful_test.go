@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+// newTestServer runs the REST API against fake Foursquare, with the
+// callback of the OAuth flow pointing back at the API.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	withFakeFoursquare(t)
+	var router http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	oauth := kmlapi.NewOAuthFlow(fsqfake.DefaultClientId, fsqfake.DefaultClientSecret, server.URL+"/api/callback", time.Minute)
+	sessions := newTestSessions(t)
+	jobs := NewJobManager(2, time.Minute)
+	router = newRouter(oauth, sessions, jobs, NewFeedStore(sessions, jobs, time.Hour, time.Hour, 5))
+	return server
+}
+
+// newBrowser is a client with its own cookies that does not follow
+// redirects.
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func do(t *testing.T, client *http.Client, method string, url string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// authorize has browser ask for an authorization URL and consent, and
+// returns the callback URL Foursquare redirects it to.
+func authorize(t *testing.T, browser *http.Client, server *httptest.Server) string {
+	t.Helper()
+	resp, body := do(t, browser, http.MethodGet, server.URL+"/api/preauth", nil)
+	var preauth PreauthResponse
+	if err := json.Unmarshal([]byte(body), &preauth); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("preauth failed: %d %s", resp.StatusCode, body)
+	}
+	resp, _ = do(t, browser, http.MethodGet, preauth.Url, nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect to the callback, got %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+func signIn(t *testing.T, server *httptest.Server) *http.Client {
+	t.Helper()
+	browser := newBrowser(t)
+	if resp, body := do(t, browser, http.MethodGet, authorize(t, browser, server), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("sign in failed: %d %s", resp.StatusCode, body)
+	}
+	return browser
+}
+
+func TestSignInRequiresTheBrowserThatAskedForIt(t *testing.T) {
+	server := newTestServer(t)
+
+	// The callback of an attacker's sign in must not sign the victim in.
+	attacker, victim := newBrowser(t), newBrowser(t)
+	callback := authorize(t, attacker, server)
+	if resp, _ := do(t, victim, http.MethodGet, callback, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a callback from another browser to be rejected, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, victim, http.MethodGet, server.URL+"/api/session", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the victim not to be signed in, got %d", resp.StatusCode)
+	}
+
+	browser := signIn(t, server)
+	if resp, body := do(t, browser, http.MethodGet, server.URL+"/api/session", nil); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"authenticated":true`) {
+		t.Fatalf("expected a session, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestExportJob(t *testing.T) {
+	server := newTestServer(t)
+
+	if resp, _ := do(t, newBrowser(t), http.MethodGet, server.URL+"/api/export", nil); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Fatalf("expected GET export to be rejected, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, newBrowser(t), http.MethodPost, server.URL+"/api/jobs", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an export to require a session, got %d", resp.StatusCode)
+	}
+
+	browser := signIn(t, server)
+	resp, body := do(t, browser, http.MethodPost, server.URL+"/api/jobs", nil)
+	var job JobResponse
+	if err := json.Unmarshal([]byte(body), &job); resp.StatusCode != http.StatusAccepted || err != nil {
+		t.Fatalf("expected the job to start, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := do(t, newBrowser(t), http.MethodGet, server.URL+job.Status, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the job to be private to its session, got %d", resp.StatusCode)
+	}
+
+	events, err := browser.Get(server.URL + job.Events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var complete string
+	for scanner := bufio.NewScanner(events.Body); scanner.Scan(); {
+		if scanner.Text() == "event: complete" && scanner.Scan() {
+			complete = scanner.Text()
+			break
+		}
+	}
+	events.Body.Close()
+	if !strings.Contains(complete, `"state":"succeeded"`) {
+		t.Fatalf("expected the job to succeed, got %q", complete)
+	}
+
+	resp, body = do(t, browser, http.MethodGet, server.URL+job.Result, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "<kml") || !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment; filename=export-") {
+		t.Fatalf("unexpected result %d %s", resp.StatusCode, resp.Header)
+	}
+	if resp, _ := do(t, browser, http.MethodDelete, server.URL+job.Status, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the job to be dropped, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, browser, http.MethodGet, server.URL+job.Result, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the dropped job to be gone, got %d", resp.StatusCode)
+	}
+}
+
+func TestLiveFeed(t *testing.T) {
+	server := newTestServer(t)
+	browser := signIn(t, server)
+
+	resp, body := do(t, browser, http.MethodPost, server.URL+"/api/feeds?"+url.Values{"format": {"csv"}}.Encode(), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a CSV feed to be rejected, got %d %s", resp.StatusCode, body)
+	}
+	resp, body = do(t, browser, http.MethodPost, server.URL+"/api/feeds", nil)
+	var feed FeedResponse
+	if err := json.Unmarshal([]byte(body), &feed); resp.StatusCode != http.StatusCreated || err != nil {
+		t.Fatalf("expected the feed to be created, got %d %s", resp.StatusCode, body)
+	}
+
+	// Google Earth reads the feed without cookies.
+	earth := newBrowser(t)
+	if resp, body := do(t, earth, http.MethodGet, feed.Link, nil); resp.StatusCode != http.StatusOK || !strings.Contains(body, feed.Latest) {
+		t.Fatalf("expected the link to load the latest export, got %d %s", resp.StatusCode, body)
+	}
+	resp, body = do(t, earth, http.MethodGet, feed.Latest, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "<kml") {
+		t.Fatalf("expected the latest export, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, earth, http.MethodGet, feed.Latest, http.Header{"If-None-Match": {resp.Header.Get("ETag")}}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected an unchanged export not to be sent again, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := do(t, browser, http.MethodPost, server.URL+"/api/logout", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout failed: %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, earth, http.MethodGet, feed.Latest, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the feed to end on logout, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+const (
+	sessionCookie = "fs4map_session"
+	// stateCookie ties an OAuth state to the browser that asked for it.
+	stateCookie = "fs4map_oauth_state"
+)
+
+var errNoSession = errors.New("not authenticated, sign in with Foursquare first")
+
+type Session struct {
+	ID        string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type sessionEntry struct {
+	Session
+	sealedToken []byte
+}
+
+// SessionStore keeps access tokens on the server, sealed with AES-GCM, and
+// hands out HMAC-signed cookies that only carry the session ID.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionEntry
+	ttl      time.Duration
+	secret   []byte
+	signKey  []byte
+	aead     cipher.AEAD
+	secure   bool
+	path     string
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// NewSessionStore derives signing and encryption keys from secret. An empty
+// secret generates a random one, which invalidates sessions on restart.
+func NewSessionStore(secret string, ttl time.Duration, path string, secure bool) (*SessionStore, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(deriveKey(key, "session-token-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionStore{
+		sessions: make(map[string]*sessionEntry),
+		ttl:      ttl,
+		secret:   key,
+		signKey:  deriveKey(key, "session-cookie-signature"),
+		aead:     aead,
+		secure:   secure,
+		path:     path,
+	}, nil
+}
+
+// subKey derives a key for another purpose from the secret of the store,
+// so values signed for that purpose are never valid session cookies.
+func (s *SessionStore) subKey(purpose string) []byte {
+	return deriveKey(s.secret, purpose)
+}
+
+func signID(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyID(key []byte, value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i <= 0 {
+		return "", false
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(signID(key, id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+func (s *SessionStore) sign(id string) string {
+	return signID(s.signKey, id)
+}
+
+func (s *SessionStore) verify(value string) (string, bool) {
+	return verifyID(s.signKey, value)
+}
+
+func (s *SessionStore) seal(token kmlapi.FSQToken) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, []byte(token), nil), nil
+}
+
+func (s *SessionStore) open(sealed []byte) (kmlapi.FSQToken, error) {
+	size := s.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errNoSession
+	}
+	plain, err := s.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return kmlapi.NewToken(string(plain)), nil
+}
+
+// Create stores token in a new session and sets its cookie on w.
+func (s *SessionStore) Create(w http.ResponseWriter, token kmlapi.FSQToken) (Session, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Session{}, err
+	}
+	sealed, err := s.seal(token)
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	entry := &sessionEntry{
+		Session:     Session{ID: id, CreatedAt: now, ExpiresAt: now.Add(s.ttl)},
+		sealedToken: sealed,
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = entry
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.sign(id),
+		Path:     s.path,
+		Expires:  entry.ExpiresAt,
+		MaxAge:   int(s.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return entry.Session, nil
+}
+
+// Lookup returns the session and its access token for the request cookie.
+func (s *SessionStore) Lookup(r *http.Request) (Session, kmlapi.FSQToken, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, "", errNoSession
+	}
+	id, ok := s.verify(cookie.Value)
+	if !ok {
+		return Session{}, "", errNoSession
+	}
+
+	return s.Get(id)
+}
+
+// Get returns the session id and its access token while it is valid.
+func (s *SessionStore) Get(id string) (Session, kmlapi.FSQToken, error) {
+	s.mu.Lock()
+	entry, ok := s.sessions[id]
+	if ok && time.Now().After(entry.ExpiresAt) {
+		delete(s.sessions, id)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return Session{}, "", errNoSession
+	}
+
+	token, err := s.open(entry.sealedToken)
+	if err != nil {
+		return Session{}, "", err
+	}
+	return entry.Session, token, nil
+}
+
+// Destroy drops the session of the request, if any, and expires its cookie.
+func (s *SessionStore) Destroy(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if id, ok := s.verify(cookie.Value); ok {
+			s.mu.Lock()
+			delete(s.sessions, id)
+			s.mu.Unlock()
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     s.path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// BindState sets a short-lived cookie with a fresh binding for an OAuth
+// state and returns the binding.
+func (s *SessionStore) BindState(w http.ResponseWriter, ttl time.Duration) (string, error) {
+	binding, err := kmlapi.NewStateBinding()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    binding,
+		Path:     s.path,
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: true,
+		Secure:   s.secure,
+		// Lax still sends it on the redirect back from Foursquare.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return binding, nil
+}
+
+// StateBinding returns the binding of the request and expires its cookie,
+// since a state is used once.
+func (s *SessionStore) StateBinding(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    "",
+		Path:     s.path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return cookie.Value
+}
+
+func (s *SessionStore) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for id, entry := range s.sessions {
+				if now.After(entry.ExpiresAt) {
+					delete(s.sessions, id)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+func newTestSessions(t *testing.T) *SessionStore {
+	t.Helper()
+	sessions, err := NewSessionStore("test-secret", time.Hour, "/api/", false)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	return sessions
+}
+
+// withCookies is a request carrying the cookies set on rec.
+func withCookies(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSessionStoreSealsTheToken(t *testing.T) {
+	sessions := newTestSessions(t)
+	rec := httptest.NewRecorder()
+	session, err := sessions.Create(rec, kmlapi.NewToken("secret-token"))
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].Path != "/api/" || bytes.Contains([]byte(cookies[0].Value), []byte("secret-token")) {
+		t.Fatalf("unexpected session cookie %+v", cookies)
+	}
+	if sealed := sessions.sessions[session.ID].sealedToken; bytes.Contains(sealed, []byte("secret-token")) {
+		t.Fatal("expected the token to be sealed in memory")
+	}
+
+	got, token, err := sessions.Lookup(withCookies(rec))
+	if err != nil || got.ID != session.ID || token != "secret-token" {
+		t.Fatalf("expected the session back, got %+v %q %v", got, token, err)
+	}
+}
+
+func TestSessionStoreRejectsForgedAndExpiredCookies(t *testing.T) {
+	sessions := newTestSessions(t)
+	rec := httptest.NewRecorder()
+	session, _ := sessions.Create(rec, kmlapi.NewToken("secret-token"))
+
+	forged := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	forged.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.ID + ".forged"})
+	if _, _, err := sessions.Lookup(forged); !errors.Is(err, errNoSession) {
+		t.Fatalf("expected a forged cookie to be rejected, got %v", err)
+	}
+
+	// Another secret can neither verify the cookie nor open the token.
+	other, _ := NewSessionStore("other-secret", time.Hour, "/api/", false)
+	if _, ok := other.verify(rec.Result().Cookies()[0].Value); ok {
+		t.Fatal("expected a cookie signed with another secret to be rejected")
+	}
+	if _, err := other.open(sessions.sessions[session.ID].sealedToken); err == nil {
+		t.Fatal("expected a token sealed with another secret not to open")
+	}
+
+	sessions.sessions[session.ID].ExpiresAt = time.Now().Add(-time.Second)
+	if _, _, err := sessions.Lookup(withCookies(rec)); !errors.Is(err, errNoSession) {
+		t.Fatalf("expected an expired session to be rejected, got %v", err)
+	}
+	if _, ok := sessions.sessions[session.ID]; ok {
+		t.Fatal("expected an expired session to be dropped")
+	}
+}
+
+func TestSessionStoreDestroy(t *testing.T) {
+	sessions := newTestSessions(t)
+	rec := httptest.NewRecorder()
+	sessions.Create(rec, kmlapi.NewToken("secret-token"))
+
+	out := httptest.NewRecorder()
+	sessions.Destroy(out, withCookies(rec))
+	if cookies := out.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("expected the cookie to be expired, got %+v", cookies)
+	}
+	if _, _, err := sessions.Lookup(withCookies(rec)); !errors.Is(err, errNoSession) {
+		t.Fatalf("expected the session to be gone, got %v", err)
+	}
+}
+
+func TestSessionStoreStateBinding(t *testing.T) {
+	sessions := newTestSessions(t)
+	rec := httptest.NewRecorder()
+	binding, err := sessions.BindState(rec, time.Minute)
+	if err != nil || binding == "" {
+		t.Fatalf("BindState returned %q, %v", binding, err)
+	}
+	cookie := rec.Result().Cookies()[0]
+	if cookie.Name != stateCookie || !cookie.HttpOnly || cookie.MaxAge != 60 || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected state cookie %+v", cookie)
+	}
+
+	out := httptest.NewRecorder()
+	if got := sessions.StateBinding(out, withCookies(rec)); got != binding {
+		t.Fatalf("expected the binding back, got %q", got)
+	}
+	if cookies := out.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("expected the state cookie to be expired once used, got %+v", cookies)
+	}
+	if got := sessions.StateBinding(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)); got != "" {
+		t.Fatalf("expected no binding without the cookie, got %q", got)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+const sseKeepAlive = 15 * time.Second
+
+type ProgressMessage struct {
+	Stage      string              `json:"stage"`
+	Page       int                 `json:"page,omitempty"`
+	Fetched    int                 `json:"fetched"`
+	Total      int                 `json:"total"`
+	Percent    float64             `json:"percent"`
+	ETASeconds float64             `json:"eta_seconds,omitempty"`
+	Attempt    int                 `json:"attempt,omitempty"`
+	DelayMs    int64               `json:"delay_ms,omitempty"`
+	Message    string              `json:"message,omitempty"`
+	Stats      *kmlapi.ExportStats `json:"stats,omitempty"`
+}
+
+type CompletionMessage struct {
+	ID     string             `json:"id"`
+	State  JobState           `json:"state"`
+	Result string             `json:"result,omitempty"`
+	Stats  kmlapi.ExportStats `json:"stats"`
+	Error  string             `json:"error,omitempty"`
+}
+
+// sseEventName maps progress kinds onto the SSE event field so that browser
+// clients can subscribe with addEventListener per kind.
+func sseEventName(kind kmlapi.ProgressEventKind) string {
+	switch kind {
+	case kmlapi.StageStarted, kmlapi.StageFinished:
+		return "stage"
+	case kmlapi.PageFetched:
+		return "progress"
+	case kmlapi.RetryScheduled:
+		return "retry"
+	case kmlapi.Warning:
+		return "warning"
+	case kmlapi.StatsSnapshot:
+		return "stats"
+	default:
+		return "message"
+	}
+}
+
+func progressMessage(e kmlapi.ProgressEvent) ProgressMessage {
+	msg := ProgressMessage{
+		Stage:   e.Stage,
+		Page:    e.Page,
+		Fetched: e.Fetched,
+		Total:   e.Total,
+		Percent: e.Percent(),
+		Attempt: e.Attempt,
+		Message: e.Message,
+		Stats:   e.Stats,
+	}
+	if eta := e.ETA(); eta > 0 {
+		msg.ETASeconds = eta.Seconds()
+	}
+	if e.Delay > 0 {
+		msg.DelayMs = e.Delay.Milliseconds()
+	}
+	if e.Kind == kmlapi.RetryScheduled && e.Err != nil {
+		msg.Message = e.Err.Error()
+	}
+	if e.Kind == kmlapi.StageFinished {
+		msg.Message = "finished"
+	}
+	if e.Kind == kmlapi.StageStarted {
+		msg.Message = "started"
+	}
+	return msg
+}
+
+func writeSSE(w http.ResponseWriter, id int, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// streamJobEvents replays the job's events from the Last-Event-ID the client
+// reconnects with, follows new ones as they arrive and finishes with a
+// "complete" event that links to the result. A client behind the kept
+// events first gets a "snapshot" event with the whole job status.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, job *Job, resultUrl string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	next, err := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if err != nil || next < 0 {
+		next = 0
+	}
+
+	allowOrigin(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, dropped, done, changed := job.Events(next)
+		if next < dropped {
+			// The status covers every dropped event, so the client resumes
+			// after them.
+			next = dropped
+			if err := writeSSE(w, next, "snapshot", job.Status()); err != nil {
+				return
+			}
+		}
+		for _, e := range events {
+			if e.Seq <= next {
+				continue
+			}
+			next = e.Seq
+			if err := writeSSE(w, next, sseEventName(e.Kind), progressMessage(e.ProgressEvent)); err != nil {
+				return
+			}
+		}
+		if done {
+			status := job.Status()
+			completion := CompletionMessage{ID: status.ID, State: status.State, Stats: status.Stats, Error: status.Error}
+			if status.State == JobSucceeded {
+				completion.Result = resultUrl
+			}
+			writeSSE(w, 0, "complete", completion)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jdevelop/fs4map/kmlapi"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE reads the events of a stream up to and including "complete".
+func readSSE(t *testing.T, url, lastEventID string) []sseEvent {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	var events []sseEvent
+	var e sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		case line == "" && e.event != "":
+			events = append(events, e)
+			if e.event == "complete" {
+				return events
+			}
+			e = sseEvent{}
+		}
+	}
+	t.Fatalf("stream ended without a complete event: %+v", events)
+	return nil
+}
+
+func finishedJob(t *testing.T, pages int) *Job {
+	t.Helper()
+	jobs := NewJobManager(1, 0)
+	job, _ := jobs.Start("alice", func(ctx context.Context, listener kmlapi.ProgressListener) (*ExportResult, error) {
+		listener.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.StageStarted, Stage: "checkins"})
+		for i := 1; i <= pages; i++ {
+			listener.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.PageFetched, Stage: "checkins", Page: i})
+		}
+		listener.OnProgress(kmlapi.ProgressEvent{Kind: kmlapi.StageFinished, Stage: "checkins"})
+		return &ExportResult{}, nil
+	})
+	waitJob(t, job)
+	return job
+}
+
+func jobEventsServer(job *Job) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamJobEvents(w, r, job, "/api/jobs/"+job.ID()+"/result")
+	}))
+}
+
+func TestStreamJobEventsResumes(t *testing.T) {
+	job := finishedJob(t, 3)
+	server := jobEventsServer(job)
+	defer server.Close()
+
+	events := readSSE(t, server.URL, "")
+	var names []string
+	for _, e := range events {
+		names = append(names, e.id+":"+e.event)
+	}
+	if got := strings.Join(names, " "); got != "1:stage 2:progress 3:progress 4:progress 5:stage :complete" {
+		t.Fatalf("unexpected events %s", got)
+	}
+	if complete := events[len(events)-1].data; !strings.Contains(complete, `"state":"succeeded"`) || !strings.Contains(complete, "/result") {
+		t.Fatalf("unexpected completion %s", complete)
+	}
+
+	resumed := readSSE(t, server.URL, "3")
+	if len(resumed) != 3 || resumed[0].id != "4" || resumed[1].id != "5" {
+		t.Fatalf("expected to resume after event 3, got %+v", resumed)
+	}
+}
+
+func TestStreamJobEventsSnapshotsDroppedEvents(t *testing.T) {
+	pages := 2 * maxJobEvents
+	job := finishedJob(t, pages)
+	_, dropped, _, _ := job.Events(0)
+	server := jobEventsServer(job)
+	defer server.Close()
+
+	events := readSSE(t, server.URL, "1")
+	if events[0].event != "snapshot" || events[0].id != strconv.Itoa(dropped) {
+		t.Fatalf("expected a snapshot up to event %d first, got %+v", dropped, events[0])
+	}
+	if !strings.Contains(events[0].data, `"progress":{"checkins"`) {
+		t.Fatalf("expected the snapshot to carry the job status, got %s", events[0].data)
+	}
+	for _, e := range events[1 : len(events)-1] {
+		if seq, _ := strconv.Atoi(e.id); seq <= dropped {
+			t.Fatalf("expected only events after the snapshot, got %s", e.id)
+		}
+	}
+
+	// A client ahead of the compacted events resumes without a snapshot.
+	last := strconv.Itoa(pages + 1)
+	if events := readSSE(t, server.URL, last); len(events) != 2 || events[0].event != "stage" {
+		t.Fatalf("expected only the last stage event, got %+v", events)
+	}
+}
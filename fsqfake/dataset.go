@@ -0,0 +1,348 @@
+// Package fsqfake implements the subset of the Foursquare v2 API used by
+// kmlapi on top of a synthetic, seedable dataset, for development and tests
+// without network access.
+package fsqfake
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+type Category struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Categories []Category `json:"categories"`
+	// PlacesId is the id in the numeric Places API v3 taxonomy.
+	PlacesId int `json:"-"`
+}
+
+type Location struct {
+	Address          string   `json:"address,omitempty"`
+	Lat              float64  `json:"lat"`
+	Lng              float64  `json:"lng"`
+	PostalCode       string   `json:"postalCode,omitempty"`
+	Cc               string   `json:"cc,omitempty"`
+	City             string   `json:"city,omitempty"`
+	State            string   `json:"state,omitempty"`
+	Country          string   `json:"country,omitempty"`
+	FormattedAddress []string `json:"formattedAddress,omitempty"`
+}
+
+type Contact struct {
+	Phone          string `json:"phone,omitempty"`
+	FormattedPhone string `json:"formattedPhone,omitempty"`
+}
+
+type VenueCategory struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Primary  bool   `json:"primary"`
+	PlacesId int    `json:"-"`
+}
+
+type Venue struct {
+	Id         string          `json:"id"`
+	Name       string          `json:"name"`
+	Location   Location        `json:"location"`
+	Categories []VenueCategory `json:"categories"`
+	Contact    Contact         `json:"contact"`
+	Url        string          `json:"url,omitempty"`
+}
+
+type Checkin struct {
+	Id        string
+	CreatedAt int64
+	// VenueId is empty for checkins without a venue, like shouts.
+	VenueId string
+}
+
+type ListItem struct {
+	Id        string
+	VenueId   string
+	CreatedAt int64
+	Note      string
+}
+
+// List is a curated list of venues. The saved and liked lists have ids
+// ending in /todos and /venuelikes like the real ones.
+type List struct {
+	Id          string
+	Name        string
+	Description string
+	Items       []ListItem
+}
+
+// Tip is a tip the user left on a venue.
+type Tip struct {
+	Id        string
+	VenueId   string
+	CreatedAt int64
+	Text      string
+}
+
+// Photo is a photo the user added to a checkin. It is served as a generated
+// image under /img/.
+type Photo struct {
+	Id        string
+	VenueId   string
+	CreatedAt int64
+}
+
+// Dataset is the history served by a Server. Checkins, tips and photos are
+// sorted newest first, as the API returns them.
+type Dataset struct {
+	Categories []Category
+	Venues     []Venue
+	Checkins   []Checkin
+	Lists      []List
+	Tips       []Tip
+	Photos     []Photo
+
+	venues map[string]*Venue
+}
+
+func (d *Dataset) index() {
+	d.venues = make(map[string]*Venue, len(d.Venues))
+	for i := range d.Venues {
+		d.venues[d.Venues[i].Id] = &d.Venues[i]
+	}
+	sort.SliceStable(d.Checkins, func(i, j int) bool {
+		return d.Checkins[i].CreatedAt > d.Checkins[j].CreatedAt
+	})
+	sort.SliceStable(d.Tips, func(i, j int) bool {
+		return d.Tips[i].CreatedAt > d.Tips[j].CreatedAt
+	})
+	sort.SliceStable(d.Photos, func(i, j int) bool {
+		return d.Photos[i].CreatedAt > d.Photos[j].CreatedAt
+	})
+}
+
+// Venue returns the venue with the given id.
+func (d *Dataset) Venue(id string) (Venue, bool) {
+	v, ok := d.venues[id]
+	if !ok {
+		return Venue{}, false
+	}
+	return *v, true
+}
+
+// NewDataset wraps hand written venues and checkins, e.g. for a test.
+func NewDataset(categories []Category, venues []Venue, checkins []Checkin) *Dataset {
+	d := &Dataset{Categories: categories, Venues: venues, Checkins: checkins}
+	d.index()
+	return d
+}
+
+type GenerateOptions struct {
+	Seed     int64
+	Venues   int
+	Checkins int
+	// Checkins are spread over [From, To).
+	From time.Time
+	To   time.Time
+	// ShoutRate is the fraction of checkins without a venue.
+	ShoutRate float64
+	// ListItems is the size of each generated list; 0 generates none.
+	ListItems int
+	// Tips and Photos are left at the venues of random checkins.
+	Tips   int
+	Photos int
+}
+
+func DefaultGenerateOptions() GenerateOptions {
+	to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return GenerateOptions{
+		Seed:      1,
+		Venues:    200,
+		Checkins:  2000,
+		From:      to.AddDate(-5, 0, 0),
+		To:        to,
+		ShoutRate: 0.01,
+		ListItems: 10,
+		Tips:      20,
+		Photos:    30,
+	}
+}
+
+const fakeUserId = "1001"
+
+var tipTexts = []string{
+	"Great coffee, slow wifi",
+	"Ask for the daily special",
+	"Cash only",
+	"Best seats are by the window",
+	"Crowded on weekends, come on a weekday",
+	"Friendly staff & quick service",
+	"Try the <house> lemonade",
+}
+
+var listNotes = []string{"", "", "Try the tasting menu", "Go early, it gets busy", "Recommended by a friend", "Rooftop view"}
+
+type city struct {
+	name, state, country, cc, postalCode string
+	lat, lng                             float64
+}
+
+var cities = []city{
+	{"New York", "NY", "United States", "US", "10001", 40.7128, -74.0060},
+	{"San Francisco", "CA", "United States", "US", "94103", 37.7749, -122.4194},
+	{"London", "England", "United Kingdom", "GB", "EC1A 1BB", 51.5074, -0.1278},
+	{"Berlin", "Berlin", "Germany", "DE", "10115", 52.5200, 13.4050},
+	{"Tokyo", "Tokyo", "Japan", "JP", "100-0001", 35.6762, 139.6503},
+	{"Lisbon", "Lisboa", "Portugal", "PT", "1100-148", 38.7223, -9.1393},
+}
+
+var streets = []string{"Main St", "Market St", "High St", "Station Rd", "Park Ave", "Harbour Way", "Church St", "Mill Ln"}
+
+// DefaultCategories is a small two level taxonomy shaped like the real one.
+var DefaultCategories = []Category{
+	{Id: "fake-food", Name: "Food", Categories: []Category{
+		{Id: "fake-coffee", Name: "Coffee Shop", PlacesId: 13035},
+		{Id: "fake-pizza", Name: "Pizza Place", PlacesId: 13064},
+		{Id: "fake-sushi", Name: "Sushi Restaurant", PlacesId: 13276},
+		{Id: "fake-bakery", Name: "Bakery", PlacesId: 13002},
+	}},
+	{Id: "fake-nightlife", Name: "Nightlife Spot", Categories: []Category{
+		{Id: "fake-bar", Name: "Bar", PlacesId: 13003},
+		{Id: "fake-pub", Name: "Pub", PlacesId: 13018},
+	}},
+	{Id: "fake-travel", Name: "Travel & Transport", Categories: []Category{
+		{Id: "fake-airport", Name: "Airport", PlacesId: 19040},
+		{Id: "fake-hotel", Name: "Hotel", PlacesId: 19014},
+		{Id: "fake-train", Name: "Train Station", PlacesId: 19047},
+	}},
+	{Id: "fake-outdoors", Name: "Outdoors & Recreation", Categories: []Category{
+		{Id: "fake-park", Name: "Park", PlacesId: 16032},
+		{Id: "fake-beach", Name: "Beach", PlacesId: 16003},
+	}},
+	{Id: "fake-shops", Name: "Shop & Service", Categories: []Category{
+		{Id: "fake-books", Name: "Bookstore", PlacesId: 17018},
+		{Id: "fake-grocery", Name: "Grocery Store", PlacesId: 17069},
+	}},
+	{Id: "fake-arts", Name: "Arts & Entertainment", Categories: []Category{
+		{Id: "fake-museum", Name: "Museum", PlacesId: 10027},
+		{Id: "fake-cinema", Name: "Movie Theater", PlacesId: 10024},
+	}},
+}
+
+func leafCategories(cats []Category) []VenueCategory {
+	var out []VenueCategory
+	for _, c := range cats {
+		if len(c.Categories) == 0 {
+			out = append(out, VenueCategory{Id: c.Id, Name: c.Name, PlacesId: c.PlacesId})
+			continue
+		}
+		out = append(out, leafCategories(c.Categories)...)
+	}
+	return out
+}
+
+// Generate builds a synthetic history. The same options always produce the
+// same dataset. Visits follow a Zipf distribution, so a few venues collect
+// most checkins like in a real history.
+func Generate(opts GenerateOptions) *Dataset {
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	leaves := leafCategories(DefaultCategories)
+
+	venues := make([]Venue, opts.Venues)
+	for i := range venues {
+		c := cities[rnd.Intn(len(cities))]
+		cat := leaves[rnd.Intn(len(leaves))]
+		cat.Primary = true
+		address := fmt.Sprintf("%d %s", 1+rnd.Intn(300), streets[rnd.Intn(len(streets))])
+		id := fmt.Sprintf("%024x", rnd.Int63())
+		venues[i] = Venue{
+			Id:   id,
+			Name: fmt.Sprintf("%s %s #%d", c.name, cat.Name, i+1),
+			Location: Location{
+				Address:          address,
+				Lat:              c.lat + (rnd.Float64()-0.5)*0.2,
+				Lng:              c.lng + (rnd.Float64()-0.5)*0.2,
+				PostalCode:       c.postalCode,
+				Cc:               c.cc,
+				City:             c.name,
+				State:            c.state,
+				Country:          c.country,
+				FormattedAddress: []string{address, fmt.Sprintf("%s %s", c.name, c.postalCode), c.country},
+			},
+			Categories: []VenueCategory{cat},
+			// Derived from the index so the history of a seed stays put.
+			Contact: Contact{Phone: fmt.Sprintf("555%07d", i+1), FormattedPhone: fmt.Sprintf("(555) %03d-%04d", (i+1)/10000, (i+1)%10000)},
+			Url:     fmt.Sprintf("https://example.com/venues/%s", id),
+		}
+	}
+
+	checkins := make([]Checkin, opts.Checkins)
+	span := opts.To.Unix() - opts.From.Unix()
+	if span <= 0 {
+		span = 1
+	}
+	var zipf *rand.Zipf
+	if len(venues) > 1 {
+		zipf = rand.NewZipf(rnd, 1.2, 1, uint64(len(venues)-1))
+	}
+	for i := range checkins {
+		checkins[i] = Checkin{
+			Id:        fmt.Sprintf("%024x", rnd.Int63()),
+			CreatedAt: opts.From.Unix() + rnd.Int63n(span),
+		}
+		if rnd.Float64() < opts.ShoutRate || len(venues) == 0 {
+			continue
+		}
+		idx := 0
+		if zipf != nil {
+			idx = int(zipf.Uint64())
+		}
+		checkins[i].VenueId = venues[idx].Id
+	}
+
+	d := NewDataset(DefaultCategories, venues, checkins)
+	// Lists come last so they do not change the history of a seed.
+	if opts.ListItems > 0 && len(venues) > 0 {
+		for _, l := range []List{
+			{Id: fakeUserId + "/todos", Name: "Saved places"},
+			{Id: fakeUserId + "/venuelikes", Name: "Liked places"},
+			{Id: fmt.Sprintf("%024x", rnd.Int63()), Name: "To try", Description: "Places friends keep recommending"},
+		} {
+			for _, idx := range rnd.Perm(len(venues))[:min(opts.ListItems, len(venues))] {
+				l.Items = append(l.Items, ListItem{
+					Id:        fmt.Sprintf("v%s", venues[idx].Id),
+					VenueId:   venues[idx].Id,
+					CreatedAt: opts.From.Unix() + rnd.Int63n(span),
+					Note:      listNotes[rnd.Intn(len(listNotes))],
+				})
+			}
+			d.Lists = append(d.Lists, l)
+		}
+	}
+	// Tips and photos follow a checkin at their venue.
+	var visits []Checkin
+	for _, c := range checkins {
+		if c.VenueId != "" {
+			visits = append(visits, c)
+		}
+	}
+	if len(visits) > 0 {
+		for i := 0; i < opts.Tips; i++ {
+			c := visits[rnd.Intn(len(visits))]
+			d.Tips = append(d.Tips, Tip{
+				Id:        fmt.Sprintf("%024x", rnd.Int63()),
+				VenueId:   c.VenueId,
+				CreatedAt: c.CreatedAt + 60 + rnd.Int63n(3600),
+				Text:      tipTexts[rnd.Intn(len(tipTexts))],
+			})
+		}
+		for i := 0; i < opts.Photos; i++ {
+			c := visits[rnd.Intn(len(visits))]
+			d.Photos = append(d.Photos, Photo{
+				Id:        fmt.Sprintf("%024x", rnd.Int63()),
+				VenueId:   c.VenueId,
+				CreatedAt: c.CreatedAt + rnd.Int63n(600),
+			})
+		}
+		d.index()
+	}
+	return d
+}
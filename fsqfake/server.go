@@ -0,0 +1,556 @@
+package fsqfake
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultClientId     = "fake-client-id"
+	DefaultClientSecret = "fake-client-secret"
+	DefaultToken        = "fake-token"
+	DefaultAPIKey       = "fake-api-key"
+
+	checkinsDefaultLimit = 20
+	checkinsMaxLimit     = 250
+)
+
+// Server serves the dataset under /v2 and a consent-free OAuth flow under
+// /oauth2: authenticate redirects straight back with a code, and
+// access_token trades each code once for Token.
+type Server struct {
+	Data         *Dataset
+	ClientId     string
+	ClientSecret string
+	Token        string
+	// APIKey is the Authorization header the Places API v3 expects.
+	APIKey string
+	// HistoryLimit caps venuehistory responses without a limit parameter,
+	// mimicking the truncated first page of the real API. 0 returns all.
+	HistoryLimit int
+
+	mu    sync.Mutex
+	codes map[string]string
+
+	mux *http.ServeMux
+}
+
+func NewServer(data *Dataset) *Server {
+	s := &Server{
+		Data:         data,
+		ClientId:     DefaultClientId,
+		ClientSecret: DefaultClientSecret,
+		Token:        DefaultToken,
+		APIKey:       DefaultAPIKey,
+		codes:        make(map[string]string),
+		mux:          http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v2/users/self/venuehistory", s.authorized(s.venueHistory))
+	s.mux.HandleFunc("/v2/users/self/checkins", s.authorized(s.checkins))
+	s.mux.HandleFunc("/v2/venues/categories", s.authorized(s.categories))
+	s.mux.HandleFunc("/v2/users/self/lists", s.authorized(s.userLists))
+	s.mux.HandleFunc("/v2/lists/", s.authorized(s.list))
+	s.mux.HandleFunc("/v2/users/self/tips", s.authorized(s.tips))
+	s.mux.HandleFunc("/v2/users/self/photos", s.authorized(s.photos))
+	s.mux.HandleFunc("/img/general/", s.image)
+	s.mux.HandleFunc("/v3/places/", s.place)
+	s.mux.HandleFunc("/oauth2/authenticate", s.authenticate)
+	s.mux.HandleFunc("/oauth2/access_token", s.accessToken)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type meta struct {
+	Code        int    `json:"code"`
+	ErrorType   string `json:"errorType,omitempty"`
+	ErrorDetail string `json:"errorDetail,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeResponse(w http.ResponseWriter, response interface{}) {
+	writeJSON(w, http.StatusOK, struct {
+		Meta     meta        `json:"meta"`
+		Response interface{} `json:"response"`
+	}{meta{Code: http.StatusOK}, response})
+}
+
+func writeError(w http.ResponseWriter, status int, errorType string, detail string) {
+	writeJSON(w, status, struct {
+		Meta     meta     `json:"meta"`
+		Response struct{} `json:"response"`
+	}{Meta: meta{Code: status, ErrorType: errorType, ErrorDetail: detail}})
+}
+
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("oauth_token") != s.Token {
+			writeError(w, http.StatusUnauthorized, "invalid_auth", "OAuth token invalid or revoked.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// window holds the paging and time filters shared by the history endpoints.
+// Both timestamps are exclusive.
+type window struct {
+	before, after int64
+	limit, offset int
+	hasLimit      bool
+}
+
+func (win window) contains(ts int64) bool {
+	return (win.before == 0 || ts < win.before) && (win.after == 0 || ts > win.after)
+}
+
+func page[T any](items []T, win window) []T {
+	if win.offset >= len(items) {
+		return []T{}
+	}
+	items = items[win.offset:]
+	if win.hasLimit && win.limit < len(items) {
+		items = items[:win.limit]
+	}
+	return items
+}
+
+func parseWindow(q url.Values) (window, string) {
+	var win window
+	intParam := func(name string, dst *int64) bool {
+		v := q.Get(name)
+		if v == "" {
+			return true
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return false
+		}
+		*dst = n
+		return true
+	}
+	var limit, offset int64
+	for name, dst := range map[string]*int64{
+		"beforeTimestamp": &win.before,
+		"afterTimestamp":  &win.after,
+		"limit":           &limit,
+		"offset":          &offset,
+	} {
+		if !intParam(name, dst) {
+			return win, "invalid " + name
+		}
+	}
+	win.limit, win.offset = int(limit), int(offset)
+	win.hasLimit = q.Get("limit") != ""
+	return win, ""
+}
+
+func (s *Server) venueHistory(w http.ResponseWriter, r *http.Request) {
+	win, bad := parseWindow(r.URL.Query())
+	if bad != "" {
+		writeError(w, http.StatusBadRequest, "param_error", bad)
+		return
+	}
+
+	type item struct {
+		BeenHere int   `json:"beenHere"`
+		Venue    Venue `json:"venue"`
+		last     int64
+	}
+	visits := make(map[string]*item)
+	var items []*item
+	for _, c := range s.Data.Checkins {
+		if c.VenueId == "" || !win.contains(c.CreatedAt) {
+			continue
+		}
+		it, ok := visits[c.VenueId]
+		if !ok {
+			venue, found := s.Data.Venue(c.VenueId)
+			if !found {
+				continue
+			}
+			it = &item{Venue: venue, last: c.CreatedAt}
+			visits[c.VenueId] = it
+			items = append(items, it)
+		}
+		it.BeenHere++
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].last > items[j].last })
+
+	if !win.hasLimit && s.HistoryLimit > 0 {
+		win.hasLimit, win.limit = true, s.HistoryLimit
+	}
+	var body struct {
+		Venues struct {
+			Count int     `json:"count"`
+			Items []*item `json:"items"`
+		} `json:"venues"`
+	}
+	body.Venues.Count = len(items)
+	body.Venues.Items = page(items, win)
+	writeResponse(w, body)
+}
+
+func (s *Server) checkins(w http.ResponseWriter, r *http.Request) {
+	win, bad := parseWindow(r.URL.Query())
+	if bad != "" {
+		writeError(w, http.StatusBadRequest, "param_error", bad)
+		return
+	}
+	if !win.hasLimit {
+		win.hasLimit, win.limit = true, checkinsDefaultLimit
+	}
+	if win.limit > checkinsMaxLimit {
+		writeError(w, http.StatusBadRequest, "param_error", "limit must be at most 250")
+		return
+	}
+
+	type item struct {
+		Id        string `json:"id"`
+		CreatedAt int64  `json:"createdAt"`
+		Type      string `json:"type"`
+		Venue     *Venue `json:"venue,omitempty"`
+	}
+	var items []item
+	for _, c := range s.Data.Checkins {
+		if !win.contains(c.CreatedAt) {
+			continue
+		}
+		it := item{Id: c.Id, CreatedAt: c.CreatedAt, Type: "checkin"}
+		if venue, ok := s.Data.Venue(c.VenueId); ok {
+			it.Venue = &venue
+		} else {
+			it.Type = "shout"
+		}
+		items = append(items, it)
+	}
+
+	var body struct {
+		Checkins struct {
+			Count int    `json:"count"`
+			Items []item `json:"items"`
+		} `json:"checkins"`
+	}
+	body.Checkins.Count = len(items)
+	body.Checkins.Items = page(items, win)
+	writeResponse(w, body)
+}
+
+func (s *Server) categories(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, struct {
+		Categories []Category `json:"categories"`
+	}{s.Data.Categories})
+}
+
+type listSummary struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ListItems   struct {
+		Count int `json:"count"`
+	} `json:"listItems"`
+}
+
+func (s *Server) userLists(w http.ResponseWriter, r *http.Request) {
+	type group struct {
+		Type  string        `json:"type"`
+		Count int           `json:"count"`
+		Items []listSummary `json:"items"`
+	}
+	created := group{Type: "created", Items: []listSummary{}}
+	for _, l := range s.Data.Lists {
+		summary := listSummary{Id: l.Id, Name: l.Name, Description: l.Description}
+		summary.ListItems.Count = len(l.Items)
+		created.Items = append(created.Items, summary)
+	}
+	created.Count = len(created.Items)
+	var body struct {
+		Lists struct {
+			Count  int     `json:"count"`
+			Groups []group `json:"groups"`
+		} `json:"lists"`
+	}
+	body.Lists.Count = created.Count
+	body.Lists.Groups = []group{created, {Type: "followed", Items: []listSummary{}}}
+	writeResponse(w, body)
+}
+
+// list serves a list with its items paged by limit and offset.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v2/lists/")
+	var found *List
+	for i := range s.Data.Lists {
+		if s.Data.Lists[i].Id == id {
+			found = &s.Data.Lists[i]
+		}
+	}
+	if found == nil {
+		writeError(w, http.StatusNotFound, "not_found", "List not found.")
+		return
+	}
+	win, bad := parseWindow(r.URL.Query())
+	if bad != "" {
+		writeError(w, http.StatusBadRequest, "param_error", bad)
+		return
+	}
+
+	type text struct {
+		Text string `json:"text"`
+	}
+	type item struct {
+		Id        string `json:"id"`
+		CreatedAt int64  `json:"createdAt"`
+		Venue     *Venue `json:"venue,omitempty"`
+		Note      *text  `json:"note,omitempty"`
+	}
+	items := make([]item, 0, len(found.Items))
+	for _, it := range found.Items {
+		out := item{Id: it.Id, CreatedAt: it.CreatedAt}
+		if venue, ok := s.Data.Venue(it.VenueId); ok {
+			out.Venue = &venue
+		}
+		if it.Note != "" {
+			out.Note = &text{it.Note}
+		}
+		items = append(items, out)
+	}
+
+	var body struct {
+		List struct {
+			Id          string `json:"id"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			ListItems   struct {
+				Count int    `json:"count"`
+				Items []item `json:"items"`
+			} `json:"listItems"`
+		} `json:"list"`
+	}
+	body.List.Id, body.List.Name, body.List.Description = found.Id, found.Name, found.Description
+	body.List.ListItems.Count = len(items)
+	body.List.ListItems.Items = page(items, win)
+	writeResponse(w, body)
+}
+
+type venueRef struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func (s *Server) venueRef(id string) *venueRef {
+	v, ok := s.Data.Venue(id)
+	if !ok {
+		return nil
+	}
+	return &venueRef{Id: v.Id, Name: v.Name}
+}
+
+func (s *Server) tips(w http.ResponseWriter, r *http.Request) {
+	win, bad := parseWindow(r.URL.Query())
+	if bad != "" {
+		writeError(w, http.StatusBadRequest, "param_error", bad)
+		return
+	}
+	type item struct {
+		Id        string    `json:"id"`
+		CreatedAt int64     `json:"createdAt"`
+		Text      string    `json:"text"`
+		Venue     *venueRef `json:"venue,omitempty"`
+	}
+	items := make([]item, 0, len(s.Data.Tips))
+	for _, t := range s.Data.Tips {
+		items = append(items, item{Id: t.Id, CreatedAt: t.CreatedAt, Text: t.Text, Venue: s.venueRef(t.VenueId)})
+	}
+	var body struct {
+		Tips struct {
+			Count int    `json:"count"`
+			Items []item `json:"items"`
+		} `json:"tips"`
+	}
+	body.Tips.Count = len(items)
+	body.Tips.Items = page(items, win)
+	writeResponse(w, body)
+}
+
+// photos serves photo metadata whose prefix points back at this server, so
+// the images resolve without network access.
+func (s *Server) photos(w http.ResponseWriter, r *http.Request) {
+	win, bad := parseWindow(r.URL.Query())
+	if bad != "" {
+		writeError(w, http.StatusBadRequest, "param_error", bad)
+		return
+	}
+	type item struct {
+		Id        string    `json:"id"`
+		CreatedAt int64     `json:"createdAt"`
+		Prefix    string    `json:"prefix"`
+		Suffix    string    `json:"suffix"`
+		Venue     *venueRef `json:"venue,omitempty"`
+	}
+	prefix := "http://" + r.Host + "/img/general/"
+	items := make([]item, 0, len(s.Data.Photos))
+	for _, p := range s.Data.Photos {
+		items = append(items, item{Id: p.Id, CreatedAt: p.CreatedAt, Prefix: prefix, Suffix: "/" + p.Id + ".jpg", Venue: s.venueRef(p.VenueId)})
+	}
+	var body struct {
+		Photos struct {
+			Count int    `json:"count"`
+			Items []item `json:"items"`
+		} `json:"photos"`
+	}
+	body.Photos.Count = len(items)
+	body.Photos.Items = page(items, win)
+	writeResponse(w, body)
+}
+
+// image serves /img/general/<size>/<id>.jpg as a solid JPEG of that size,
+// colored after the photo id.
+func (s *Server) image(w http.ResponseWriter, r *http.Request) {
+	size, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/img/general/"), "/")
+	id := strings.TrimSuffix(name, ".jpg")
+	if !ok || id == name {
+		http.NotFound(w, r)
+		return
+	}
+	width, height := 300, 300
+	if size != "original" {
+		ws, hs, _ := strings.Cut(size, "x")
+		var errW, errH error
+		width, errW = strconv.Atoi(ws)
+		height, errH = strconv.Atoi(hs)
+		if errW != nil || errH != nil || width <= 0 || height <= 0 || width > 2000 || height > 2000 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	sum := h.Sum32()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{uint8(sum), uint8(sum >> 8), uint8(sum >> 16), 0xff}}, image.Point{}, draw.Src)
+	w.Header().Set("Content-Type", "image/jpeg")
+	jpeg.Encode(w, img, nil)
+}
+
+type placeCategory struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type place struct {
+	FsqId    string `json:"fsq_id"`
+	Name     string `json:"name"`
+	Geocodes struct {
+		Main struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"main"`
+	} `json:"geocodes"`
+	Location struct {
+		Address          string `json:"address,omitempty"`
+		Locality         string `json:"locality,omitempty"`
+		Region           string `json:"region,omitempty"`
+		Postcode         string `json:"postcode,omitempty"`
+		Country          string `json:"country,omitempty"`
+		FormattedAddress string `json:"formatted_address,omitempty"`
+	} `json:"location"`
+	Categories []placeCategory `json:"categories"`
+	Website    string          `json:"website,omitempty"`
+	Tel        string          `json:"tel,omitempty"`
+}
+
+// place serves a venue the way the Places API v3 does: keyed by fsq_id,
+// authorized by the API key and with the numeric category taxonomy.
+func (s *Server) place(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != s.APIKey {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Invalid request token."})
+		return
+	}
+	v, ok := s.Data.Venue(strings.TrimPrefix(r.URL.Path, "/v3/places/"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Place not found"})
+		return
+	}
+	p := place{FsqId: v.Id, Name: v.Name, Website: v.Url, Tel: v.Contact.FormattedPhone}
+	p.Geocodes.Main.Latitude = v.Location.Lat
+	p.Geocodes.Main.Longitude = v.Location.Lng
+	p.Location.Address = v.Location.Address
+	p.Location.Locality = v.Location.City
+	p.Location.Region = v.Location.State
+	p.Location.Postcode = v.Location.PostalCode
+	p.Location.Country = v.Location.Cc
+	p.Location.FormattedAddress = strings.Join(v.Location.FormattedAddress, ", ")
+	for _, c := range v.Categories {
+		if c.PlacesId != 0 {
+			p.Categories = append(p.Categories, placeCategory{Id: c.PlacesId, Name: c.Name})
+		}
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientId {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(buf)
+	s.mu.Lock()
+	s.codes[code] = q.Get("redirect_uri")
+	s.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	if state := q.Get("state"); state != "" {
+		back.Set("state", state)
+	}
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) accessToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientId || q.Get("client_secret") != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	s.mu.Lock()
+	redirect, ok := s.codes[q.Get("code")]
+	delete(s.codes, q.Get("code"))
+	s.mu.Unlock()
+	if !ok || redirect != q.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": s.Token})
+}
@@ -0,0 +1,273 @@
+package fsqfake
+
+import (
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, server *httptest.Server, path string, q url.Values, out interface{}) int {
+	t.Helper()
+	resp, err := http.Get(server.URL + path + "?" + q.Encode())
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("decode %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	opts := DefaultGenerateOptions()
+	a, b := Generate(opts), Generate(opts)
+	if !reflect.DeepEqual(a.Venues, b.Venues) || !reflect.DeepEqual(a.Checkins, b.Checkins) || !reflect.DeepEqual(a.Lists, b.Lists) {
+		t.Fatal("expected the same seed to produce the same dataset")
+	}
+	opts.Seed++
+	if reflect.DeepEqual(a.Checkins, Generate(opts).Checkins) {
+		t.Fatal("expected another seed to produce another dataset")
+	}
+	for i := 1; i < len(a.Checkins); i++ {
+		if a.Checkins[i-1].CreatedAt < a.Checkins[i].CreatedAt {
+			t.Fatal("expected checkins sorted newest first")
+		}
+	}
+}
+
+func TestCheckinsPagingAndWindow(t *testing.T) {
+	data := NewDataset(DefaultCategories,
+		[]Venue{{Id: "v1", Name: "One"}},
+		[]Checkin{
+			{Id: "c1", CreatedAt: 100, VenueId: "v1"},
+			{Id: "c2", CreatedAt: 200, VenueId: "v1"},
+			{Id: "c3", CreatedAt: 300},
+			{Id: "c4", CreatedAt: 400, VenueId: "v1"},
+		})
+	server := httptest.NewServer(NewServer(data))
+	defer server.Close()
+
+	type page struct {
+		Response struct {
+			Checkins struct {
+				Count int `json:"count"`
+				Items []struct {
+					Id    string `json:"id"`
+					Type  string `json:"type"`
+					Venue *Venue `json:"venue"`
+				} `json:"items"`
+			} `json:"checkins"`
+		} `json:"response"`
+	}
+	var p page
+	q := url.Values{"oauth_token": {DefaultToken}, "limit": {"2"}, "offset": {"1"}, "afterTimestamp": {"100"}}
+	if status := getJSON(t, server, "/v2/users/self/checkins", q, &p); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	items := p.Response.Checkins.Items
+	if p.Response.Checkins.Count != 3 || len(items) != 2 {
+		t.Fatalf("unexpected page: %+v", p.Response.Checkins)
+	}
+	if items[0].Id != "c3" || items[0].Type != "shout" || items[0].Venue != nil || items[1].Id != "c2" {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+
+	q.Set("oauth_token", "wrong")
+	if status := getJSON(t, server, "/v2/users/self/checkins", q, &p); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", status)
+	}
+}
+
+func TestVenueHistoryCountsVisitsInWindow(t *testing.T) {
+	data := NewDataset(DefaultCategories,
+		[]Venue{{Id: "v1", Name: "One"}, {Id: "v2", Name: "Two"}},
+		[]Checkin{
+			{Id: "c1", CreatedAt: 100, VenueId: "v1"},
+			{Id: "c2", CreatedAt: 200, VenueId: "v2"},
+			{Id: "c3", CreatedAt: 300, VenueId: "v1"},
+		})
+	fake := NewServer(data)
+	fake.HistoryLimit = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	var p struct {
+		Response struct {
+			Venues struct {
+				Count int `json:"count"`
+				Items []struct {
+					BeenHere int   `json:"beenHere"`
+					Venue    Venue `json:"venue"`
+				} `json:"items"`
+			} `json:"venues"`
+		} `json:"response"`
+	}
+	q := url.Values{"oauth_token": {DefaultToken}}
+	getJSON(t, server, "/v2/users/self/venuehistory", q, &p)
+	if p.Response.Venues.Count != 2 || len(p.Response.Venues.Items) != 1 {
+		t.Fatalf("expected the unpaged response to be capped: %+v", p.Response.Venues)
+	}
+	if it := p.Response.Venues.Items[0]; it.Venue.Id != "v1" || it.BeenHere != 2 {
+		t.Fatalf("unexpected first venue: %+v", it)
+	}
+
+	q.Set("beforeTimestamp", "300")
+	q.Set("limit", "10")
+	getJSON(t, server, "/v2/users/self/venuehistory", q, &p)
+	if len(p.Response.Venues.Items) != 2 || p.Response.Venues.Items[1].BeenHere != 1 {
+		t.Fatalf("unexpected window: %+v", p.Response.Venues)
+	}
+}
+
+func TestListsArePagedWithNotes(t *testing.T) {
+	data := NewDataset(DefaultCategories, []Venue{{Id: "v1", Name: "One"}, {Id: "v2", Name: "Two"}}, nil)
+	data.Lists = []List{{Id: "1001/todos", Name: "Saved", Items: []ListItem{
+		{Id: "i1", VenueId: "v1", Note: "Try the cake"},
+		{Id: "i2", VenueId: "v2"},
+	}}}
+	server := httptest.NewServer(NewServer(data))
+	defer server.Close()
+
+	var index struct {
+		Response struct {
+			Lists struct {
+				Groups []struct {
+					Items []struct {
+						Id string `json:"id"`
+					} `json:"items"`
+				} `json:"groups"`
+			} `json:"lists"`
+		} `json:"response"`
+	}
+	q := url.Values{"oauth_token": {DefaultToken}}
+	getJSON(t, server, "/v2/users/self/lists", q, &index)
+	if groups := index.Response.Lists.Groups; len(groups) == 0 || len(groups[0].Items) != 1 || groups[0].Items[0].Id != "1001/todos" {
+		t.Fatalf("unexpected lists: %+v", index.Response.Lists)
+	}
+
+	var l struct {
+		Response struct {
+			List struct {
+				Name      string `json:"name"`
+				ListItems struct {
+					Count int `json:"count"`
+					Items []struct {
+						Venue Venue `json:"venue"`
+						Note  struct {
+							Text string `json:"text"`
+						} `json:"note"`
+					} `json:"items"`
+				} `json:"listItems"`
+			} `json:"list"`
+		} `json:"response"`
+	}
+	q.Set("limit", "1")
+	getJSON(t, server, "/v2/lists/1001/todos", q, &l)
+	items := l.Response.List.ListItems
+	if l.Response.List.Name != "Saved" || items.Count != 2 || len(items.Items) != 1 {
+		t.Fatalf("unexpected list page: %+v", l.Response.List)
+	}
+	if items.Items[0].Venue.Id != "v1" || items.Items[0].Note.Text != "Try the cake" {
+		t.Fatalf("unexpected list item: %+v", items.Items[0])
+	}
+	if status := getJSON(t, server, "/v2/lists/missing", q, &l); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown list, got %d", status)
+	}
+}
+
+func TestPhotosResolveToImages(t *testing.T) {
+	data := NewDataset(DefaultCategories, []Venue{{Id: "v1", Name: "One"}}, nil)
+	data.Tips = []Tip{{Id: "t1", VenueId: "v1", CreatedAt: 100, Text: "Cash only"}}
+	data.Photos = []Photo{{Id: "p1", VenueId: "v1", CreatedAt: 100}, {Id: "p2", VenueId: "v1", CreatedAt: 200}}
+	data.index()
+	server := httptest.NewServer(NewServer(data))
+	defer server.Close()
+
+	var tips struct {
+		Response struct {
+			Tips struct {
+				Count int `json:"count"`
+				Items []struct {
+					Text  string `json:"text"`
+					Venue Venue  `json:"venue"`
+				} `json:"items"`
+			} `json:"tips"`
+		} `json:"response"`
+	}
+	q := url.Values{"oauth_token": {DefaultToken}}
+	getJSON(t, server, "/v2/users/self/tips", q, &tips)
+	if items := tips.Response.Tips.Items; len(items) != 1 || items[0].Text != "Cash only" || items[0].Venue.Id != "v1" {
+		t.Fatalf("unexpected tips: %+v", tips.Response.Tips)
+	}
+
+	var photos struct {
+		Response struct {
+			Photos struct {
+				Count int `json:"count"`
+				Items []struct {
+					Id     string `json:"id"`
+					Prefix string `json:"prefix"`
+					Suffix string `json:"suffix"`
+				} `json:"items"`
+			} `json:"photos"`
+		} `json:"response"`
+	}
+	q.Set("limit", "1")
+	getJSON(t, server, "/v2/users/self/photos", q, &photos)
+	items := photos.Response.Photos.Items
+	if photos.Response.Photos.Count != 2 || len(items) != 1 || items[0].Id != "p2" {
+		t.Fatalf("expected the newest photo on the first page, got %+v", photos.Response.Photos)
+	}
+
+	resp, err := http.Get(items[0].Prefix + "100x100" + items[0].Suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	img, err := jpeg.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("expected a JPEG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Fatalf("expected a 100x100 thumbnail, got %v", b)
+	}
+}
+
+func TestOAuthFlow(t *testing.T) {
+	server := httptest.NewServer(NewServer(Generate(GenerateOptions{Seed: 1, From: time.Unix(0, 0), To: time.Unix(10, 0)})))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	q := url.Values{"client_id": {DefaultClientId}, "redirect_uri": {"http://localhost/cb"}, "state": {"xyz"}}
+	resp, err := client.Get(server.URL + "/oauth2/authenticate?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || location.Query().Get("state") != "xyz" {
+		t.Fatalf("unexpected redirect %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	exchange := url.Values{
+		"client_id":     {DefaultClientId},
+		"client_secret": {DefaultClientSecret},
+		"redirect_uri":  {"http://localhost/cb"},
+		"code":          {location.Query().Get("code")},
+	}
+	var token map[string]string
+	if status := getJSON(t, server, "/oauth2/access_token", exchange, &token); status != http.StatusOK || token["access_token"] != DefaultToken {
+		t.Fatalf("unexpected exchange %d %v", status, token)
+	}
+	if status := getJSON(t, server, "/oauth2/access_token", exchange, &token); status != http.StatusBadRequest {
+		t.Fatalf("expected a code to be single use, got %d", status)
+	}
+}
@@ -0,0 +1,300 @@
+package kmlapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BackendV2 = "v2"
+	BackendV3 = "v3"
+
+	placesFields = "fsq_id,name,geocodes,location,categories,website,tel"
+)
+
+// Backend serves the venue details and the category taxonomy. The checkin
+// history itself only exists in the v2 user endpoints and is fetched from
+// there regardless of the backend.
+type Backend interface {
+	Name() string
+	// Categories returns the taxonomy named in locale where the backend
+	// supports it.
+	Categories(ctx context.Context, token FSQToken, locale string) ([]GlobalCategory, error)
+	VenueDetails(ctx context.Context, token FSQToken, id string) (Venue, error)
+	// OwnTaxonomy reports whether the backend uses other category ids than
+	// the v2 history, so every venue has to be refreshed from it.
+	OwnTaxonomy() bool
+}
+
+// categoryRooter is implemented by backends whose category ids encode the
+// top-level ancestor, for categories missing from the fetched tree.
+type categoryRooter interface {
+	RootOf(id string) (string, bool)
+}
+
+var activeBackend Backend = V2Backend{}
+
+// SetBackend selects the backend used by every export. It is meant to be
+// called once at startup.
+func SetBackend(b Backend) {
+	activeBackend = b
+}
+
+func CurrentBackend() Backend {
+	return activeBackend
+}
+
+// NewBackend returns the backend registered under name.
+func NewBackend(name string, apiKey string) (Backend, error) {
+	switch name {
+	case "", BackendV2:
+		return V2Backend{}, nil
+	case BackendV3:
+		if apiKey == "" {
+			return nil, errors.New("the v3 backend needs a Places API key")
+		}
+		return NewPlacesBackend(apiKey), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q, expected %s or %s", name, BackendV2, BackendV3)
+}
+
+// V2Backend is the legacy API authorized with the user's oauth_token.
+type V2Backend struct{}
+
+func (V2Backend) Name() string {
+	return BackendV2
+}
+
+func (V2Backend) Categories(ctx context.Context, token FSQToken, locale string) ([]GlobalCategory, error) {
+	return fetchCategories(ctx, token, locale)
+}
+
+func (b V2Backend) VenueDetails(ctx context.Context, token FSQToken, id string) (Venue, error) {
+	v, _, err := b.venueDetails(ctx, token, id, nil)
+	return v, err
+}
+
+func (V2Backend) venueDetails(ctx context.Context, token FSQToken, id string, rep *progressReporter) (Venue, time.Duration, error) {
+	var fsq struct {
+		Response struct {
+			Venue Venue `json:"venue"`
+		} `json:"response"`
+	}
+	urlStr := fsqVenues + url.PathEscape(id) + "?" + commonQuery(token).Encode()
+	took, err := fetchPage(ctx, rep, "details", urlStr, &fsq)
+	return fsq.Response.Venue, took, err
+}
+
+func (V2Backend) OwnTaxonomy() bool {
+	return false
+}
+
+// PlacesBackend is the Places API v3, authorized with an API key in the
+// Authorization header. Places are addressed by fsq_id, which keeps the ids
+// of the v2 venues, and categories use the numeric v3 taxonomy.
+type PlacesBackend struct {
+	APIKey string
+	// BaseURL defaults to the Places API, or the host set with SetBaseURL.
+	BaseURL string
+}
+
+func NewPlacesBackend(apiKey string) *PlacesBackend {
+	return &PlacesBackend{APIKey: apiKey}
+}
+
+// placesTaxonomy is the bundled v3 taxonomy, which RootOf checks top
+// levels against.
+var placesTaxonomy = sync.OnceValues(func() ([]GlobalCategory, error) {
+	return snapshotCategories(BackendV3, "en")
+})
+
+func (b *PlacesBackend) Name() string {
+	return BackendV3
+}
+
+func (b *PlacesBackend) base() string {
+	if b.BaseURL != "" {
+		return strings.TrimSuffix(b.BaseURL, "/")
+	}
+	return fsqPlaces
+}
+
+func (b *PlacesBackend) header() http.Header {
+	h := http.Header{}
+	h.Set("Authorization", b.APIKey)
+	h.Set("Accept", "application/json")
+	return h
+}
+
+// Categories returns the bundled v3 taxonomy, as the Places API has no
+// endpoint listing it. Its names are English whatever the locale.
+func (b *PlacesBackend) Categories(ctx context.Context, token FSQToken, locale string) ([]GlobalCategory, error) {
+	return snapshotCategories(BackendV3, locale)
+}
+
+// RootOf guesses the top level of a category missing from the bundled
+// taxonomy: so far every v3 descendant id falls in the thousand starting at
+// its top-level id, e.g. 13032 Café under 13000.
+func (b *PlacesBackend) RootOf(id string) (string, bool) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return "", false
+	}
+	top, err := placesTaxonomy()
+	if err != nil {
+		return "", false
+	}
+	root := strconv.Itoa(n / 1000 * 1000)
+	for _, c := range top {
+		if c.Id == root {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+type placesCategory struct {
+	Id   json.Number `json:"id"`
+	Name string      `json:"name"`
+}
+
+type place struct {
+	FsqId    string `json:"fsq_id"`
+	Name     string `json:"name"`
+	Geocodes struct {
+		Main struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"main"`
+	} `json:"geocodes"`
+	Location struct {
+		Address          string `json:"address"`
+		Locality         string `json:"locality"`
+		Region           string `json:"region"`
+		Postcode         string `json:"postcode"`
+		Country          string `json:"country"`
+		FormattedAddress string `json:"formatted_address"`
+	} `json:"location"`
+	Categories []placesCategory `json:"categories"`
+	Website    string           `json:"website"`
+	Tel        string           `json:"tel"`
+}
+
+func (p place) venue() Venue {
+	// The v3 country is the country code.
+	v := Venue{
+		HasId:   HasId{Id: p.FsqId},
+		HasName: HasName{Name: p.Name},
+		Location: Location{
+			Lat:        p.Geocodes.Main.Latitude,
+			Lng:        p.Geocodes.Main.Longitude,
+			Address:    p.Location.Address,
+			City:       p.Location.Locality,
+			State:      p.Location.Region,
+			PostalCode: p.Location.Postcode,
+			Cc:         p.Location.Country,
+		},
+		Contact: Contact{FormattedPhone: p.Tel},
+		Url:     p.Website,
+	}
+	if p.Location.FormattedAddress != "" {
+		v.Location.FormattedAddress = []string{p.Location.FormattedAddress}
+	}
+	for _, c := range p.Categories {
+		v.Categories = append(v.Categories, Category{HasId: HasId{Id: c.Id.String()}, HasName: HasName{Name: c.Name}})
+	}
+	return v
+}
+
+func (b *PlacesBackend) VenueDetails(ctx context.Context, token FSQToken, id string) (Venue, error) {
+	v, _, err := b.venueDetails(ctx, token, id, nil)
+	return v, err
+}
+
+func (b *PlacesBackend) venueDetails(ctx context.Context, token FSQToken, id string, rep *progressReporter) (Venue, time.Duration, error) {
+	urlStr := b.base() + "/places/" + url.PathEscape(id) + "?" + url.Values{"fields": {placesFields}}.Encode()
+	var p place
+	took, err := fetchPageWithHeader(ctx, rep, "details", urlStr, b.header(), &p)
+	return p.venue(), took, err
+}
+
+func (b *PlacesBackend) OwnTaxonomy() bool {
+	return true
+}
+
+// detailsFetcher is VenueDetails with retries reported to rep.
+type detailsFetcher interface {
+	venueDetails(ctx context.Context, token FSQToken, id string, rep *progressReporter) (Venue, time.Duration, error)
+}
+
+// refreshDetails replaces the names, locations and categories of the
+// history venues with the backend's view. Venues the backend does not know
+// keep their v2 details. Every venue costs a request to the backend, unless
+// the details cache has it or it was already asked for in this export.
+func refreshDetails(ctx context.Context, b Backend, token FSQToken, venues []Venue, rep *progressReporter) error {
+	rep.stageStarted("details")
+	known := detailsCache.load(b.Name())
+	fetched := 0
+	defer func() {
+		if fetched == 0 {
+			return
+		}
+		if err := detailsCache.save(b.Name(), known); err != nil {
+			rep.warning("details", "can not write the venue details cache: %v", err)
+		}
+	}()
+
+	unknown := 0
+	for i := range venues {
+		entry, ok := known[venues[i].Id]
+		var took time.Duration
+		if !ok {
+			var (
+				v   Venue
+				err error
+			)
+			if f, ok := b.(detailsFetcher); ok {
+				v, took, err = f.venueDetails(ctx, token, venues[i].Id, rep)
+			} else {
+				start := time.Now()
+				v, err = b.VenueDetails(ctx, token, venues[i].Id)
+				took = time.Since(start)
+			}
+			var statusErr *statusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+				entry = cachedVenue{FetchedAt: time.Now().UTC(), Unknown: true}
+			} else if err != nil {
+				return err
+			} else {
+				entry = cachedVenue{FetchedAt: time.Now().UTC(), Venue: v}
+			}
+			known[venues[i].Id] = entry
+			fetched++
+		}
+		if entry.Unknown {
+			unknown++
+			continue
+		}
+		v := entry.Venue
+		v.Id = venues[i].Id
+		v.VisitTimestamps = venues[i].VisitTimestamps
+		if v.Location.Country == "" && strings.EqualFold(v.Location.Cc, venues[i].Location.Cc) {
+			v.Location.Country = venues[i].Location.Country
+		}
+		venues[i] = v
+		rep.pageFetched("details", i+1, len(venues), took)
+	}
+	rep.stageFinished("details", len(venues), len(venues))
+	if unknown > 0 {
+		rep.warning("details", "%d venues are unknown to the %s backend and keep their history details", unknown, b.Name())
+	}
+	return nil
+}
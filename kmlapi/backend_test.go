@@ -0,0 +1,142 @@
+package kmlapi
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func withBackend(t *testing.T, b Backend) {
+	t.Helper()
+	original := activeBackend
+	SetBackend(b)
+	t.Cleanup(func() {
+		SetBackend(original)
+	})
+}
+
+func TestPlacesBackendRefreshesVenuesAndTaxonomy(t *testing.T) {
+	opts := fsqfake.DefaultGenerateOptions()
+	opts.Venues, opts.Checkins, opts.ShoutRate = 20, 200, 0
+	data := fsqfake.Generate(opts)
+	// A history venue the Places API does not know.
+	data.Venues[0].Categories[0].PlacesId = 0
+	fake := fsqfake.NewServer(data)
+	withMockFSQServer(t, fake.ServeHTTP)
+	withBackend(t, NewPlacesBackend(fsqfake.DefaultAPIKey))
+
+	var warnings []string
+	ds, _, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, ProgressListenerFunc(func(e ProgressEvent) {
+		if e.Kind == Warning {
+			warnings = append(warnings, e.Message)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("FetchDataset returned error: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+
+	for _, v := range ds.Venues {
+		fakeVenue, _ := data.Venue(v.Id)
+		names := ds.TopLevelNames(v)
+		if fakeVenue.Id == data.Venues[0].Id {
+			if len(v.Categories) != 0 || names[0] != unknownCategoryFolder {
+				t.Fatalf("expected a venue without v3 category to be unknown, got %+v", v)
+			}
+			continue
+		}
+		if len(v.Categories) != 1 || v.Categories[0].Id == fakeVenue.Categories[0].Id {
+			t.Fatalf("expected v3 category ids, got %+v", v.Categories)
+		}
+		if v.Location.City != fakeVenue.Location.City || v.Location.CountryName() != fakeVenue.Location.Country || v.Url != fakeVenue.Url {
+			t.Fatalf("expected the v3 details of %s, got %+v", v.Name, v)
+		}
+		if names[0] == unknownCategoryFolder || len(v.VisitTimestamps) == 0 {
+			t.Fatalf("expected %s to resolve to a v3 top level and keep its visits: %v %+v", v.Name, names, v)
+		}
+	}
+}
+
+func TestPlacesBackendCachesVenueDetails(t *testing.T) {
+	opts := fsqfake.DefaultGenerateOptions()
+	opts.Venues, opts.Checkins, opts.ShoutRate = 10, 50, 0
+	data := fsqfake.Generate(opts)
+	// A venue the Places API does not know is remembered as well.
+	data.Venues[0].Categories[0].PlacesId = 0
+	fake := fsqfake.NewServer(data)
+	var places int32
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v3/places/") {
+			atomic.AddInt32(&places, 1)
+		}
+		fake.ServeHTTP(w, r)
+	})
+	withBackend(t, NewPlacesBackend(fsqfake.DefaultAPIKey))
+	original := detailsCache
+	SetDetailsCache(DetailsCache{Dir: t.TempDir(), TTL: time.Hour})
+	t.Cleanup(func() {
+		SetDetailsCache(original)
+	})
+
+	first, _, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("FetchDataset returned error: %v", err)
+	}
+	if n := atomic.LoadInt32(&places); int(n) != len(first.Venues) {
+		t.Fatalf("expected a request per venue, got %d for %d venues", n, len(first.Venues))
+	}
+	second, _, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("FetchDataset returned error: %v", err)
+	}
+	if n := atomic.LoadInt32(&places); int(n) != len(first.Venues) {
+		t.Fatalf("expected the cached details to be reused, got %d requests", n)
+	}
+	if !reflect.DeepEqual(first.Venues, second.Venues) {
+		t.Fatal("expected the cached details to give the same venues")
+	}
+}
+
+func TestPlacesBackendRootOf(t *testing.T) {
+	b := NewPlacesBackend("key")
+	for id, want := range map[string]string{"13032": "13000", "19000": "19000", "10024": "10000"} {
+		if got, ok := b.RootOf(id); !ok || got != want {
+			t.Fatalf("RootOf(%s) = %s, %v", id, got, ok)
+		}
+	}
+	for _, id := range []string{"9000", "25000", "4bf58dd8d48988d1e0931735"} {
+		if _, ok := b.RootOf(id); ok {
+			t.Fatalf("expected %s to have no v3 root", id)
+		}
+	}
+}
+
+func TestPlacesBackendCategoriesAreBundled(t *testing.T) {
+	root, topLevel, _, err := resolveCategories(context.Background(), NewPlacesBackend("key"), "", "de", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := topLevel[root["13035"]]; got != "Dining and Drinking" {
+		t.Fatalf("expected Coffee Shop under the English Dining and Drinking, got %q", got)
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	if b, err := NewBackend("", ""); err != nil || b.Name() != BackendV2 {
+		t.Fatalf("expected v2 by default, got %v %v", b, err)
+	}
+	if _, err := NewBackend(BackendV3, ""); err == nil {
+		t.Fatal("expected v3 without an API key to fail")
+	}
+	if _, err := NewBackend("v4", "key"); err == nil {
+		t.Fatal("expected an unknown backend to fail")
+	}
+}
@@ -0,0 +1,256 @@
+package kmlapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	cassetteVersion = 1
+	redacted        = "REDACTED"
+	base64Encoding  = "base64"
+)
+
+// Query parameters and headers carrying credentials. Their values are
+// replaced in the recorded request and anywhere in the response body.
+var (
+	secretParams  = []string{"oauth_token", "client_secret", "code"}
+	secretHeaders = []string{"Authorization"}
+	accessTokenRe = regexp.MustCompile(`("access_token"\s*:\s*")[^"]*(")`)
+)
+
+type Interaction struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body"`
+	// Encoding is base64 for binary bodies such as photo thumbnails.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Cassette is a sanitized capture of the API traffic of one run. Meta holds
+// free-form details needed to replay it, like the export window.
+type Cassette struct {
+	Version      int               `json:"version"`
+	RecordedAt   time.Time         `json:"recorded_at"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	Interactions []Interaction     `json:"interactions"`
+}
+
+func LoadCassette(path string) (*Cassette, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+	if c.Version != cassetteVersion {
+		return nil, fmt.Errorf("unsupported cassette version %d", c.Version)
+	}
+	return &c, nil
+}
+
+func (c *Cassette) Save(path string) error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+// scrubRequest returns the request key with credentials redacted, and the
+// secret values found so they can be removed from the response too.
+func scrubRequest(req *http.Request) (string, []string) {
+	var secrets []string
+	q := req.URL.Query()
+	for _, name := range secretParams {
+		if v := q.Get(name); v != "" {
+			secrets = append(secrets, v)
+			q.Set(name, redacted)
+		}
+	}
+	for _, name := range secretHeaders {
+		if v := req.Header.Get(name); v != "" {
+			secrets = append(secrets, v)
+			if _, token, ok := strings.Cut(v, " "); ok && token != "" {
+				secrets = append(secrets, token)
+			}
+		}
+	}
+	// Host and scheme are left out so a capture of the real API replays
+	// against any base URL.
+	return req.Method + " " + req.URL.Path + "?" + q.Encode(), secrets
+}
+
+func scrubBody(body string, secrets []string) string {
+	for _, s := range secrets {
+		body = strings.ReplaceAll(body, s, redacted)
+	}
+	return accessTokenRe.ReplaceAllString(body, "${1}"+redacted+"${2}")
+}
+
+// Recorder is an http.RoundTripper saving every exchange, credentials
+// scrubbed, into a Cassette.
+type Recorder struct {
+	Transport http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+func NewRecorder(transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{
+		Transport: transport,
+		cassette:  Cassette{Version: cassetteVersion, RecordedAt: time.Now().UTC(), Meta: map[string]string{}},
+	}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	key, secrets := scrubRequest(req)
+	method, target, _ := strings.Cut(key, " ")
+	header := http.Header{}
+	for _, name := range []string{"Content-Type", "Retry-After", "ETag"} {
+		if v := resp.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	it := Interaction{
+		Method: method,
+		URL:    target,
+		Status: resp.StatusCode,
+		Header: header,
+	}
+	if utf8.Valid(body) {
+		it.Body = scrubBody(string(body), secrets)
+	} else {
+		it.Body = base64.StdEncoding.EncodeToString(body)
+		it.Encoding = base64Encoding
+	}
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, it)
+	r.mu.Unlock()
+	return resp, nil
+}
+
+func (r *Recorder) SetMeta(key string, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Meta[key] = value
+}
+
+// Cassette returns a copy of what was recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.cassette
+	c.Interactions = append([]Interaction(nil), r.cassette.Interactions...)
+	c.Meta = make(map[string]string, len(r.cassette.Meta))
+	for k, v := range r.cassette.Meta {
+		c.Meta[k] = v
+	}
+	return &c
+}
+
+var ErrNotRecorded = errors.New("no recorded response")
+
+// Replayer serves responses from a Cassette. Identical requests get their
+// recorded responses in order, so retried pages replay the same way.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+func NewReplayer(c *Cassette) *Replayer {
+	return &Replayer{
+		interactions: c.Interactions,
+		used:         make([]bool, len(c.Interactions)),
+	}
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, _ := scrubRequest(req)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, it := range r.interactions {
+		if r.used[i] || it.Method+" "+it.URL != key {
+			continue
+		}
+		r.used[i] = true
+		body := []byte(it.Body)
+		if it.Encoding == base64Encoding {
+			decoded, err := base64.StdEncoding.DecodeString(it.Body)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recorded body for %s: %w", key, err)
+			}
+			body = decoded
+		}
+		header := it.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", it.Status, http.StatusText(it.Status)),
+			StatusCode:    it.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNotRecorded, key)
+}
+
+// Unused lists the recorded requests the replay never asked for.
+func (r *Replayer) Unused() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for i, it := range r.interactions {
+		if !r.used[i] {
+			out = append(out, it.Method+" "+it.URL)
+		}
+	}
+	return out
+}
+
+// SetTransport routes every API call through rt, e.g. a Recorder or a
+// Replayer. It is meant to be called once at startup.
+func SetTransport(rt http.RoundTripper) {
+	defaultHTTPClient.Transport = rt
+}
+
+// ReplayToken stands in for the access token when replaying a cassette;
+// the recorded requests carry a redacted token anyway.
+const ReplayToken = FSQToken(redacted)
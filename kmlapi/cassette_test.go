@@ -0,0 +1,101 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func TestRecordAndReplayDataset(t *testing.T) {
+	fake := fsqfake.NewServer(fsqfake.Generate(fsqfake.DefaultGenerateOptions()))
+	fake.Token = "secret-token"
+	withMockFSQServer(t, fake.ServeHTTP)
+	recorder := NewRecorder(defaultHTTPClient.Transport)
+	SetTransport(recorder)
+
+	recorded, _, err := FetchDataset(context.Background(), NewToken("secret-token"), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("FetchDataset returned error: %v", err)
+	}
+	if _, err := Authenticate(fsqfake.DefaultClientId, "client-secret-value", "code-value", "http://localhost/cb"); err == nil {
+		t.Fatal("expected the fake to reject an unknown code")
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder.SetMeta("from", "0")
+	if err := recorder.Cassette().Save(path); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		t.Fatalf("LoadCassette returned error: %v", err)
+	}
+	if cassette.Meta["from"] != "0" || len(cassette.Interactions) < 3 {
+		t.Fatalf("unexpected cassette: meta=%v interactions=%d", cassette.Meta, len(cassette.Interactions))
+	}
+	for _, it := range cassette.Interactions {
+		for _, secret := range []string{"secret-token", "client-secret-value", "code-value"} {
+			if strings.Contains(it.URL, secret) || strings.Contains(it.Body, secret) {
+				t.Fatalf("secret %q leaked into %s", secret, it.URL)
+			}
+		}
+	}
+
+	replayer := NewReplayer(cassette)
+	defaultHTTPClient = &http.Client{Transport: replayer}
+	replayed, _, err := FetchDataset(context.Background(), ReplayToken, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("replay returned error: %v", err)
+	}
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Fatal("expected the replay to reproduce the recorded dataset")
+	}
+	if unused := replayer.Unused(); len(unused) != 1 || !strings.Contains(unused[0], "/oauth2/access_token") {
+		t.Fatalf("unexpected unused interactions: %v", unused)
+	}
+	if _, err := FetchCategories(NewToken("other")); !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("expected ErrNotRecorded once the cassette is used up, got %v", err)
+	}
+}
+
+func TestScrubBodyRedactsAccessToken(t *testing.T) {
+	got := scrubBody(`{"access_token": "abc123", "user": "me"}`, nil)
+	if got != `{"access_token": "REDACTED", "user": "me"}` {
+		t.Fatalf("unexpected scrubbed body %s", got)
+	}
+}
+
+func TestBinaryBodiesReplayUnchanged(t *testing.T) {
+	image := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F'}
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(image)
+	})
+	recorder := NewRecorder(defaultHTTPClient.Transport)
+	SetTransport(recorder)
+
+	photo := Photo{Id: "p1", Prefix: "https://fastly.4sqi.net/img/general/", Suffix: "/p1.jpg"}
+	if _, _, err := fetchThumbnail(context.Background(), photo); err != nil {
+		t.Fatalf("fetchThumbnail returned error: %v", err)
+	}
+	cassette := recorder.Cassette()
+	if len(cassette.Interactions) != 1 || cassette.Interactions[0].Encoding != "base64" {
+		t.Fatalf("expected a base64 interaction, got %+v", cassette.Interactions)
+	}
+
+	defaultHTTPClient = &http.Client{Transport: NewReplayer(cassette)}
+	got, _, err := fetchThumbnail(context.Background(), photo)
+	if err != nil {
+		t.Fatalf("replay returned error: %v", err)
+	}
+	if !bytes.Equal(got, image) {
+		t.Fatalf("expected the recorded image, got %x", got)
+	}
+}
@@ -0,0 +1,235 @@
+package kmlapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	categoryCacheVersion = 1
+	DefaultCategoryTTL   = 7 * 24 * time.Hour
+)
+
+// Snapshots of the taxonomies, used when neither the API nor the cache can
+// provide one. Regenerate v2 with `make taxonomy`.
+//
+//go:embed taxonomy/*.json
+var taxonomySnapshots embed.FS
+
+// CategoryCache keeps the taxonomy of every backend in Dir for TTL. A zero
+// TTL or empty Dir disables caching.
+type CategoryCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+type cachedTaxonomy struct {
+	Version   int       `json:"version"`
+	Backend   string    `json:"backend"`
+	Locale    string    `json:"locale"`
+	FetchedAt time.Time `json:"fetched_at"`
+	// ETag is sent back as If-None-Match; Hash identifies the taxonomy
+	// version when the API does not send one.
+	ETag       string           `json:"etag,omitempty"`
+	Hash       string           `json:"hash"`
+	Categories []GlobalCategory `json:"categories"`
+}
+
+var categoryCache CategoryCache
+
+// SetCategoryCache configures the on-disk taxonomy cache. It is meant to be
+// called once at startup.
+func SetCategoryCache(c CategoryCache) {
+	categoryCache = c
+}
+
+// DefaultCategoryCacheDir is fs4map in the user cache directory.
+func DefaultCategoryCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "fs4map")
+}
+
+func (c CategoryCache) enabled() bool {
+	return c.Dir != "" && c.TTL > 0
+}
+
+func (c CategoryCache) path(backend string, locale string) string {
+	return filepath.Join(c.Dir, "categories-"+backend+"-"+locale+".json")
+}
+
+func (c CategoryCache) load(backend string, locale string) (*cachedTaxonomy, error) {
+	content, err := os.ReadFile(c.path(backend, locale))
+	if err != nil {
+		return nil, err
+	}
+	var cached cachedTaxonomy
+	if err := json.Unmarshal(content, &cached); err != nil {
+		return nil, err
+	}
+	if cached.Version != categoryCacheVersion || cached.Backend != backend || cached.Locale != locale {
+		return nil, errors.New("stale category cache format")
+	}
+	return &cached, nil
+}
+
+func (c CategoryCache) save(cached *cachedTaxonomy) error {
+	content, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.Dir, ".categories-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(cached.Backend, cached.Locale))
+}
+
+func taxonomyHash(cats []GlobalCategory) string {
+	content, _ := json.Marshal(cats)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
+
+// snapshotCategories returns the bundled taxonomy in locale, or in English
+// when there is no snapshot for it.
+func snapshotCategories(backend string, locale string) ([]GlobalCategory, error) {
+	content, err := taxonomySnapshots.ReadFile("taxonomy/" + backend + "-" + locale + ".json")
+	if err != nil {
+		content, err = taxonomySnapshots.ReadFile("taxonomy/" + backend + ".json")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no bundled taxonomy for the %s backend", backend)
+	}
+	var cats []GlobalCategory
+	if err := json.Unmarshal(content, &cats); err != nil {
+		return nil, err
+	}
+	return cats, nil
+}
+
+// conditionalCategories is implemented by backends able to revalidate a
+// cached taxonomy with its ETag.
+type conditionalCategories interface {
+	categoriesIfChanged(ctx context.Context, token FSQToken, locale string, etag string) (cats []GlobalCategory, newETag string, notModified bool, err error)
+}
+
+func (V2Backend) categoriesIfChanged(ctx context.Context, token FSQToken, locale string, etag string) ([]GlobalCategory, string, bool, error) {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	var fsq fsqCategory
+	respHeader, err := getJSONConditional(ctx, fsqCategories+localizedQuery(token, locale).Encode(), header, &fsq)
+	if errors.Is(err, errNotModified) {
+		return nil, etag, true, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return fsq.Response.Categories, respHeader.Get("ETag"), false, nil
+}
+
+// unavailable tells a failure to reach the API, which the cache and the
+// snapshot stand in for, from a rejected request like an expired token, a
+// replay miss or a canceled export.
+func unavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrNotRecorded) {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.retryable()
+	}
+	return true
+}
+
+// loadCategories returns the taxonomy of b in locale from the cache while it
+// is fresh, revalidates or refetches it otherwise, and falls back to a stale
+// cache or the bundled snapshot when the API fails.
+func loadCategories(ctx context.Context, b Backend, token FSQToken, locale string, rep *progressReporter) ([]GlobalCategory, error) {
+	cache := categoryCache
+	var cached *cachedTaxonomy
+	if cache.enabled() {
+		cached, _ = cache.load(b.Name(), locale)
+		if cached != nil && time.Since(cached.FetchedAt) < cache.TTL {
+			return cached.Categories, nil
+		}
+	}
+
+	var (
+		cats        []GlobalCategory
+		etag        string
+		notModified bool
+		err         error
+	)
+	if cond, ok := b.(conditionalCategories); ok {
+		previous := ""
+		if cached != nil {
+			previous = cached.ETag
+		}
+		cats, etag, notModified, err = cond.categoriesIfChanged(ctx, token, locale, previous)
+	} else {
+		cats, err = b.Categories(ctx, token, locale)
+	}
+
+	if err != nil {
+		if !unavailable(ctx, err) {
+			return nil, err
+		}
+		if cached != nil {
+			rep.warning("categories", "can not refresh categories (%v), using the cache from %s", err, cached.FetchedAt.Format(time.RFC3339))
+			return cached.Categories, nil
+		}
+		snapshot, snapErr := snapshotCategories(b.Name(), locale)
+		if snapErr != nil {
+			return nil, err
+		}
+		rep.warning("categories", "can not fetch categories (%v), using the bundled taxonomy", err)
+		return snapshot, nil
+	}
+	if notModified && cached != nil {
+		cats = cached.Categories
+	}
+
+	if cache.enabled() {
+		fresh := &cachedTaxonomy{
+			Version:    categoryCacheVersion,
+			Backend:    b.Name(),
+			Locale:     locale,
+			FetchedAt:  time.Now().UTC(),
+			ETag:       etag,
+			Hash:       taxonomyHash(cats),
+			Categories: cats,
+		}
+		if cached != nil && cached.Hash != fresh.Hash {
+			rep.warning("categories", "the category taxonomy changed since %s", cached.FetchedAt.Format(time.RFC3339))
+		}
+		if err := cache.save(fresh); err != nil {
+			rep.warning("categories", "can not write the category cache: %v", err)
+		}
+	}
+	return cats, nil
+}
@@ -0,0 +1,186 @@
+package kmlapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func withCategoryCache(t *testing.T, ttl time.Duration) CategoryCache {
+	t.Helper()
+	original := categoryCache
+	cache := CategoryCache{Dir: t.TempDir(), TTL: ttl}
+	SetCategoryCache(cache)
+	t.Cleanup(func() {
+		SetCategoryCache(original)
+	})
+	return cache
+}
+
+const foodCategories = `{"response":{"categories":[{"id":"top-food","name":"Food","categories":[{"id":"child-coffee","name":"Coffee Shop","categories":[]}]}]}}`
+
+func TestCategoriesAreServedFromTheCache(t *testing.T) {
+	withCategoryCache(t, time.Hour)
+	var requests int32
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, foodCategories)
+	})
+
+	for i := 0; i < 2; i++ {
+		root, topLevel, err := ResolveCategories(NewToken("token"))
+		if err != nil {
+			t.Fatalf("ResolveCategories returned error: %v", err)
+		}
+		if root["child-coffee"] != "top-food" || topLevel["top-food"] != "Food" {
+			t.Fatalf("unexpected taxonomy %v %v", root, topLevel)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected the second lookup to hit the cache, got %d requests", requests)
+	}
+}
+
+func TestExpiredCategoriesAreRevalidatedWithETag(t *testing.T) {
+	cache := withCategoryCache(t, time.Hour)
+	var conditional int32
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, foodCategories)
+	})
+
+	if _, err := FetchCategories(NewToken("token")); err != nil {
+		t.Fatalf("FetchCategories returned error: %v", err)
+	}
+	cached, err := cache.load(BackendV2, DefaultLocale)
+	if err != nil {
+		t.Fatalf("expected a cache entry: %v", err)
+	}
+	cached.FetchedAt = time.Now().Add(-2 * time.Hour)
+	if err := cache.save(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	cats, err := FetchCategories(NewToken("token"))
+	if err != nil {
+		t.Fatalf("FetchCategories returned error: %v", err)
+	}
+	if conditional != 1 || len(cats) != 1 || cats[0].Name != "Food" {
+		t.Fatalf("expected a 304 to keep the cached taxonomy, got %d conditional requests and %+v", conditional, cats)
+	}
+	refreshed, err := cache.load(BackendV2, DefaultLocale)
+	if err != nil || time.Since(refreshed.FetchedAt) > time.Minute || refreshed.ETag != `"v1"` {
+		t.Fatalf("expected the revalidation to refresh the cache entry, got %+v (%v)", refreshed, err)
+	}
+}
+
+func TestCategoriesFallBackWhenTheAPIIsDown(t *testing.T) {
+	cache := withCategoryCache(t, time.Hour)
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+
+	var warnings []string
+	rep := newProgressReporter(ProgressListenerFunc(func(e ProgressEvent) {
+		if e.Kind == Warning {
+			warnings = append(warnings, e.Message)
+		}
+	}))
+	cats, err := loadCategories(context.Background(), V2Backend{}, NewToken("token"), DefaultLocale, rep)
+	if err != nil {
+		t.Fatalf("expected the bundled taxonomy, got %v", err)
+	}
+	snapshot, err := snapshotCategories(BackendV2, DefaultLocale)
+	if err != nil || len(cats) != len(snapshot) || len(cats) == 0 {
+		t.Fatalf("expected the bundled taxonomy, got %d categories", len(cats))
+	}
+
+	stale := &cachedTaxonomy{
+		Version:    categoryCacheVersion,
+		Backend:    BackendV2,
+		Locale:     DefaultLocale,
+		FetchedAt:  time.Now().Add(-48 * time.Hour),
+		Categories: []GlobalCategory{{HasId: HasId{Id: "top-food"}, HasName: HasName{Name: "Food"}}},
+	}
+	if err := cache.save(stale); err != nil {
+		t.Fatal(err)
+	}
+	cats, err = loadCategories(context.Background(), V2Backend{}, NewToken("token"), DefaultLocale, rep)
+	if err != nil || len(cats) != 1 || cats[0].Id != "top-food" {
+		t.Fatalf("expected the stale cache, got %+v (%v)", cats, err)
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("expected a warning per fallback, got %v", warnings)
+	}
+}
+
+func TestRejectedCategoryRequestDoesNotFallBack(t *testing.T) {
+	withCategoryCache(t, time.Hour)
+	var paged int32
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/venues/categories" {
+			atomic.AddInt32(&paged, 1)
+		}
+		http.Error(w, `{"meta":{"code":401}}`, http.StatusUnauthorized)
+	})
+
+	if _, _, err := FetchDataset(context.Background(), NewToken("expired"), nil, nil, nil); err == nil {
+		t.Fatal("expected an expired token to fail the export")
+	}
+	if paged != 0 {
+		t.Fatalf("expected the categories to fail the export before paging, got %d history requests", paged)
+	}
+}
+
+func TestBundledTaxonomiesParse(t *testing.T) {
+	entries, err := taxonomySnapshots.ReadDir("taxonomy")
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("expected bundled taxonomies, got %v", err)
+	}
+	for _, e := range entries {
+		content, err := taxonomySnapshots.ReadFile("taxonomy/" + e.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cats []GlobalCategory
+		if err := json.Unmarshal(content, &cats); err != nil || len(cats) == 0 {
+			t.Fatalf("invalid taxonomy %s: %v", e.Name(), err)
+		}
+	}
+	if _, err := snapshotCategories(BackendV2, DefaultLocale); err != nil {
+		t.Fatalf("expected a snapshot for the default backend: %v", err)
+	}
+}
+
+func TestSnapshotResolvesLeavesToTheirRoot(t *testing.T) {
+	withCategoryCache(t, time.Hour)
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+
+	root, topLevel, _, err := resolveCategories(context.Background(), V2Backend{}, NewToken("token"), DefaultLocale, nil)
+	if err != nil {
+		t.Fatalf("expected the bundled taxonomy, got %v", err)
+	}
+	for leaf, want := range map[string]string{
+		"4bf58dd8d48988d1e0931735": "Food",           // Coffee Shop
+		"4bf58dd8d48988d11b941735": "Nightlife Spot", // Pub, under Bar
+		"4bf58dd8d48988d1fa931735": "Travel & Transport",
+	} {
+		if got := topLevel[root[leaf]]; got != want {
+			t.Fatalf("expected %s to resolve to %s, got %q", leaf, want, got)
+		}
+	}
+	if _, err := snapshotCategories(BackendV3, DefaultLocale); err != nil {
+		t.Fatalf("expected a snapshot for the v3 backend: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package kmlapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/twpayne/go-kml"
+)
+
+// ClusterMethod selects how nearby venues are grouped into clusters, none
+// for every venue on its own.
+type ClusterMethod string
+
+const (
+	ClusterOff ClusterMethod = ""
+	// ClusterGrid groups the venues of a grid cell twice the radius wide.
+	ClusterGrid ClusterMethod = "grid"
+	// ClusterDBSCAN chains venues within the radius of each other.
+	ClusterDBSCAN ClusterMethod = "dbscan"
+
+	// DefaultClusterRadius is the cluster radius in meters at the deepest
+	// zoom level.
+	DefaultClusterRadius = 200.0
+	// maxClusterZoom is the deepest zoom level of web maps.
+	maxClusterZoom = 22
+	// clusterMembersShown caps the venue names in a cluster description.
+	clusterMembersShown = 20
+)
+
+// DefaultClusterZooms are the zoom levels venues are clustered below.
+var DefaultClusterZooms = []int{10, 13, 16}
+
+func ParseClusterMethod(s string) (ClusterMethod, error) {
+	switch m := ClusterMethod(strings.ToLower(strings.TrimSpace(s))); m {
+	case ClusterOff, ClusterGrid, ClusterDBSCAN:
+		return m, nil
+	case "off", "none":
+		return ClusterOff, nil
+	}
+	return ClusterOff, fmt.Errorf("expected grid or dbscan")
+}
+
+// ParseClusterZooms reads a comma separated list of increasing zoom levels.
+func ParseClusterZooms(s string) ([]int, error) {
+	var zooms []int
+	for _, item := range splitList(s) {
+		z, err := strconv.Atoi(item)
+		if err != nil || z < 1 || z > maxClusterZoom {
+			return nil, fmt.Errorf("expected zoom levels from 1 to %d", maxClusterZoom)
+		}
+		if len(zooms) > 0 && z <= zooms[len(zooms)-1] {
+			return nil, fmt.Errorf("expected increasing zoom levels")
+		}
+		zooms = append(zooms, z)
+	}
+	return zooms, nil
+}
+
+// Cluster stands for nearby venues while the map is zoomed out between
+// MinZoom and MaxZoom.
+type Cluster struct {
+	MinZoom int
+	MaxZoom int
+	// Radius in meters the venues were grouped with.
+	Radius   float64
+	Lat, Lng float64
+	Venues   []Venue
+}
+
+func (c Cluster) visits() int {
+	n := 0
+	for _, v := range c.Venues {
+		n += len(v.VisitTimestamps)
+	}
+	return n
+}
+
+// Clustering holds the clusters of every zoom level and the zoom level from
+// which each clustered venue shows on its own.
+type Clustering struct {
+	Clusters []Cluster
+	MinZoom  map[string]int
+	// Radius at the deepest level, which sizes the regions of the venues.
+	Radius float64
+}
+
+// Cluster returns a dataset sharing ds with its venues clustered below each
+// of zooms, DefaultClusterZooms when empty. The radius in meters,
+// DefaultClusterRadius when not positive, applies below the deepest level
+// and doubles with every level zoomed out, like the scale of the map.
+func (ds *Dataset) Cluster(method ClusterMethod, radius float64, zooms []int) *Dataset {
+	if method == ClusterOff {
+		return ds
+	}
+	if radius <= 0 {
+		radius = DefaultClusterRadius
+	}
+	if len(zooms) == 0 {
+		zooms = DefaultClusterZooms
+	}
+	deepest := zooms[len(zooms)-1]
+
+	c := &Clustering{MinZoom: make(map[string]int), Radius: radius}
+	levels := make([][][]int, len(zooms))
+	single := make([][]bool, len(zooms))
+	for l, z := range zooms {
+		levels[l] = clusterLevel(ds.Venues, method, radius*math.Exp2(float64(deepest-z)))
+		single[l] = make([]bool, len(ds.Venues))
+		for _, group := range levels[l] {
+			single[l][group[0]] = len(group) == 1
+		}
+	}
+	// alone is the level from which a venue is on its own at every deeper
+	// level; 0 for venues never clustered, len(zooms) for those clustered
+	// down to the deepest level.
+	alone := make([]int, len(ds.Venues))
+	for i := range ds.Venues {
+		l := len(zooms)
+		for l > 0 && single[l-1][i] {
+			l--
+		}
+		alone[i] = l
+	}
+	levelStart := func(l int) int {
+		if l == 0 {
+			return 0
+		}
+		return zooms[l-1]
+	}
+
+	for l, z := range zooms {
+		for _, group := range levels[l] {
+			// A venue alone from this level on shows as itself instead.
+			if len(group) == 1 && alone[group[0]] <= l {
+				continue
+			}
+			cluster := Cluster{MinZoom: levelStart(l), MaxZoom: z, Radius: radius * math.Exp2(float64(deepest-z))}
+			for _, i := range group {
+				v := ds.Venues[i]
+				cluster.Venues = append(cluster.Venues, v)
+				cluster.Lat += v.Location.Lat / float64(len(group))
+				cluster.Lng += v.Location.Lng / float64(len(group))
+			}
+			c.Clusters = append(c.Clusters, cluster)
+		}
+	}
+	for i, v := range ds.Venues {
+		if alone[i] > 0 {
+			c.MinZoom[v.Id] = levelStart(alone[i])
+		}
+	}
+
+	out := *ds
+	out.Clusters = c
+	return &out
+}
+
+// clusterLevel groups the indexes of venues lying within radius meters,
+// each group in the order of venues and the groups by their first venue.
+func clusterLevel(venues []Venue, method ClusterMethod, radius float64) [][]int {
+	var groups [][]int
+	if method == ClusterGrid {
+		cells := make(map[cellID]int)
+		size := 2 * radius / metersPerDegree
+		for i, v := range venues {
+			// Each row of cells is as wide as it is high at its latitude.
+			row := int(math.Floor(v.Location.Lat / size))
+			width := size / math.Max(math.Cos((float64(row)+0.5)*size*math.Pi/180), 0.01)
+			id := cellID{row, int(math.Floor(v.Location.Lng / width))}
+			g, ok := cells[id]
+			if !ok {
+				g = len(groups)
+				cells[id] = g
+				groups = append(groups, nil)
+			}
+			groups[g] = append(groups[g], i)
+		}
+		return groups
+	}
+
+	// DBSCAN with a minimum of two points: every venue within the radius
+	// of another joins its cluster. Scanning the venues sorted by latitude
+	// keeps to the band that can be within reach.
+	parent := make([]int, len(venues))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	order := make([]int, len(venues))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return venues[order[a]].Location.Lat < venues[order[b]].Location.Lat })
+	band := radius / metersPerDegree
+	for a, i := range order {
+		for _, j := range order[a+1:] {
+			if venues[j].Location.Lat-venues[i].Location.Lat > band {
+				break
+			}
+			if distanceMeters(venues[i].Location, venues[j].Location) <= radius {
+				if ri, rj := find(i), find(j); ri != rj {
+					parent[max(ri, rj)] = min(ri, rj)
+				}
+			}
+		}
+	}
+	index := make(map[int]int)
+	for i := range venues {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+const (
+	earthRadius = 6371008.8
+	// metersPerDegree of latitude, and of longitude at the equator.
+	metersPerDegree = earthRadius * math.Pi / 180
+)
+
+func distanceMeters(a Location, b Location) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLng := lat2-lat1, (b.Lng-a.Lng)*math.Pi/180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// zoomRegion shows its feature at lat, lng between the web map zoom levels
+// minZoom and maxZoom, 0 meaning no limit. Google Earth measures regions
+// in pixels, so the region is a box of side meters, which takes side over
+// the meters of a pixel at a zoom level.
+func zoomRegion(lat float64, lng float64, side float64, minZoom int, maxZoom int) *kml.CompoundElement {
+	half := side / 2 / metersPerDegree
+	b := bounds{north: lat + half, south: lat - half, east: lng + half/math.Max(math.Cos(lat*math.Pi/180), 0.01), west: lng - half/math.Max(math.Cos(lat*math.Pi/180), 0.01)}
+	pixels := func(zoom int) int {
+		// A web map tile of 256 pixels spans the equator at zoom 0.
+		perPixel := 2 * math.Pi * earthRadius * math.Cos(lat*math.Pi/180) / 256 / math.Exp2(float64(zoom))
+		return int(math.Round(side / perPixel))
+	}
+	minPixels, maxPixels := 0, -1
+	if minZoom > 0 {
+		minPixels = pixels(minZoom)
+	}
+	if maxZoom > 0 {
+		maxPixels = pixels(maxZoom)
+	}
+	return region(b, minPixels, maxPixels)
+}
+
+func clusterSchema() *kml.SharedElement {
+	return kml.Schema(
+		"cluster-metadata",
+		"ClusterMetadata",
+		kml.SimpleField("venue_count", "int"),
+		kml.SimpleField("visit_count", "int"),
+		kml.SimpleField("venue_ids", "string"),
+		kml.SimpleField("min_zoom", "int"),
+		kml.SimpleField("max_zoom", "int"),
+	)
+}
+
+func clusterDescription(c Cluster, msg Catalog) string {
+	lines := []string{fmt.Sprintf("%d venues", len(c.Venues)), fmt.Sprintf("%s: %d", msg.VisitCount, c.visits()), ""}
+	for i, v := range c.Venues {
+		if i == clusterMembersShown {
+			lines = append(lines, fmt.Sprintf("+%d", len(c.Venues)-i))
+			break
+		}
+		lines = append(lines, v.Name)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func clusterIDs(c Cluster) []string {
+	ids := make([]string, len(c.Venues))
+	for i, v := range c.Venues {
+		ids[i] = v.Id
+	}
+	return ids
+}
+
+func clusterPlacemark(c Cluster, msg Catalog) *kml.CompoundElement {
+	ids, err := json.Marshal(clusterIDs(c))
+	if err != nil {
+		ids = []byte("[]")
+	}
+	return kml.Placemark(
+		kml.Name(strconv.Itoa(len(c.Venues))),
+		kml.Description(clusterDescription(c, msg)),
+		zoomRegion(c.Lat, c.Lng, 2*c.Radius, c.MinZoom, c.MaxZoom),
+		kml.ExtendedData(
+			kml.SchemaData(
+				"#cluster-metadata",
+				kml.SimpleData("venue_count", strconv.Itoa(len(c.Venues))),
+				kml.SimpleData("visit_count", strconv.Itoa(c.visits())),
+				kml.SimpleData("venue_ids", string(ids)),
+				kml.SimpleData("min_zoom", strconv.Itoa(c.MinZoom)),
+				kml.SimpleData("max_zoom", strconv.Itoa(c.MaxZoom)),
+			),
+		),
+		kml.Point(kml.Coordinates(kml.Coordinate{Lon: c.Lng, Lat: c.Lat})),
+	)
+}
+
+// minZoom is the zoom level from which v shows on its own, false for
+// venues that are never clustered.
+func (c *Clustering) minZoom(v Venue) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	zoom, ok := c.MinZoom[v.Id]
+	return zoom, ok
+}
+
+// venueRegion hides v until zoom, while its cluster stands for it.
+func (c *Clustering) venueRegion(v Venue, zoom int) *kml.CompoundElement {
+	return zoomRegion(v.Location.Lat, v.Location.Lng, 2*c.Radius, zoom, 0)
+}
+
+func clusterFeature(c Cluster, msg Catalog) geoJSONFeature {
+	return geoJSONFeature{
+		Type: "Feature",
+		Geometry: geoJSONGeometry{
+			Type:        "Point",
+			Coordinates: []float64{c.Lng, c.Lat},
+		},
+		Properties: map[string]interface{}{
+			"layer":       clustersLayer,
+			"venue_count": len(c.Venues),
+			"visit_count": c.visits(),
+			"venue_ids":   clusterIDs(c),
+			"description": clusterDescription(c, msg),
+			"min_zoom":    c.MinZoom,
+			"max_zoom":    c.MaxZoom,
+		},
+	}
+}
+
+// clustersLayer is the GeoJSON layer of the clusters.
+const clustersLayer = "clusters"
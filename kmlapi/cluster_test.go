@@ -0,0 +1,153 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClusterZooms(t *testing.T) {
+	zooms, err := ParseClusterZooms("8, 12,15")
+	if err != nil || !reflect.DeepEqual(zooms, []int{8, 12, 15}) {
+		t.Fatalf("unexpected zooms %v %v", zooms, err)
+	}
+	for _, s := range []string{"12,8", "0", "23", "ten"} {
+		if _, err := ParseClusterZooms(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+	if m, err := ParseClusterMethod(" DBSCAN "); err != nil || m != ClusterDBSCAN {
+		t.Fatalf("unexpected method %q %v", m, err)
+	}
+	if _, err := ParseClusterMethod("kmeans"); err == nil {
+		t.Fatal("expected kmeans to be rejected")
+	}
+}
+
+func TestDistanceMeters(t *testing.T) {
+	// A degree of latitude is about 111 km.
+	if d := distanceMeters(Location{Lat: 0, Lng: 0}, Location{Lat: 1, Lng: 0}); math.Abs(d-111195) > 1 {
+		t.Fatalf("unexpected distance %f", d)
+	}
+	// A degree of longitude shrinks with the latitude.
+	if d := distanceMeters(Location{Lat: 60, Lng: 0}, Location{Lat: 60, Lng: 1}); math.Abs(d-55597) > 100 {
+		t.Fatalf("unexpected distance %f", d)
+	}
+}
+
+// clusterDataset has two venues about 110 m apart and a third about 1 km
+// east of them.
+func clusterDataset() *Dataset {
+	ds := testDataset()
+	ds.Venues[0].Location = Location{Lat: 0, Lng: 0}
+	ds.Venues[1].Location = Location{Lat: 0, Lng: 0.001}
+	ds.Venues = append(ds.Venues, Venue{
+		HasId:           HasId{Id: "v3"},
+		HasName:         HasName{Name: "Far Bar"},
+		Location:        Location{Lat: 0, Lng: 0.01},
+		VisitTimestamps: []int64{400},
+	})
+	return ds
+}
+
+func TestClusterLevel(t *testing.T) {
+	ds := clusterDataset()
+	for _, method := range []ClusterMethod{ClusterGrid, ClusterDBSCAN} {
+		if got := clusterLevel(ds.Venues, method, 200); !reflect.DeepEqual(got, [][]int{{0, 1}, {2}}) {
+			t.Fatalf("%s: unexpected groups %v", method, got)
+		}
+	}
+	if got := clusterLevel(ds.Venues, ClusterDBSCAN, 1600); !reflect.DeepEqual(got, [][]int{{0, 1, 2}}) {
+		t.Fatalf("expected a chain of venues in one group, got %v", got)
+	}
+}
+
+func TestDatasetCluster(t *testing.T) {
+	ds := clusterDataset()
+	if ds.Cluster(ClusterOff, 0, nil) != ds {
+		t.Fatal("expected the dataset itself without clustering")
+	}
+	clustered := ds.Cluster(ClusterDBSCAN, 200, []int{10, 13, 16})
+	c := clustered.Clusters
+	if c == nil || ds.Clusters != nil {
+		t.Fatal("expected the clusters on a copy of the dataset")
+	}
+	if !reflect.DeepEqual(c.MinZoom, map[string]int{"v1": 16, "v2": 16, "v3": 13}) {
+		t.Fatalf("unexpected min zooms %v", c.MinZoom)
+	}
+	var ranges [][3]int
+	for _, cl := range c.Clusters {
+		ranges = append(ranges, [3]int{cl.MinZoom, cl.MaxZoom, len(cl.Venues)})
+	}
+	if !reflect.DeepEqual(ranges, [][3]int{{0, 10, 3}, {10, 13, 3}, {13, 16, 2}}) {
+		t.Fatalf("unexpected clusters %v", ranges)
+	}
+	if c.Clusters[0].Radius != 200*64 || c.Clusters[2].Radius != 200 {
+		t.Fatalf("expected the radius to double per level, got %f and %f", c.Clusters[0].Radius, c.Clusters[2].Radius)
+	}
+}
+
+func TestWriteClusters(t *testing.T) {
+	ds := clusterDataset()
+	opts := ExportOptions{Format: FormatKML, Cluster: ClusterDBSCAN, ClusterZooms: []int{10, 13, 16}}
+
+	var kml bytes.Buffer
+	if err := writeDataset(context.Background(), &kml, ds, opts, nil, &ExportStats{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<Schema id="cluster-metadata"`, "<name>Clusters</name>", "<Region>", "<minLodPixels>", `<SimpleData name="venue_ids">[&#34;v1&#34;,&#34;v2&#34;]</SimpleData>`, `<SimpleData name="min_zoom">16</SimpleData>`, "Far Bar"} {
+		if !strings.Contains(kml.String(), want) {
+			t.Fatalf("expected %s in the KML", want)
+		}
+	}
+
+	opts.Format = FormatGeoJSON
+	var geo bytes.Buffer
+	if err := writeDataset(context.Background(), &geo, ds, opts, nil, &ExportStats{}); err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(geo.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 6 {
+		t.Fatalf("expected 3 venues and 3 clusters, got %d features", len(fc.Features))
+	}
+	if p := fc.Features[2].Properties; p["min_zoom"] != 13.0 {
+		t.Fatalf("unexpected venue properties %v", p)
+	}
+	if p := fc.Features[5].Properties; p["layer"] != clustersLayer || p["venue_count"] != 2.0 || p["min_zoom"] != 13.0 || p["max_zoom"] != 16.0 {
+		t.Fatalf("unexpected cluster properties %v", p)
+	}
+}
+
+func TestParseExportOptionsCluster(t *testing.T) {
+	opts, err := ParseExportOptions(url.Values{"cluster": {"grid"}, "cluster_radius": {"150"}, "cluster_zooms": {"9", "14"}}, time.Now())
+	if err != nil || opts.Cluster != ClusterGrid || opts.ClusterRadius != 150 || !reflect.DeepEqual(opts.ClusterZooms, []int{9, 14}) {
+		t.Fatalf("unexpected options %+v %v", opts, err)
+	}
+	for _, q := range []url.Values{
+		{"cluster": {"kmeans"}},
+		{"cluster": {"grid"}, "cluster_radius": {"-1"}},
+		{"cluster": {"grid"}, "cluster_zooms": {"14,9"}},
+		{"cluster": {"grid"}, "format": {"csv"}},
+		{"cluster": {"grid"}, "split": {"true"}},
+		{"cluster": {"grid"}, "density": {"hex"}},
+	} {
+		var paramErr *ParamError
+		if _, err := ParseExportOptions(q, time.Now()); !errors.As(err, &paramErr) {
+			t.Fatalf("expected %v to be rejected, got %v", q, err)
+		}
+	}
+}
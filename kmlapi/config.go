@@ -0,0 +1,131 @@
+package kmlapi
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ConfigClientId          = "client.id"
+	ConfigClientSecret      = "client.secret"
+	ConfigClientRedirectUrl = "client.redirect.url"
+	ConfigToken             = "client.token"
+	// ConfigBaseURL replaces the Foursquare hosts, e.g. with a fsqfake server.
+	ConfigBaseURL = "foursquare.base_url"
+	// ConfigBackend selects the venue details and category backend, v2 or v3.
+	ConfigBackend = "foursquare.backend"
+	ConfigAPIKey  = "foursquare.api_key"
+	// ConfigLocale is the language of category names and export labels.
+	ConfigLocale = "foursquare.locale"
+	// ConfigCategoryCacheDir and ConfigCategoryTTL control the taxonomy
+	// cache; a zero TTL disables it.
+	ConfigCategoryCacheDir = "categories.cache_dir"
+	ConfigCategoryTTL      = "categories.ttl"
+	// ConfigDetailsTTL is how long the v3 venue details are kept, in the
+	// category cache directory; 0 disables it.
+	ConfigDetailsTTL = "details.ttl"
+
+	ConfigEnvPrefix = "KMLEXPORT"
+	// ConfigPathEnv names the config file when no -config flag is given.
+	ConfigPathEnv = "KMLEXPORT_CONFIG"
+)
+
+// Keys with a shorter environment variable than the derived one.
+var configEnvAliases = map[string]string{
+	ConfigToken: "KMLEXPORT_TOKEN",
+}
+
+// ConfigEnvName returns the environment variable overriding a config key,
+// e.g. KMLEXPORT_CLIENT_REDIRECT_URL for client.redirect.url.
+func ConfigEnvName(key string) string {
+	if env, ok := configEnvAliases[key]; ok {
+		return env
+	}
+	return ConfigEnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// LoadConfig binds the KMLEXPORT_* environment variables and reads the
+// config file at path. With an empty path it looks for config.* in
+// $HOME/.kmlexport and carries on without one, so everything can come from
+// the environment.
+func LoadConfig(v *viper.Viper, path string) error {
+	if err := readConfig(v, path); err != nil {
+		return err
+	}
+	if base := v.GetString(ConfigBaseURL); base != "" {
+		SetBaseURL(base)
+	}
+	backend, err := NewBackend(v.GetString(ConfigBackend), v.GetString(ConfigAPIKey))
+	if err != nil {
+		return fmt.Errorf("%s: %w", ConfigBackend, err)
+	}
+	SetBackend(backend)
+
+	locale := DefaultLocale
+	if s := v.GetString(ConfigLocale); s != "" {
+		if locale, err = ParseLocale(s); err != nil {
+			return fmt.Errorf("%s: %w", ConfigLocale, err)
+		}
+	}
+	SetLocale(locale)
+
+	v.SetDefault(ConfigCategoryCacheDir, DefaultCategoryCacheDir())
+	v.SetDefault(ConfigCategoryTTL, DefaultCategoryTTL.String())
+	ttl, err := time.ParseDuration(v.GetString(ConfigCategoryTTL))
+	if err != nil {
+		return fmt.Errorf("%s: %w", ConfigCategoryTTL, err)
+	}
+	SetCategoryCache(CategoryCache{Dir: v.GetString(ConfigCategoryCacheDir), TTL: ttl})
+
+	v.SetDefault(ConfigDetailsTTL, DefaultDetailsTTL.String())
+	detailsTTL, err := time.ParseDuration(v.GetString(ConfigDetailsTTL))
+	if err != nil {
+		return fmt.Errorf("%s: %w", ConfigDetailsTTL, err)
+	}
+	SetDetailsCache(DetailsCache{Dir: v.GetString(ConfigCategoryCacheDir), TTL: detailsTTL})
+	return nil
+}
+
+func readConfig(v *viper.Viper, path string) error {
+	v.SetEnvPrefix(ConfigEnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for key, env := range configEnvAliases {
+		if err := v.BindEnv(key, env); err != nil {
+			return err
+		}
+	}
+
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("can not read config %s: %w", path, err)
+		}
+		return nil
+	}
+	v.SetConfigName("config")
+	v.AddConfigPath("$HOME/.kmlexport")
+	err := v.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// RequireConfig reports every key among keys that has no value, together
+// with the environment variable that can provide it.
+func RequireConfig(v *viper.Viper, keys ...string) error {
+	var missing []string
+	for _, key := range keys {
+		if v.GetString(key) == "" {
+			missing = append(missing, fmt.Sprintf("%s (%s)", key, ConfigEnvName(key)))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing config keys: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
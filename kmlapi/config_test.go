@@ -0,0 +1,122 @@
+package kmlapi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// withConfigGlobals restores what LoadConfig installs, and keeps the
+// category cache out of the user's cache directory.
+func withConfigGlobals(t *testing.T) {
+	t.Helper()
+	backend, cache, locale := activeBackend, categoryCache, defaultLocale
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Cleanup(func() {
+		SetBackend(backend)
+		SetCategoryCache(cache)
+		SetLocale(locale)
+	})
+}
+
+func TestLoadConfigFromEnvironmentOnly(t *testing.T) {
+	withConfigGlobals(t)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("KMLEXPORT_CLIENT_ID", "env-id")
+	t.Setenv("KMLEXPORT_CLIENT_REDIRECT_URL", "http://localhost/cb")
+	t.Setenv("KMLEXPORT_TOKEN", "env-token")
+
+	v := viper.New()
+	if err := LoadConfig(v, ""); err != nil {
+		t.Fatalf("expected a missing default config to be fine, got %v", err)
+	}
+	if got := v.GetString(ConfigClientId); got != "env-id" {
+		t.Fatalf("unexpected client id %q", got)
+	}
+	if got := v.GetString(ConfigClientRedirectUrl); got != "http://localhost/cb" {
+		t.Fatalf("unexpected redirect url %q", got)
+	}
+	if got := v.GetString(ConfigToken); got != "env-token" {
+		t.Fatalf("unexpected token %q", got)
+	}
+
+	err := RequireConfig(v, ConfigClientId, ConfigClientSecret, ConfigClientRedirectUrl)
+	if err == nil || err.Error() != "missing config keys: client.secret (KMLEXPORT_CLIENT_SECRET)" {
+		t.Fatalf("unexpected validation error %v", err)
+	}
+}
+
+func TestLoadConfigExplicitPathWithEnvOverride(t *testing.T) {
+	withConfigGlobals(t)
+	path := filepath.Join(t.TempDir(), "fs4map.yaml")
+	content := "client:\n  id: file-id\n  secret: file-secret\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KMLEXPORT_CLIENT_SECRET", "env-secret")
+
+	v := viper.New()
+	if err := LoadConfig(v, path); err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if got := v.GetString(ConfigClientId); got != "file-id" {
+		t.Fatalf("unexpected client id %q", got)
+	}
+	if got := v.GetString(ConfigClientSecret); got != "env-secret" {
+		t.Fatalf("expected the environment to win, got %q", got)
+	}
+	if v.ConfigFileUsed() != path {
+		t.Fatalf("unexpected config file %q", v.ConfigFileUsed())
+	}
+
+	err := RequireConfig(v, ConfigClientId, ConfigClientSecret, ConfigClientRedirectUrl, ConfigToken)
+	if err == nil || !strings.Contains(err.Error(), "client.redirect.url (KMLEXPORT_CLIENT_REDIRECT_URL), client.token (KMLEXPORT_TOKEN)") {
+		t.Fatalf("unexpected validation error %v", err)
+	}
+}
+
+func TestLoadConfigMissingExplicitPath(t *testing.T) {
+	withConfigGlobals(t)
+	if err := LoadConfig(viper.New(), filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected an error for a missing explicit config file")
+	}
+}
+
+func TestLoadConfigCategoryCache(t *testing.T) {
+	withConfigGlobals(t)
+	dir := t.TempDir()
+	t.Setenv("KMLEXPORT_CATEGORIES_CACHE_DIR", dir)
+	t.Setenv("KMLEXPORT_CATEGORIES_TTL", "1h")
+
+	if err := LoadConfig(viper.New(), ""); err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if categoryCache.Dir != dir || categoryCache.TTL != time.Hour {
+		t.Fatalf("unexpected category cache %+v", categoryCache)
+	}
+
+	t.Setenv("KMLEXPORT_CATEGORIES_TTL", "weekly")
+	if err := LoadConfig(viper.New(), ""); err == nil || !strings.Contains(err.Error(), ConfigCategoryTTL) {
+		t.Fatalf("expected an invalid ttl error, got %v", err)
+	}
+}
+
+func TestLoadConfigLocale(t *testing.T) {
+	withConfigGlobals(t)
+	t.Setenv("KMLEXPORT_FOURSQUARE_LOCALE", "pt_BR")
+	if err := LoadConfig(viper.New(), ""); err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if defaultLocale != "pt-br" {
+		t.Fatalf("unexpected default locale %q", defaultLocale)
+	}
+
+	t.Setenv("KMLEXPORT_FOURSQUARE_LOCALE", "portuguese")
+	if err := LoadConfig(viper.New(), ""); err == nil || !strings.Contains(err.Error(), ConfigLocale) {
+		t.Fatalf("expected an invalid locale error, got %v", err)
+	}
+}
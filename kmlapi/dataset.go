@@ -0,0 +1,288 @@
+package kmlapi
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Dataset is everything an exporter needs: the fetched venues with their
+// visit timestamps attached and the category taxonomy to resolve folders.
+type Dataset struct {
+	Venues   []Venue
+	Root     Root
+	TopLevel TopLevel
+	Tree     CategoryTree
+	// Lists are the user's curated lists, when requested.
+	Lists []List
+	// Locale of the category names, also used for the labels of exports.
+	Locale string
+	// Clusters group nearby venues below some zoom levels, when requested.
+	Clusters *Clustering
+}
+
+type Filter struct {
+	Categories []string
+	MinVisits  int
+	Name       string
+	// Countries match the country name or code, Cities the city name.
+	Countries []string
+	Cities    []string
+}
+
+func (f Filter) empty() bool {
+	return len(f.Categories) == 0 && f.MinVisits <= 0 && f.Name == "" && len(f.Countries) == 0 && len(f.Cities) == 0
+}
+
+func matchesAny(values []string, wants []string) bool {
+	for _, want := range wants {
+		for _, v := range values {
+			if v != "" && strings.EqualFold(v, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TopLevelNames returns the distinct top-level category names of v, or the
+// unknown category folder when none of its categories resolve.
+func (ds *Dataset) TopLevelNames(v Venue) []string {
+	names := make([]string, 0, len(v.Categories))
+	seen := make(map[string]struct{}, len(v.Categories))
+	for _, c := range v.Categories {
+		name := ds.TopLevel[ds.Root[c.Id]]
+		if name == "" {
+			name = CatalogFor(ds.Locale).Unknown
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, CatalogFor(ds.Locale).Unknown)
+	}
+	return names
+}
+
+func (ds *Dataset) matches(v Venue, f Filter) bool {
+	if len(v.VisitTimestamps) < f.MinVisits {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(v.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	if len(f.Countries) > 0 && !matchesAny([]string{v.Location.Country, v.Location.Cc}, f.Countries) {
+		return false
+	}
+	if len(f.Cities) > 0 && !matchesAny([]string{v.Location.City}, f.Cities) {
+		return false
+	}
+	if len(f.Categories) == 0 {
+		return true
+	}
+	for _, name := range ds.TopLevelNames(v) {
+		for _, want := range f.Categories {
+			if strings.EqualFold(name, want) {
+				return true
+			}
+		}
+	}
+	for _, c := range v.Categories {
+		for _, want := range f.Categories {
+			if c.Id == want || ds.Root[c.Id] == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Filter returns a dataset sharing the taxonomy of ds with only the venues
+// matching f.
+func (ds *Dataset) Filter(f Filter) *Dataset {
+	if f.empty() {
+		return ds
+	}
+	out := &Dataset{Root: ds.Root, TopLevel: ds.TopLevel, Tree: ds.Tree, Locale: ds.Locale}
+	for _, v := range ds.Venues {
+		if ds.matches(v, f) {
+			out.Venues = append(out.Venues, v)
+		}
+	}
+	// Saved venues are usually not visited yet, so the visit count does not
+	// apply to them.
+	listFilter := f
+	listFilter.MinVisits = 0
+	for _, l := range ds.Lists {
+		filtered := l
+		filtered.Items = nil
+		for _, it := range l.Items {
+			if ds.matches(it.Venue, listFilter) {
+				filtered.Items = append(filtered.Items, it)
+			}
+		}
+		out.Lists = append(out.Lists, filtered)
+	}
+	return out
+}
+
+func FetchDataset(ctx context.Context, token FSQToken, before *time.Time, after *time.Time, listener ProgressListener) (*Dataset, ExportStats, error) {
+	return fetchDataset(ctx, token, ExportOptions{Before: before, After: after}, newProgressReporter(listener))
+}
+
+// FetchDatasetWithOptions is FetchDataset honouring the window, locale and
+// lists of opts. The filter is left to Dataset.Filter.
+func FetchDatasetWithOptions(ctx context.Context, token FSQToken, opts ExportOptions, listener ProgressListener) (*Dataset, ExportStats, error) {
+	return fetchDataset(ctx, token, opts, newProgressReporter(listener))
+}
+
+func fetchDataset(ctx context.Context, token FSQToken, opts ExportOptions, rep *progressReporter) (*Dataset, ExportStats, error) {
+	backend := activeBackend
+	locale := resolveLocale(opts.Locale)
+	stats := ExportStats{}
+
+	// Categories come first so a broken taxonomy fails the export before
+	// minutes of paging.
+	rep.stageStarted("categories")
+	root, topLevel, tree, err := resolveCategories(ctx, backend, token, locale, rep)
+	if err != nil {
+		return nil, stats, err
+	}
+	rep.stageFinished("categories", len(topLevel), len(topLevel))
+
+	var (
+		venues          []Venue
+		checkinsByVenue map[string][]int64
+		lists           []List
+	)
+	if opts.Lists.visits() {
+		if venues, checkinsByVenue, err = fetchVisits(ctx, token, opts.Before, opts.After, locale, rep, &stats); err != nil {
+			return nil, stats, err
+		}
+	}
+	if opts.Lists != ListsOff {
+		if lists, err = fetchLists(ctx, token, locale, rep); err != nil {
+			return nil, stats, err
+		}
+		stats.ListsFetched = len(lists)
+		for _, l := range lists {
+			for i := range l.Items {
+				l.Items[i].Venue.VisitTimestamps = checkinsByVenue[l.Items[i].Venue.Id]
+			}
+		}
+	}
+	media, err := fetchMedia(ctx, token, opts, rep)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	if backend.OwnTaxonomy() {
+		all := append([]Venue(nil), venues...)
+		for _, l := range lists {
+			for _, it := range l.Items {
+				all = append(all, it.Venue)
+			}
+		}
+		if err := refreshDetails(ctx, backend, token, all, rep); err != nil {
+			return nil, stats, err
+		}
+		n := copy(venues, all)
+		for _, l := range lists {
+			for i := range l.Items {
+				l.Items[i].Venue = all[n]
+				n++
+			}
+		}
+	}
+
+	// Media is attached after the refresh, which replaces the venues. It is
+	// counted once per placemark, so a listed venue that was visited counts
+	// twice.
+	if opts.Tips || opts.Photos {
+		attach := func(v *Venue) {
+			tips, photos := media.attach(v)
+			stats.TipsAttached += tips
+			stats.PhotosAttached += photos
+		}
+		for i := range venues {
+			attach(&venues[i])
+		}
+		for _, l := range lists {
+			for i := range l.Items {
+				attach(&l.Items[i].Venue)
+			}
+		}
+	}
+
+	if rooter, ok := backend.(categoryRooter); ok {
+		addRoot := func(v Venue) {
+			for _, c := range v.Categories {
+				if _, known := root[c.Id]; known {
+					continue
+				}
+				if top, ok := rooter.RootOf(c.Id); ok {
+					root[c.Id] = top
+				}
+			}
+		}
+		for _, v := range venues {
+			addRoot(v)
+		}
+		for _, l := range lists {
+			for _, it := range l.Items {
+				addRoot(it.Venue)
+			}
+		}
+	}
+
+	return &Dataset{Venues: venues, Lists: lists, Root: root, TopLevel: topLevel, Tree: tree, Locale: locale}, stats, nil
+}
+
+// fetchVisits pages the visited venues and the checkins of the window and
+// attaches the visit timestamps to the venues.
+func fetchVisits(ctx context.Context, token FSQToken, before *time.Time, after *time.Time, locale string, rep *progressReporter, stats *ExportStats) ([]Venue, map[string][]int64, error) {
+	venues, err := fetchVenues(ctx, token, before, after, locale, rep)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.VenuesFetched = len(venues)
+	rep.statsSnapshot(*stats)
+
+	checkinsByVenue, checkinStats, err := fetchCheckins(ctx, token, before, after, rep)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.CheckinsRawFetched = checkinStats.RawCheckinsFetched
+	stats.CheckinsUniqueRetained = checkinStats.UniqueCheckinsRetained
+	stats.CheckinsMissingVenueOrTime = checkinStats.MissingVenueOrTimestamp
+	stats.CheckinsDeduplicatedByVenueTs = checkinStats.DeduplicatedByVenueAndTime
+
+	venueSet := make(map[string]struct{}, len(venues))
+	for i := range venues {
+		venueSet[venues[i].Id] = struct{}{}
+		venues[i].VisitTimestamps = checkinsByVenue[venues[i].Id]
+	}
+	for venueID, timestamps := range checkinsByVenue {
+		if _, ok := venueSet[venueID]; ok {
+			stats.CheckinsMatchedToVenues += len(timestamps)
+			continue
+		}
+		stats.UnmatchedVenueIDs++
+		stats.CheckinsUnmatchedToVenues += len(timestamps)
+	}
+	if stats.UnmatchedVenueIDs > 0 {
+		rep.warning("checkins", "%d venue IDs from checkins were not present in fetched venue details (%d checkins unmatched)",
+			stats.UnmatchedVenueIDs, stats.CheckinsUnmatchedToVenues)
+	}
+	if stats.CheckinsMissingVenueOrTime > 0 {
+		rep.warning("checkins", "skipped %d checkins with missing venue.id or createdAt", stats.CheckinsMissingVenueOrTime)
+	}
+	if stats.CheckinsDeduplicatedByVenueTs > 0 {
+		rep.warning("checkins", "deduplicated %d checkins by (venue.id, createdAt)", stats.CheckinsDeduplicatedByVenueTs)
+	}
+	rep.statsSnapshot(*stats)
+	return venues, checkinsByVenue, nil
+}
@@ -0,0 +1,369 @@
+package kmlapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twpayne/go-kml"
+)
+
+// DensityShape selects the cells a density export bins the checkins into,
+// none for a regular export.
+type DensityShape string
+
+const (
+	DensityOff    DensityShape = ""
+	DensitySquare DensityShape = "square"
+	// DensityHex cells are hexagons laid out in Web Mercator, so they look
+	// regular on the map.
+	DensityHex DensityShape = "hex"
+
+	// DefaultCellSize is the width of a density cell in degrees, about a
+	// kilometer at the equator.
+	DefaultCellSize = 0.01
+)
+
+func ParseDensityShape(s string) (DensityShape, error) {
+	switch d := DensityShape(strings.ToLower(strings.TrimSpace(s))); d {
+	case DensityOff, DensitySquare, DensityHex:
+		return d, nil
+	case "off", "none":
+		return DensityOff, nil
+	case "hexagon":
+		return DensityHex, nil
+	}
+	return DensityOff, fmt.Errorf("expected square or hex")
+}
+
+// DensityLayers splits a density export into a layer per year of the
+// checkins or per top-level category of the venues.
+type DensityLayers string
+
+const (
+	DensityAll        DensityLayers = ""
+	DensityByYear     DensityLayers = "year"
+	DensityByCategory DensityLayers = "category"
+)
+
+func ParseDensityLayers(s string) (DensityLayers, error) {
+	switch l := DensityLayers(strings.ToLower(strings.TrimSpace(s))); l {
+	case DensityAll, DensityByYear, DensityByCategory:
+		return l, nil
+	}
+	return DensityAll, fmt.Errorf("expected year or category")
+}
+
+type cellID [2]int
+
+type densityGrid interface {
+	cell(lat float64, lng float64) cellID
+	// ring is the closed boundary of the cell, as lng, lat pairs.
+	ring(id cellID) [][2]float64
+}
+
+func newDensityGrid(shape DensityShape, size float64) densityGrid {
+	if size <= 0 {
+		size = DefaultCellSize
+	}
+	if shape == DensityHex {
+		return hexGrid{radius: size / math.Sqrt(3)}
+	}
+	return squareGrid{size: size}
+}
+
+type squareGrid struct {
+	size float64
+}
+
+func (g squareGrid) cell(lat float64, lng float64) cellID {
+	return cellID{int(math.Floor(lat / g.size)), int(math.Floor(lng / g.size))}
+}
+
+func (g squareGrid) ring(id cellID) [][2]float64 {
+	south, west := float64(id[0])*g.size, float64(id[1])*g.size
+	north, east := south+g.size, west+g.size
+	return [][2]float64{{west, south}, {east, south}, {east, north}, {west, north}, {west, south}}
+}
+
+// hexGrid holds pointy-top hexagons in axial coordinates, with the Web
+// Mercator y scaled to degrees at the equator.
+type hexGrid struct {
+	radius float64
+}
+
+// maxMercatorLat is where Web Mercator, and so the hexagons, stop.
+const maxMercatorLat = 85.05112878
+
+func mercatorY(lat float64) float64 {
+	lat = math.Max(-maxMercatorLat, math.Min(maxMercatorLat, lat))
+	return math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * 180 / math.Pi
+}
+
+func mercatorLat(y float64) float64 {
+	return (2*math.Atan(math.Exp(y*math.Pi/180)) - math.Pi/2) * 180 / math.Pi
+}
+
+func (g hexGrid) cell(lat float64, lng float64) cellID {
+	x, y := lng, mercatorY(lat)
+	q := (math.Sqrt(3)/3*x - y/3) / g.radius
+	r := (2.0 / 3 * y) / g.radius
+	// Round the cube coordinates, fixing the one that moved the most.
+	s := -q - r
+	rq, rr, rs := math.Round(q), math.Round(r), math.Round(s)
+	dq, dr, ds := math.Abs(rq-q), math.Abs(rr-r), math.Abs(rs-s)
+	switch {
+	case dq > dr && dq > ds:
+		rq = -rr - rs
+	case dr > ds:
+		rr = -rq - rs
+	}
+	return cellID{int(rq), int(rr)}
+}
+
+func (g hexGrid) ring(id cellID) [][2]float64 {
+	q, r := float64(id[0]), float64(id[1])
+	cx := g.radius * math.Sqrt(3) * (q + r/2)
+	cy := g.radius * 1.5 * r
+	ring := make([][2]float64, 0, 7)
+	for i := 0; i <= 6; i++ {
+		angle := math.Pi / 180 * float64(60*(i%6)-30)
+		ring = append(ring, [2]float64{cx + g.radius*math.Cos(angle), mercatorLat(cy + g.radius*math.Sin(angle))})
+	}
+	return ring
+}
+
+type densityCell struct {
+	layer    string
+	id       cellID
+	checkins int
+	venues   int
+	level    int
+}
+
+// densityColors fill the cells of each level, from few to many checkins.
+var densityColors = []color.RGBA{
+	{R: 0xff, G: 0xff, B: 0xb2, A: 0x99},
+	{R: 0xfe, G: 0xcc, B: 0x5c, A: 0x99},
+	{R: 0xfd, G: 0x8d, B: 0x3c, A: 0x99},
+	{R: 0xf0, G: 0x3b, B: 0x20, A: 0x99},
+	{R: 0xbd, G: 0x00, B: 0x26, A: 0x99},
+}
+
+// densityLevel buckets count on a log scale up to busiest, so a few busy cells
+// do not wash out the rest.
+func densityLevel(count int, busiest int) int {
+	if busiest <= 1 || count <= 1 {
+		return 1
+	}
+	level := 1 + int(float64(len(densityColors)-1)*math.Log(float64(count))/math.Log(float64(busiest))+0.5)
+	return min(level, len(densityColors))
+}
+
+// densityCells bins the checkins of ds, sorted by layer and then by count,
+// busiest first.
+func densityCells(ds *Dataset, g densityGrid, by DensityLayers) []densityCell {
+	type cellKey struct {
+		layer string
+		id    cellID
+	}
+	cells := make(map[cellKey]*densityCell)
+	add := func(layer string, id cellID, checkins int, venue bool) {
+		key := cellKey{layer, id}
+		c := cells[key]
+		if c == nil {
+			c = &densityCell{layer: layer, id: id}
+			cells[key] = c
+		}
+		c.checkins += checkins
+		if venue {
+			c.venues++
+		}
+	}
+	for _, v := range ds.Venues {
+		if len(v.VisitTimestamps) == 0 {
+			continue
+		}
+		id := g.cell(v.Location.Lat, v.Location.Lng)
+		switch by {
+		case DensityByYear:
+			years := make(map[string]int)
+			for _, ts := range v.VisitTimestamps {
+				years[visitYear(ts)]++
+			}
+			for year, n := range years {
+				add(year, id, n, true)
+			}
+		case DensityByCategory:
+			for _, name := range ds.TopLevelNames(v) {
+				add(name, id, len(v.VisitTimestamps), true)
+			}
+		default:
+			add("", id, len(v.VisitTimestamps), true)
+		}
+	}
+
+	out := make([]densityCell, 0, len(cells))
+	busiest := 0
+	for _, c := range cells {
+		out = append(out, *c)
+		busiest = max(busiest, c.checkins)
+	}
+	for i := range out {
+		out[i].level = densityLevel(out[i].checkins, busiest)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.layer != b.layer {
+			return a.layer < b.layer
+		}
+		if a.checkins != b.checkins {
+			return a.checkins > b.checkins
+		}
+		if a.id[0] != b.id[0] {
+			return a.id[0] < b.id[0]
+		}
+		return a.id[1] < b.id[1]
+	})
+	return out
+}
+
+func densityStyleID(level int) string {
+	return "density-" + strconv.Itoa(level)
+}
+
+func densityDescription(c densityCell, msg Catalog) string {
+	return fmt.Sprintf("%d venues\n%s: %d", c.venues, msg.VisitCount, c.checkins)
+}
+
+// yearSpan limits a layer of a year to that year on the time slider.
+func yearSpan(layer string) kml.Element {
+	year, err := strconv.Atoi(layer)
+	if err != nil {
+		return nil
+	}
+	return kml.TimeSpan(
+		kml.Begin(time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)),
+		kml.End(time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC)),
+	)
+}
+
+func densityKML(ds *Dataset, opts ExportOptions, rep *progressReporter, stats *ExportStats) *kml.CompoundElement {
+	msg := CatalogFor(ds.Locale)
+	rep.stageStarted("density")
+	g := newDensityGrid(opts.Density, opts.CellSize)
+
+	d := kml.Document(kml.Name("Checkin density"))
+	d.Add(
+		kml.Schema(
+			"density-metadata",
+			"DensityMetadata",
+			kml.SimpleField("checkins", "int"),
+			kml.SimpleField("venues", "int"),
+			kml.SimpleField("level", "int"),
+		),
+	)
+	for i, c := range densityColors {
+		d.Add(kml.SharedStyle(
+			densityStyleID(i+1),
+			kml.LineStyle(kml.Color(color.RGBA{R: c.R, G: c.G, B: c.B, A: 0xff}), kml.Width(1)),
+			kml.PolyStyle(kml.Color(c)),
+		))
+	}
+
+	folders := make(map[string]*kml.CompoundElement)
+	for _, c := range densityCells(ds, g, opts.DensityBy) {
+		ring := g.ring(c.id)
+		coords := make([]kml.Coordinate, len(ring))
+		for i, p := range ring {
+			coords[i] = kml.Coordinate{Lon: p[0], Lat: p[1]}
+		}
+		place := kml.Placemark(
+			kml.Name(strconv.Itoa(c.checkins)),
+			kml.Description(densityDescription(c, msg)),
+			kml.StyleURL("#"+densityStyleID(c.level)),
+			kml.ExtendedData(
+				kml.SchemaData(
+					"#density-metadata",
+					kml.SimpleData("checkins", strconv.Itoa(c.checkins)),
+					kml.SimpleData("venues", strconv.Itoa(c.venues)),
+					kml.SimpleData("level", strconv.Itoa(c.level)),
+				),
+			),
+			kml.Polygon(kml.Tessellate(true), kml.OuterBoundaryIs(kml.LinearRing(kml.Coordinates(coords...)))),
+		)
+		if opts.DensityBy == DensityAll {
+			d.Add(place)
+			continue
+		}
+		folder := folders[c.layer]
+		if folder == nil {
+			folder = kml.Folder(kml.Name(c.layer))
+			if opts.DensityBy == DensityByYear {
+				if span := yearSpan(c.layer); span != nil {
+					folder.Add(span)
+				}
+			}
+			folders[c.layer] = folder
+			d.Add(folder)
+		}
+		folder.Add(place)
+	}
+	countExported(ds, stats)
+	finishRender("density", ds, rep, stats)
+	return kml.KML(d)
+}
+
+// densityLayer is the GeoJSON layer of the cells when they are not split.
+const densityLayer = "density"
+
+func writeDensityGeoJSON(w io.Writer, ds *Dataset, opts ExportOptions, rep *progressReporter, stats *ExportStats) error {
+	rep.stageStarted("density")
+	g := newDensityGrid(opts.Density, opts.CellSize)
+	cells := densityCells(ds, g, opts.DensityBy)
+	collection := geoJSONCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(cells))}
+	for _, c := range cells {
+		ring := g.ring(c.id)
+		coords := make([][]float64, len(ring))
+		for i, p := range ring {
+			coords[i] = []float64{p[0], p[1]}
+		}
+		layer := c.layer
+		if opts.DensityBy == DensityAll {
+			layer = densityLayer
+		}
+		fill := densityColors[c.level-1]
+		hex := fmt.Sprintf("#%02x%02x%02x", fill.R, fill.G, fill.B)
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: geoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{coords}},
+			// fill and stroke follow the simplestyle convention that
+			// GeoJSON viewers read.
+			Properties: map[string]interface{}{
+				"layer":        layer,
+				"checkins":     c.checkins,
+				"venues":       c.venues,
+				"level":        c.level,
+				"fill":         hex,
+				"fill-opacity": float64(fill.A) / 0xff,
+				"stroke":       hex,
+				"stroke-width": 1,
+			},
+		})
+	}
+	countExported(ds, stats)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(collection); err != nil {
+		return err
+	}
+	finishRender("density", ds, rep, stats)
+	return nil
+}
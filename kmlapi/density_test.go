@@ -0,0 +1,142 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSquareGridCells(t *testing.T) {
+	g := newDensityGrid(DensitySquare, 0.5)
+	if got := g.cell(1.5, -2.25); got != (cellID{3, -5}) {
+		t.Fatalf("unexpected cell %v", got)
+	}
+	ring := g.ring(cellID{3, -5})
+	if len(ring) != 5 || ring[0] != ring[4] || ring[0] != [2]float64{-2.5, 1.5} || ring[2] != [2]float64{-2, 2} {
+		t.Fatalf("unexpected ring %v", ring)
+	}
+}
+
+func TestHexGridCellsHoldTheirPoints(t *testing.T) {
+	g := newDensityGrid(DensityHex, 0.01)
+	for _, p := range [][2]float64{{38.72, -9.14}, {51.5, -0.12}, {-33.86, 151.2}, {35.68, 139.69}, {0, 0}} {
+		id := g.cell(p[0], p[1])
+		ring := g.ring(id)
+		if len(ring) != 7 || ring[0] != ring[6] {
+			t.Fatalf("expected a closed hexagon, got %v", ring)
+		}
+		var lat, lng float64
+		for _, v := range ring[:6] {
+			lng += v[0] / 6
+			lat += v[1] / 6
+			if math.Abs(v[1]-p[0]) > 0.01 || math.Abs(v[0]-p[1]) > 0.01 {
+				t.Fatalf("vertex %v is too far from %v", v, p)
+			}
+		}
+		// Points around the center stay in the cell.
+		if got := g.cell(lat, lng); got != id {
+			t.Fatalf("the center of %v is in %v", id, got)
+		}
+	}
+}
+
+func TestDensityLevels(t *testing.T) {
+	for _, c := range []struct{ count, busiest, want int }{{1, 1, 1}, {1, 100, 1}, {10, 100, 3}, {100, 100, 5}, {50, 100, 4}} {
+		if got := densityLevel(c.count, c.busiest); got != c.want {
+			t.Fatalf("densityLevel(%d, %d) = %d, want %d", c.count, c.busiest, got, c.want)
+		}
+	}
+}
+
+func densityDataset() *Dataset {
+	ds := testDataset()
+	year := func(y int) int64 { return time.Date(y, time.June, 1, 0, 0, 0, 0, time.UTC).Unix() }
+	ds.Venues[0].VisitTimestamps = []int64{year(2021), year(2020), year(2020)}
+	ds.Venues[1].Location = Location{Lat: 1.6, Lng: 2.6}
+	ds.Venues[1].VisitTimestamps = []int64{year(2021)}
+	return ds
+}
+
+func TestDensityCellsByLayer(t *testing.T) {
+	ds := densityDataset()
+	g := newDensityGrid(DensitySquare, 1)
+
+	all := densityCells(ds, g, DensityAll)
+	if len(all) != 1 || all[0].checkins != 4 || all[0].venues != 2 || all[0].level != 5 {
+		t.Fatalf("expected both venues in one cell, got %+v", all)
+	}
+	years := densityCells(ds, g, DensityByYear)
+	if len(years) != 2 || years[0].layer != "2020" || years[0].checkins != 2 || years[0].venues != 1 || years[1].checkins != 2 || years[1].venues != 2 {
+		t.Fatalf("unexpected cells by year %+v", years)
+	}
+	categories := densityCells(ds, g, DensityByCategory)
+	if len(categories) != 2 || categories[0].layer != "Food" || categories[0].checkins != 3 || categories[1].layer != unknownCategoryFolder {
+		t.Fatalf("unexpected cells by category %+v", categories)
+	}
+}
+
+func TestWriteDensity(t *testing.T) {
+	ds := densityDataset()
+	opts := ExportOptions{Format: FormatKML, Density: DensityHex, DensityBy: DensityByYear}
+
+	var kml bytes.Buffer
+	if err := writeDataset(context.Background(), &kml, ds, opts, nil, &ExportStats{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<Style id="density-5">`, "<styleUrl>#density-", "<begin>2020-01-01T00:00:00Z</begin>", "<Polygon>", `<SimpleData name="checkins">2</SimpleData>`} {
+		if !strings.Contains(kml.String(), want) {
+			t.Fatalf("expected %s in the KML", want)
+		}
+	}
+	if strings.Contains(kml.String(), "Cafe One") {
+		t.Fatal("expected no venue placemarks in a density export")
+	}
+
+	opts.Format = FormatGeoJSON
+	opts.DensityBy = DensityAll
+	var geo bytes.Buffer
+	if err := writeDataset(context.Background(), &geo, ds, opts, nil, &ExportStats{}); err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string        `json:"type"`
+				Coordinates [][][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(geo.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	f := fc.Features[0]
+	if f.Geometry.Type != "Polygon" || len(f.Geometry.Coordinates[0]) != 7 || f.Properties["layer"] != densityLayer || f.Properties["fill"] == nil {
+		t.Fatalf("unexpected feature %+v", f)
+	}
+}
+
+func TestParseExportOptionsDensity(t *testing.T) {
+	opts, err := ParseExportOptions(url.Values{"density": {"hex"}, "cell_size": {"0.05"}, "density_by": {"year"}, "format": {"geojson"}}, time.Now())
+	if err != nil || opts.Density != DensityHex || opts.CellSize != 0.05 || opts.DensityBy != DensityByYear {
+		t.Fatalf("unexpected options %+v %v", opts, err)
+	}
+	for _, q := range []url.Values{
+		{"density": {"circle"}},
+		{"density": {"square"}, "cell_size": {"0"}},
+		{"density": {"square"}, "format": {"csv"}},
+		{"density": {"square"}, "split": {"true"}},
+		{"density_by": {"month"}},
+	} {
+		var paramErr *ParamError
+		if _, err := ParseExportOptions(q, time.Now()); !errors.As(err, &paramErr) {
+			t.Fatalf("expected %v to be rejected, got %v", q, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package kmlapi
+
+import (
+	"strings"
+
+	"github.com/twpayne/go-kml"
+)
+
+// CountryName is the country of l, or its country code when the backend
+// only returns that.
+func (l Location) CountryName() string {
+	if l.Country != "" {
+		return l.Country
+	}
+	return strings.ToUpper(l.Cc)
+}
+
+// FullAddress is the formatted address of l, or its parts joined when
+// Foursquare did not format it.
+func (l Location) FullAddress() string {
+	if len(l.FormattedAddress) > 0 {
+		return strings.Join(l.FormattedAddress, ", ")
+	}
+	var parts []string
+	for _, p := range []string{l.Address, strings.TrimSpace(l.PostalCode + " " + l.City), l.State, l.CountryName()} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String is the phone number, formatted when Foursquare has it so.
+func (c Contact) String() string {
+	if c.FormattedPhone != "" {
+		return c.FormattedPhone
+	}
+	return c.Phone
+}
+
+type venueDetail struct {
+	name  string
+	value string
+}
+
+// detailFields are the names of the venue details, in the order of the
+// CSV columns and the KML schema.
+var detailFields = []string{"address", "city", "state", "postal_code", "country", "cc", "formatted_address", "url", "phone"}
+
+func venueDetails(v Venue) []venueDetail {
+	l := v.Location
+	values := []string{l.Address, l.City, l.State, l.PostalCode, l.CountryName(), strings.ToUpper(l.Cc), l.FullAddress(), v.Url, v.Contact.String()}
+	details := make([]venueDetail, len(detailFields))
+	for i, name := range detailFields {
+		details[i] = venueDetail{name: name, value: values[i]}
+	}
+	return details
+}
+
+func hasDetails(v Venue) bool {
+	for _, d := range venueDetails(v) {
+		if d.value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func datasetHasDetails(ds *Dataset) bool {
+	for _, v := range ds.Venues {
+		if hasDetails(v) {
+			return true
+		}
+	}
+	for _, l := range ds.Lists {
+		for _, it := range l.Items {
+			if hasDetails(it.Venue) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func detailsSchema() *kml.SharedElement {
+	fields := make([]kml.Element, len(detailFields))
+	for i, name := range detailFields {
+		fields[i] = kml.SimpleField(name, "string")
+	}
+	return kml.Schema("venue-details", "VenueDetails", fields...)
+}
+
+// detailsSchemaData holds the details of v, or nil when it has none.
+func detailsSchemaData(v Venue) kml.Element {
+	if !hasDetails(v) {
+		return nil
+	}
+	details := venueDetails(v)
+	data := make([]kml.Element, len(details))
+	for i, d := range details {
+		data[i] = kml.SimpleData(d.name, d.value)
+	}
+	return kml.SchemaData("#venue-details", data...)
+}
+
+// venuePlacemark renders v with its address and phone number, which map
+// viewers show in the balloon, and the region of a clustered venue.
+func venuePlacemark(v Venue, description string, data *kml.CompoundElement, region ...kml.Element) *kml.CompoundElement {
+	place := kml.Placemark(kml.Name(v.Name))
+	if address := v.Location.FullAddress(); address != "" {
+		place.Add(kml.Address(address))
+	}
+	if phone := v.Contact.String(); phone != "" {
+		place.Add(kml.PhoneNumber(phone))
+	}
+	if details := detailsSchemaData(v); details != nil {
+		data.Add(details)
+	}
+	place.Add(kml.Description(description))
+	place.Add(region...)
+	place.Add(
+		data,
+		kml.Point(
+			kml.Coordinates(kml.Coordinate{Lon: v.Location.Lng, Lat: v.Location.Lat}),
+		),
+	)
+	return place
+}
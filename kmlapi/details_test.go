@@ -0,0 +1,137 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func detailedDataset() *Dataset {
+	ds := testDataset()
+	ds.Venues[0].Location = Location{
+		Lat:              1.5,
+		Lng:              2.5,
+		Address:          "1 Main St",
+		City:             "Lisbon",
+		State:            "Lisboa",
+		PostalCode:       "1100-148",
+		Country:          "Portugal",
+		Cc:               "PT",
+		FormattedAddress: []string{"1 Main St", "1100-148 Lisbon", "Portugal"},
+	}
+	ds.Venues[0].Contact = Contact{Phone: "5550001", FormattedPhone: "(555) 000-1"}
+	ds.Venues[0].Url = "https://example.com/cafe"
+	return ds
+}
+
+func TestFetchDatasetDecodesVenueDetails(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+
+	ds, _, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("FetchDataset returned error: %v", err)
+	}
+	for _, v := range ds.Venues {
+		want, _ := data.Venue(v.Id)
+		l := v.Location
+		if l.Address != want.Location.Address || l.City != want.Location.City || l.Cc != want.Location.Cc ||
+			l.Country != want.Location.Country || l.PostalCode != want.Location.PostalCode || len(l.FormattedAddress) != 3 {
+			t.Fatalf("unexpected location of %s: %+v", v.Id, l)
+		}
+		if v.Url != want.Url || v.Contact.FormattedPhone != want.Contact.FormattedPhone {
+			t.Fatalf("unexpected url or contact of %s: %+v", v.Id, v)
+		}
+	}
+}
+
+func TestFullAddressFallsBackToParts(t *testing.T) {
+	l := Location{Address: "1 Main St", City: "Berlin", PostalCode: "10115", Cc: "de"}
+	if got := l.FullAddress(); got != "1 Main St, 10115 Berlin, DE" {
+		t.Fatalf("unexpected address %q", got)
+	}
+	if got := (Location{}).FullAddress(); got != "" {
+		t.Fatalf("expected no address, got %q", got)
+	}
+}
+
+func TestExportsCarryVenueDetails(t *testing.T) {
+	ds := detailedDataset()
+
+	var kml bytes.Buffer
+	if _, err := WriteDataset(&kml, ds, FormatKML); err != nil {
+		t.Fatal(err)
+	}
+	out := kml.String()
+	for _, want := range []string{
+		`<Schema id="venue-details" name="VenueDetails">`,
+		"<address>1 Main St, 1100-148 Lisbon, Portugal</address>",
+		"<phoneNumber>(555) 000-1</phoneNumber>",
+		`<SimpleData name="url">https://example.com/cafe</SimpleData>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %s in the KML", want)
+		}
+	}
+	if strings.Count(out, `schemaUrl="#venue-details"`) != 1 {
+		t.Fatal("expected details only on the venue that has them")
+	}
+
+	var geo bytes.Buffer
+	if _, err := WriteDataset(&geo, ds, FormatGeoJSON); err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(geo.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	if p := fc.Features[0].Properties; p["city"] != "Lisbon" || p["cc"] != "PT" || p["phone"] != "(555) 000-1" {
+		t.Fatalf("unexpected properties %v", p)
+	}
+	if _, ok := fc.Features[1].Properties["city"]; ok {
+		t.Fatal("expected no empty details in the properties")
+	}
+
+	var buf bytes.Buffer
+	if _, err := WriteDataset(&buf, ds, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[0][9] != "address" || rows[1][9] != "1 Main St" || rows[1][13] != "Portugal" || rows[1][16] != "https://example.com/cafe" {
+		t.Fatalf("unexpected rows %v", rows[:2])
+	}
+}
+
+func TestFilterByCountryAndCity(t *testing.T) {
+	ds := detailedDataset()
+	for _, f := range []Filter{{Countries: []string{"pt"}}, {Countries: []string{"portugal"}}, {Cities: []string{"LISBON"}}} {
+		if got := ds.Filter(f).Venues; len(got) != 1 || got[0].Id != "v1" {
+			t.Fatalf("expected %+v to keep v1, got %+v", f, got)
+		}
+	}
+	if got := ds.Filter(Filter{Countries: []string{"PT"}, Cities: []string{"Porto"}}).Venues; len(got) != 0 {
+		t.Fatalf("expected no venue in Porto, got %+v", got)
+	}
+}
+
+func TestSummarizeRanksCountriesAndCities(t *testing.T) {
+	summary := Summarize(detailedDataset(), 10)
+	if len(summary.TopCountries) != 1 || summary.TopCountries[0] != (NamedCount{Name: "Portugal", Count: 2}) {
+		t.Fatalf("unexpected countries %+v", summary.TopCountries)
+	}
+	if len(summary.TopCities) != 1 || summary.TopCities[0].Name != "Lisbon, Portugal" {
+		t.Fatalf("unexpected cities %+v", summary.TopCities)
+	}
+}
@@ -0,0 +1,99 @@
+package kmlapi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	detailsCacheVersion = 1
+	DefaultDetailsTTL   = 30 * 24 * time.Hour
+)
+
+// DetailsCache keeps the venue details a backend with its own taxonomy
+// returned, by venue id, in Dir for TTL, so an export only asks for the
+// venues it has not seen lately. A zero TTL or empty Dir disables caching.
+type DetailsCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+type cachedDetails struct {
+	Version int                    `json:"version"`
+	Backend string                 `json:"backend"`
+	Venues  map[string]cachedVenue `json:"venues"`
+}
+
+type cachedVenue struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	// Unknown venues are remembered too, as asking again costs the same.
+	Unknown bool  `json:"unknown,omitempty"`
+	Venue   Venue `json:"venue"`
+}
+
+var detailsCache DetailsCache
+
+// SetDetailsCache configures the on-disk venue details cache. It is meant to
+// be called once at startup.
+func SetDetailsCache(c DetailsCache) {
+	detailsCache = c
+}
+
+func (c DetailsCache) enabled() bool {
+	return c.Dir != "" && c.TTL > 0
+}
+
+func (c DetailsCache) path(backend string) string {
+	return filepath.Join(c.Dir, "details-"+backend+".json")
+}
+
+// load returns the details of backend fetched within TTL, and an empty map
+// when there are none or caching is disabled.
+func (c DetailsCache) load(backend string) map[string]cachedVenue {
+	fresh := make(map[string]cachedVenue)
+	if !c.enabled() {
+		return fresh
+	}
+	content, err := os.ReadFile(c.path(backend))
+	if err != nil {
+		return fresh
+	}
+	var cached cachedDetails
+	if err := json.Unmarshal(content, &cached); err != nil || cached.Version != detailsCacheVersion || cached.Backend != backend {
+		return fresh
+	}
+	for id, v := range cached.Venues {
+		if time.Since(v.FetchedAt) < c.TTL {
+			fresh[id] = v
+		}
+	}
+	return fresh
+}
+
+func (c DetailsCache) save(backend string, venues map[string]cachedVenue) error {
+	if !c.enabled() {
+		return nil
+	}
+	content, err := json.Marshal(cachedDetails{Version: detailsCacheVersion, Backend: backend, Venues: venues})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.Dir, ".details-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(backend))
+}
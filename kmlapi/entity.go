@@ -9,8 +9,20 @@ type HasName struct {
 }
 
 type Location struct {
-	Lat float64 `json:"lat"`
-	Lng float64 `json:"lng"`
+	Lat              float64  `json:"lat"`
+	Lng              float64  `json:"lng"`
+	Address          string   `json:"address"`
+	City             string   `json:"city"`
+	State            string   `json:"state"`
+	PostalCode       string   `json:"postalCode"`
+	Country          string   `json:"country"`
+	Cc               string   `json:"cc"`
+	FormattedAddress []string `json:"formattedAddress"`
+}
+
+type Contact struct {
+	Phone          string `json:"phone"`
+	FormattedPhone string `json:"formattedPhone"`
 }
 
 type Category struct {
@@ -23,7 +35,31 @@ type Venue struct {
 	HasName
 	Location        Location   `json:"location"`
 	Categories      []Category `json:"categories"`
+	Contact         Contact    `json:"contact"`
+	Url             string     `json:"url"`
 	VisitTimestamps []int64    `json:"-"`
+	// Tips and Photos are the user's own, newest first, when requested.
+	Tips   []Tip   `json:"-"`
+	Photos []Photo `json:"-"`
+}
+
+type Tip struct {
+	Id        string
+	Text      string
+	CreatedAt int64
+}
+
+// Photo is served in any size by joining Prefix, a size such as 100x100 or
+// original, and Suffix.
+type Photo struct {
+	Id        string
+	Prefix    string
+	Suffix    string
+	CreatedAt int64
+}
+
+func (p Photo) URL(size string) string {
+	return p.Prefix + size + p.Suffix
 }
 
 type GlobalCategory struct {
@@ -37,3 +73,19 @@ type fsqCategory struct {
 		Categories []GlobalCategory `json:"categories"`
 	} `json:"response"`
 }
+
+// List is a user curated list of venues, like the saved and liked venues
+// or a custom "to try" list.
+type List struct {
+	HasId
+	HasName
+	Description string
+	Items       []ListItem
+}
+
+type ListItem struct {
+	Id        string
+	Venue     Venue
+	Note      string
+	CreatedAt int64
+}
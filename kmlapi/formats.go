@@ -0,0 +1,367 @@
+package kmlapi
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatKML     Format = "kml"
+	FormatGeoJSON Format = "geojson"
+	FormatCSV     Format = "csv"
+	// FormatKMZ is KML zipped together with the photo thumbnails.
+	FormatKMZ Format = "kmz"
+)
+
+var Formats = []Format{FormatKML, FormatGeoJSON, FormatCSV, FormatKMZ}
+
+func ParseFormat(s string) (Format, error) {
+	if s == "" {
+		return FormatKML, nil
+	}
+	for _, f := range Formats {
+		if strings.EqualFold(s, string(f)) {
+			return f, nil
+		}
+	}
+	names := make([]string, len(Formats))
+	for i, f := range Formats {
+		names[i] = string(f)
+	}
+	return "", fmt.Errorf("unsupported format, expected one of %s", strings.Join(names, ", "))
+}
+
+func (f Format) Extension() string {
+	return string(f)
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case FormatGeoJSON:
+		return "application/geo+json"
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatKMZ:
+		return "application/vnd.google-earth.kmz"
+	default:
+		return "application/vnd.google-earth.kml+xml"
+	}
+}
+
+type ExportOptions struct {
+	Before *time.Time
+	After  *time.Time
+	Format Format
+	Filter Filter
+	// Locale of the category names and labels, the default locale when
+	// empty.
+	Locale string
+	Lists  ListsMode
+	// Tips and Photos attach the user's tips and checkin photos to the
+	// venues.
+	Tips   bool
+	Photos bool
+	// Grouping sorts the venues into folders, by top-level category when
+	// nil.
+	Grouping Grouping
+	// Split writes a file per outermost group and list, each with at most
+	// MaxPlacemarks placemarks when positive, which also implies Split.
+	Split         bool
+	MaxPlacemarks int
+	// Superoverlay splits the venues into a quadtree of tiles loaded as
+	// the viewer zooms in, with at most MaxPlacemarks placemarks each.
+	Superoverlay bool
+	// Density bins the checkins into cells of CellSize degrees,
+	// DefaultCellSize when not positive, instead of exporting the venues,
+	// in a layer per DensityBy.
+	Density   DensityShape
+	CellSize  float64
+	DensityBy DensityLayers
+	// Cluster groups nearby venues into cluster placemarks below the
+	// ClusterZooms levels, ClusterRadius meters apart at the deepest one;
+	// see Dataset.Cluster.
+	Cluster       ClusterMethod
+	ClusterRadius float64
+	ClusterZooms  []int
+}
+
+func (o ExportOptions) split() bool {
+	return o.Split || o.MaxPlacemarks > 0 || o.Superoverlay
+}
+
+// OutputFormat is the format Export writes: a split KML export is a KMZ
+// archive holding the index and the parts.
+func (o ExportOptions) OutputFormat() Format {
+	if o.split() && (o.Format == FormatKML || o.Format == "") {
+		return FormatKMZ
+	}
+	return o.Format
+}
+
+// Export fetches the history described by opts and writes it to w in the
+// requested format.
+func Export(ctx context.Context, token FSQToken, opts ExportOptions, w io.Writer, listener ProgressListener) (ExportStats, error) {
+	rep := newProgressReporter(listener)
+	ds, stats, err := fetchDataset(ctx, token, opts, rep)
+	if err != nil {
+		return stats, err
+	}
+	return stats, writeDataset(ctx, w, ds.Filter(opts.Filter), opts, rep, &stats)
+}
+
+// ExportSplit fetches the history described by opts and renders it as the
+// index and parts of a split or superoverlay KML export, for writing into a
+// directory.
+func ExportSplit(ctx context.Context, token FSQToken, opts ExportOptions, listener ProgressListener) ([]Part, ExportStats, error) {
+	rep := newProgressReporter(listener)
+	ds, stats, err := fetchDataset(ctx, token, opts, rep)
+	if err != nil {
+		return nil, stats, err
+	}
+	return renderParts(ds.Filter(opts.Filter), opts, rep, &stats, nil), stats, nil
+}
+
+// renderParts renders the files of a split export, the index first.
+func renderParts(ds *Dataset, opts ExportOptions, rep *progressReporter, stats *ExportStats, photos photoSource) []Part {
+	if opts.Superoverlay {
+		return superoverlayKML(ds, opts.Grouping, opts.MaxPlacemarks, rep, stats, photos)
+	}
+	return splitKML(ds, opts.Grouping, opts.MaxPlacemarks, rep, stats, photos)
+}
+
+// WriteDataset renders an already fetched dataset in the given format.
+func WriteDataset(w io.Writer, ds *Dataset, format Format) (ExportStats, error) {
+	return WriteDatasetGrouped(w, ds, format, nil)
+}
+
+// WriteDatasetGrouped renders ds with the venues grouped by g, by top-level
+// category when nil.
+func WriteDatasetGrouped(w io.Writer, ds *Dataset, format Format, g Grouping) (ExportStats, error) {
+	stats := ExportStats{VenuesFetched: len(ds.Venues)}
+	return stats, writeDataset(context.Background(), w, ds, ExportOptions{Format: format, Grouping: g}, nil, &stats)
+}
+
+// writeDataset renders ds in the output format of opts. A nil grouping
+// puts the KML folders by top-level category and leaves the group out of
+// the flat formats.
+func writeDataset(ctx context.Context, w io.Writer, ds *Dataset, opts ExportOptions, rep *progressReporter, stats *ExportStats) error {
+	g := opts.Grouping
+	ds = ds.Cluster(opts.Cluster, opts.ClusterRadius, opts.ClusterZooms)
+	if opts.Density != DensityOff && opts.OutputFormat() == FormatGeoJSON {
+		return writeDensityGeoJSON(w, ds, opts, rep, stats)
+	}
+	if opts.Density != DensityOff && opts.OutputFormat() == FormatKML {
+		return densityKML(ds, opts, rep, stats).WriteIndent(w, "", "  ")
+	}
+	switch format := opts.OutputFormat(); format {
+	case FormatKML, "":
+		return buildKML(ds, g, rep, stats, nil).WriteIndent(w, "", "  ")
+	case FormatKMZ:
+		return writeKMZ(ctx, w, ds, opts, rep, stats)
+	case FormatGeoJSON:
+		return writeGeoJSON(w, ds, g, rep, stats)
+	case FormatCSV:
+		return writeCSV(w, ds, g, rep, stats)
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Id         string                 `json:"id,omitempty"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func categoryNames(v Venue) []string {
+	names := make([]string, 0, len(v.Categories))
+	for _, c := range v.Categories {
+		if c.Name != "" {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+func lastVisit(timestamps []int64) int64 {
+	if len(timestamps) == 0 {
+		return 0
+	}
+	return timestamps[0]
+}
+
+// visitsLayer is the GeoJSON layer of the visited venues; list items are
+// in a layer named after their list.
+const visitsLayer = "visits"
+
+func venueFeature(ds *Dataset, v Venue, layer string) geoJSONFeature {
+	timestamps := v.VisitTimestamps
+	if timestamps == nil {
+		timestamps = []int64{}
+	}
+	f := geoJSONFeature{
+		Type: "Feature",
+		Id:   v.Id,
+		Geometry: geoJSONGeometry{
+			Type:        "Point",
+			Coordinates: []float64{v.Location.Lng, v.Location.Lat},
+		},
+		Properties: map[string]interface{}{
+			"layer":                 layer,
+			"name":                  v.Name,
+			"categories":            categoryNames(v),
+			"top_level":             ds.TopLevelNames(v),
+			"visit_count":           len(v.VisitTimestamps),
+			"last_visit_unix":       lastVisit(v.VisitTimestamps),
+			"visit_timestamps_unix": timestamps,
+		},
+	}
+	for _, d := range venueDetails(v) {
+		if d.value != "" {
+			f.Properties[d.name] = d.value
+		}
+	}
+	if len(v.Tips) > 0 {
+		f.Properties["tips"] = tipTexts(v.Tips)
+	}
+	if len(v.Photos) > 0 {
+		f.Properties["photo_urls"] = photoURLs(v.Photos)
+	}
+	return f
+}
+
+func writeGeoJSON(w io.Writer, ds *Dataset, g Grouping, rep *progressReporter, stats *ExportStats) error {
+	rep.stageStarted("geojson")
+	collection := geoJSONCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(ds.Venues))}
+	for _, v := range ds.Venues {
+		f := venueFeature(ds, v, visitsLayer)
+		if g != nil {
+			f.Properties["groups"] = groupLabels(ds, g, v)
+		}
+		collection.Features = append(collection.Features, f)
+	}
+	for _, l := range ds.Lists {
+		for _, it := range l.Items {
+			f := venueFeature(ds, it.Venue, l.Name)
+			f.Properties["list_id"] = l.Id
+			f.Properties["note"] = it.Note
+			f.Properties["added_unix"] = it.CreatedAt
+			collection.Features = append(collection.Features, f)
+		}
+	}
+	if ds.Clusters != nil {
+		msg := CatalogFor(ds.Locale)
+		for i, f := range collection.Features[:len(ds.Venues)] {
+			if zoom, ok := ds.Clusters.minZoom(ds.Venues[i]); ok {
+				f.Properties["min_zoom"] = zoom
+			}
+		}
+		for _, c := range ds.Clusters.Clusters {
+			collection.Features = append(collection.Features, clusterFeature(c, msg))
+		}
+	}
+	countExported(ds, stats)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(collection); err != nil {
+		return err
+	}
+	finishRender("geojson", ds, rep, stats)
+	return nil
+}
+
+func writeCSV(w io.Writer, ds *Dataset, g Grouping, rep *progressReporter, stats *ExportStats) error {
+	rep.stageStarted("csv")
+	cw := csv.NewWriter(w)
+	header := []string{"id", "name", "lat", "lng", "categories", "top_level", "visit_count", "last_visit_utc", "visit_timestamps_unix"}
+	// The list columns only appear when lists are exported, so plain
+	// exports keep their layout.
+	withLists := len(ds.Lists) > 0
+	if withLists {
+		header = append(header, "list", "note")
+	}
+	// The venue details come last so the earlier columns keep their
+	// positions.
+	header = append(header, detailFields...)
+	if g != nil {
+		header = append(header, "groups")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	row := func(v Venue, groups string, extra ...string) error {
+		for _, d := range venueDetails(v) {
+			extra = append(extra, d.value)
+		}
+		if g != nil {
+			extra = append(extra, groups)
+		}
+		last := ""
+		if len(v.VisitTimestamps) > 0 {
+			last = time.Unix(v.VisitTimestamps[0], 0).UTC().Format(time.RFC3339)
+		}
+		timestamps := make([]string, len(v.VisitTimestamps))
+		for i, ts := range v.VisitTimestamps {
+			timestamps[i] = strconv.FormatInt(ts, 10)
+		}
+		return cw.Write(append([]string{
+			v.Id,
+			v.Name,
+			strconv.FormatFloat(v.Location.Lat, 'f', -1, 64),
+			strconv.FormatFloat(v.Location.Lng, 'f', -1, 64),
+			strings.Join(categoryNames(v), "; "),
+			strings.Join(ds.TopLevelNames(v), "; "),
+			strconv.Itoa(len(v.VisitTimestamps)),
+			last,
+			strings.Join(timestamps, " "),
+		}, extra...))
+	}
+	for _, v := range ds.Venues {
+		var extra []string
+		if withLists {
+			extra = []string{"", ""}
+		}
+		var groups string
+		if g != nil {
+			groups = strings.Join(groupLabels(ds, g, v), "; ")
+		}
+		if err := row(v, groups, extra...); err != nil {
+			return err
+		}
+	}
+	// List items are grouped by their list.
+	for _, l := range ds.Lists {
+		for _, it := range l.Items {
+			if err := row(it.Venue, "", l.Name, it.Note); err != nil {
+				return err
+			}
+		}
+	}
+	countExported(ds, stats)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	finishRender("csv", ds, rep, stats)
+	return nil
+}
@@ -0,0 +1,103 @@
+package kmlapi
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testDataset() *Dataset {
+	return &Dataset{
+		Venues: []Venue{
+			{
+				HasId:           HasId{Id: "v1"},
+				HasName:         HasName{Name: "Cafe One"},
+				Location:        Location{Lat: 1.5, Lng: 2.5},
+				Categories:      []Category{{HasId: HasId{Id: "child-coffee"}, HasName: HasName{Name: "Coffee Shop"}}},
+				VisitTimestamps: []int64{200, 100},
+			},
+			{
+				HasId:           HasId{Id: "v2"},
+				HasName:         HasName{Name: "Mystery Place"},
+				Location:        Location{Lat: 3, Lng: 4},
+				VisitTimestamps: []int64{300},
+			},
+		},
+		Root:     Root{"top-food": "top-food", "child-coffee": "top-food"},
+		TopLevel: TopLevel{"top-food": "Food"},
+	}
+}
+
+func TestWriteDatasetGeoJSON(t *testing.T) {
+	var buf bytes.Buffer
+	stats, err := WriteDataset(&buf, testDataset(), FormatGeoJSON)
+	if err != nil {
+		t.Fatalf("WriteDataset returned error: %v", err)
+	}
+	if stats.VenuesExported != 2 || stats.UnknownCategoryVenues != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	var doc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Id       string `json:"id"`
+			Geometry struct {
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid GeoJSON: %v", err)
+	}
+	if doc.Type != "FeatureCollection" || len(doc.Features) != 2 {
+		t.Fatalf("unexpected collection: %+v", doc)
+	}
+	f := doc.Features[0]
+	if f.Geometry.Coordinates[0] != 2.5 || f.Geometry.Coordinates[1] != 1.5 {
+		t.Fatalf("expected lng,lat coordinates, got %v", f.Geometry.Coordinates)
+	}
+	if f.Properties["visit_count"].(float64) != 2 || f.Properties["top_level"].([]interface{})[0] != "Food" {
+		t.Fatalf("unexpected properties: %v", f.Properties)
+	}
+}
+
+func TestWriteDatasetCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := WriteDataset(&buf, testDataset(), FormatCSV); err != nil {
+		t.Fatalf("WriteDataset returned error: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "id" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+	if rows[1][5] != "Food" || rows[1][6] != "2" || rows[1][8] != "200 100" {
+		t.Fatalf("unexpected first row: %v", rows[1])
+	}
+	if rows[2][5] != unknownCategoryFolder {
+		t.Fatalf("expected unknown top level for uncategorized venue, got %v", rows[2])
+	}
+}
+
+func TestDatasetFilter(t *testing.T) {
+	ds := testDataset()
+
+	if got := ds.Filter(Filter{Categories: []string{"food"}}).Venues; len(got) != 1 || got[0].Id != "v1" {
+		t.Fatalf("expected category filter to keep v1, got %#v", got)
+	}
+	if got := ds.Filter(Filter{Categories: []string{"Unknown"}}).Venues; len(got) != 1 || got[0].Id != "v2" {
+		t.Fatalf("expected Unknown filter to keep v2, got %#v", got)
+	}
+	if got := ds.Filter(Filter{MinVisits: 2}).Venues; len(got) != 1 || got[0].Id != "v1" {
+		t.Fatalf("expected min visits filter to keep v1, got %#v", got)
+	}
+	if got := ds.Filter(Filter{Name: "MYSTERY"}).Venues; len(got) != 1 || !strings.HasPrefix(got[0].Name, "Mystery") {
+		t.Fatalf("expected name filter to keep v2, got %#v", got)
+	}
+}
@@ -0,0 +1,225 @@
+package kmlapi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twpayne/go-kml"
+)
+
+// Grouping places a visited venue into folders. Each path is one folder per
+// level, outermost first; a venue in several groups is exported in each.
+type Grouping interface {
+	Groups(ds *Dataset, v Venue) [][]string
+}
+
+type GroupingFunc func(ds *Dataset, v Venue) [][]string
+
+func (f GroupingFunc) Groups(ds *Dataset, v Venue) [][]string {
+	return f(ds, v)
+}
+
+var (
+	// GroupByCategory is the default, one folder per top-level category.
+	GroupByCategory Grouping = GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		names := ds.TopLevelNames(v)
+		groups := make([][]string, len(names))
+		for i, name := range names {
+			groups[i] = []string{name}
+		}
+		return groups
+	})
+	// GroupByCategoryPath nests the folders along the category tree, e.g.
+	// Food > Asian Restaurant > Sushi Restaurant.
+	GroupByCategoryPath Grouping = GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		var groups [][]string
+		seen := make(map[string]struct{})
+		for _, c := range v.Categories {
+			path := ds.CategoryPath(c)
+			key := strings.Join(path, "\x00")
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			groups = append(groups, path)
+		}
+		if len(groups) == 0 {
+			groups = [][]string{{ds.unknown()}}
+		}
+		return groups
+	})
+	GroupByCountry Grouping = GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		return [][]string{{ds.orUnknown(v.Location.CountryName())}}
+	})
+	// GroupByCity names the folders "city, country", keeping apart cities
+	// of the same name.
+	GroupByCity Grouping = GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		city := v.Location.City
+		if country := v.Location.CountryName(); city != "" && country != "" {
+			city += ", " + country
+		}
+		return [][]string{{ds.orUnknown(city)}}
+	})
+	// GroupByFirstVisit and GroupByLastVisit group by the UTC year of the
+	// first or last visit in the window.
+	GroupByFirstVisit Grouping = GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		if len(v.VisitTimestamps) == 0 {
+			return [][]string{{ds.unknown()}}
+		}
+		return [][]string{{visitYear(v.VisitTimestamps[len(v.VisitTimestamps)-1])}}
+	})
+	GroupByLastVisit Grouping = GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		if len(v.VisitTimestamps) == 0 {
+			return [][]string{{ds.unknown()}}
+		}
+		return [][]string{{visitYear(v.VisitTimestamps[0])}}
+	})
+)
+
+func visitYear(ts int64) string {
+	return strconv.Itoa(time.Unix(ts, 0).UTC().Year())
+}
+
+// Nest places the groups of inner inside those of outer, e.g. categories
+// inside countries.
+func Nest(outer Grouping, inner Grouping) Grouping {
+	return GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+		var groups [][]string
+		for _, o := range outer.Groups(ds, v) {
+			for _, i := range inner.Groups(ds, v) {
+				groups = append(groups, append(append([]string(nil), o...), i...))
+			}
+		}
+		return groups
+	})
+}
+
+var groupings = map[string]Grouping{
+	"category":      GroupByCategory,
+	"category-path": GroupByCategoryPath,
+	"country":       GroupByCountry,
+	"city":          GroupByCity,
+	"first-visit":   GroupByFirstVisit,
+	"last-visit":    GroupByLastVisit,
+}
+
+// GroupingNames are the groupings ParseGrouping knows. Any of them can be
+// nested with >, e.g. country>category.
+var GroupingNames = []string{"category", "category-path", "country", "city", "first-visit", "last-visit", "country-category"}
+
+// ParseGrouping returns the named grouping, nil for the default category
+// grouping.
+func ParseGrouping(s string) (Grouping, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "category" {
+		return nil, nil
+	}
+	if s == "country-category" {
+		s = "country>category"
+	}
+	var g Grouping
+	for _, name := range strings.Split(s, ">") {
+		level, ok := groupings[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown grouping %q, expected one of %s or levels joined by >", name, strings.Join(GroupingNames, ", "))
+		}
+		if g == nil {
+			g = level
+		} else {
+			g = Nest(g, level)
+		}
+	}
+	return g, nil
+}
+
+func (ds *Dataset) unknown() string {
+	return CatalogFor(ds.Locale).Unknown
+}
+
+func (ds *Dataset) orUnknown(name string) string {
+	if name == "" {
+		return ds.unknown()
+	}
+	return name
+}
+
+// CategoryPath returns the names from the top level down to c. Categories
+// missing from the tree, like those of the v3 backend, get their top level
+// and their own name.
+func (ds *Dataset) CategoryPath(c Category) []string {
+	var path []string
+	for id := c.Id; id != "" && len(path) <= len(ds.Tree.Name); id = ds.Tree.Parent[id] {
+		name, ok := ds.Tree.Name[id]
+		if !ok {
+			break
+		}
+		path = append(path, name)
+	}
+	if len(path) > 0 {
+		for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+			path[i], path[j] = path[j], path[i]
+		}
+		return path
+	}
+	top := ds.TopLevel[ds.Root[c.Id]]
+	if top == "" {
+		return []string{ds.unknown()}
+	}
+	if c.Name != "" && c.Name != top {
+		return []string{top, c.Name}
+	}
+	return []string{top}
+}
+
+// groupLabels joins each group path of v for flat formats.
+func groupLabels(ds *Dataset, g Grouping, v Venue) []string {
+	groups := g.Groups(ds, v)
+	labels := make([]string, len(groups))
+	for i, path := range groups {
+		labels[i] = strings.Join(path, " > ")
+	}
+	return labels
+}
+
+// folderTree collects the placemarks of a grouping before rendering the
+// folders sorted by name.
+type folderTree struct {
+	children map[string]*folderTree
+	places   []kml.Element
+}
+
+func (t *folderTree) add(path []string, place kml.Element) {
+	for _, name := range path {
+		if t.children == nil {
+			t.children = make(map[string]*folderTree)
+		}
+		c := t.children[name]
+		if c == nil {
+			c = &folderTree{}
+			t.children[name] = c
+		}
+		t = c
+	}
+	t.places = append(t.places, place)
+}
+
+// folders renders the subfolders of t.
+func (t *folderTree) folders() []kml.Element {
+	names := make([]string, 0, len(t.children))
+	for name := range t.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]kml.Element, len(names))
+	for i, name := range names {
+		c := t.children[name]
+		folder := kml.Folder(kml.Name(name))
+		folder.Add(c.folders()...)
+		folder.Add(c.places...)
+		out[i] = folder
+	}
+	return out
+}
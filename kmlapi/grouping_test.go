@@ -0,0 +1,131 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGrouping(t *testing.T) {
+	for _, name := range []string{"", "category", "Category"} {
+		if g, err := ParseGrouping(name); err != nil || g != nil {
+			t.Fatalf("expected %q to be the default grouping, got %v %v", name, g, err)
+		}
+	}
+	for _, name := range GroupingNames[1:] {
+		if g, err := ParseGrouping(name); err != nil || g == nil {
+			t.Fatalf("ParseGrouping(%q) = %v, %v", name, g, err)
+		}
+	}
+	if _, err := ParseGrouping("country>weekday"); err == nil {
+		t.Fatal("expected an unknown level to fail")
+	}
+}
+
+func TestGroupings(t *testing.T) {
+	ds := detailedDataset()
+	ds.Venues[0].VisitTimestamps = []int64{
+		time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC).Unix(),
+		time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC).Unix(),
+	}
+	cafe, mystery := ds.Venues[0], ds.Venues[1]
+
+	for _, tc := range []struct {
+		grouping string
+		venue    Venue
+		want     [][]string
+	}{
+		{"country", cafe, [][]string{{"Portugal"}}},
+		{"country", mystery, [][]string{{unknownCategoryFolder}}},
+		{"city", cafe, [][]string{{"Lisbon, Portugal"}}},
+		{"first-visit", cafe, [][]string{{"2019"}}},
+		{"last-visit", cafe, [][]string{{"2021"}}},
+		{"country-category", cafe, [][]string{{"Portugal", "Food"}}},
+		{"first-visit>city", cafe, [][]string{{"2019", "Lisbon, Portugal"}}},
+	} {
+		g, err := ParseGrouping(tc.grouping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := g.Groups(ds, tc.venue); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s of %s = %v, want %v", tc.grouping, tc.venue.Id, got, tc.want)
+		}
+	}
+}
+
+func TestCategoryPathFollowsTheTree(t *testing.T) {
+	withCategoryCache(t, time.Hour)
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"response":{"categories":[{"id":"food","name":"Food","categories":[{"id":"asian","name":"Asian Restaurant","categories":[{"id":"sushi","name":"Sushi Restaurant","categories":[]}]}]}]}}`)
+	})
+	root, topLevel, tree, err := resolveCategories(context.Background(), V2Backend{}, NewToken("token"), DefaultLocale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root["sushi"] != "food" {
+		t.Fatalf("expected a nested category rooted at its top level, got %q", root["sushi"])
+	}
+	ds := &Dataset{Root: root, TopLevel: topLevel, Tree: tree}
+	if got := ds.CategoryPath(Category{HasId: HasId{Id: "sushi"}}); !reflect.DeepEqual(got, []string{"Food", "Asian Restaurant", "Sushi Restaurant"}) {
+		t.Fatalf("unexpected path %v", got)
+	}
+
+	// Categories outside the tree, like those of the v3 backend.
+	ds.Root["13276"] = "food"
+	if got := ds.CategoryPath(Category{HasId: HasId{Id: "13276"}, HasName: HasName{Name: "Sushi"}}); !reflect.DeepEqual(got, []string{"Food", "Sushi"}) {
+		t.Fatalf("unexpected path %v", got)
+	}
+	if got := ds.CategoryPath(Category{HasId: HasId{Id: "other"}}); !reflect.DeepEqual(got, []string{unknownCategoryFolder}) {
+		t.Fatalf("unexpected path %v", got)
+	}
+}
+
+func TestGroupedExports(t *testing.T) {
+	ds := detailedDataset()
+	g, _ := ParseGrouping("country>category")
+
+	k, _ := BuildKMLFromDatasetGrouped(ds, g)
+	var buf bytes.Buffer
+	if err := k.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	portugal := strings.Index(out, "<Folder><name>Portugal</name><Folder><name>Food</name><Placemark><name>Cafe One</name>")
+	unknown := strings.Index(out, "<Folder><name>Unknown</name><Folder><name>Unknown</name><Placemark><name>Mystery Place</name>")
+	if portugal < 0 || unknown < 0 || portugal > unknown {
+		t.Fatalf("expected nested folders sorted by name, got %s", out)
+	}
+
+	buf.Reset()
+	if _, err := WriteDatasetGrouped(&buf, ds, FormatCSV, g); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := len(rows[0]) - 1
+	if rows[0][last] != "groups" || rows[1][last] != "Portugal > Food" {
+		t.Fatalf("unexpected group column %v", rows[:2])
+	}
+}
+
+func TestParseExportOptionsGrouping(t *testing.T) {
+	opts, err := ParseExportOptions(url.Values{"group_by": {"first-visit"}}, time.Now())
+	if err != nil || opts.Grouping == nil {
+		t.Fatalf("expected a grouping, got %v", err)
+	}
+	_, err = ParseExportOptions(url.Values{"group_by": {"weekday"}}, time.Now())
+	var paramErr *ParamError
+	if !errors.As(err, &paramErr) || paramErr.Param != "group_by" {
+		t.Fatalf("expected group_by ParamError, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package kmlapi
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"path"
+	"sort"
+)
+
+// kmzDoc is the entry viewers open, the first KML of the archive.
+const kmzDoc = "doc.kml"
+
+// writeKMZ packs the KML with the photo thumbnails as files/<id>.jpg, so
+// the map shows them offline. Thumbnails that fail to download stay linked
+// from their URL. A split export packs the index as doc.kml next to its
+// parts.
+func writeKMZ(ctx context.Context, w io.Writer, ds *Dataset, opts ExportOptions, rep *progressReporter, stats *ExportStats) error {
+	if opts.Density != DensityOff {
+		return writeZip(w, []Part{{Name: kmzDoc, KML: densityKML(ds, opts, rep, stats)}}, nil)
+	}
+	files, err := downloadThumbnails(ctx, ds, rep)
+	if err != nil {
+		return err
+	}
+	stats.ThumbnailsPacked = len(files)
+
+	photos := func(p Photo) string {
+		if _, ok := files[thumbnailPath(p)]; ok {
+			return thumbnailPath(p)
+		}
+		return remotePhoto(p)
+	}
+	var docs []Part
+	if opts.split() {
+		docs = renderParts(ds, opts, rep, stats, photos)
+		docs[0].Name = kmzDoc
+	} else {
+		docs = []Part{{Name: kmzDoc, KML: buildKML(ds, opts.Grouping, rep, stats, photos)}}
+	}
+	return writeZip(w, docs, files)
+}
+
+// writeZip packs the KML documents, the first one opened by viewers, and
+// the files stored as they are.
+func writeZip(w io.Writer, docs []Part, files map[string][]byte) error {
+	zw := zip.NewWriter(w)
+	for _, d := range docs {
+		f, err := zw.Create(d.Name)
+		if err != nil {
+			return err
+		}
+		if err := d.KML.WriteIndent(f, "", "  "); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func thumbnailPath(p Photo) string {
+	ext := path.Ext(p.Suffix)
+	if ext == "" {
+		ext = ".jpg"
+	}
+	return "files/" + p.Id + ext
+}
+
+func downloadThumbnails(ctx context.Context, ds *Dataset, rep *progressReporter) (map[string][]byte, error) {
+	var photos []Photo
+	seen := make(map[string]struct{})
+	collect := func(v Venue) {
+		for _, p := range v.Photos {
+			if _, ok := seen[p.Id]; !ok {
+				seen[p.Id] = struct{}{}
+				photos = append(photos, p)
+			}
+		}
+	}
+	for _, v := range ds.Venues {
+		collect(v)
+	}
+	for _, l := range ds.Lists {
+		for _, it := range l.Items {
+			collect(it.Venue)
+		}
+	}
+
+	files := make(map[string][]byte, len(photos))
+	if len(photos) == 0 {
+		return files, nil
+	}
+	rep.stageStarted("thumbnails")
+	failed := 0
+	for i, p := range photos {
+		content, took, err := fetchThumbnail(ctx, p)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			failed++
+			continue
+		}
+		files[thumbnailPath(p)] = content
+		rep.pageFetched("thumbnails", i+1, len(photos), took)
+	}
+	rep.stageFinished("thumbnails", len(photos), len(photos))
+	if failed > 0 {
+		rep.warning("thumbnails", "%d thumbnails could not be downloaded and stay linked from their URL", failed)
+	}
+	return files, nil
+}
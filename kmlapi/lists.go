@@ -0,0 +1,155 @@
+package kmlapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListsMode selects whether the user's lists are exported, and whether
+// together with the visited venues or on their own.
+type ListsMode string
+
+const (
+	ListsOff     ListsMode = ""
+	ListsInclude ListsMode = "include"
+	ListsOnly    ListsMode = "only"
+
+	listItemsPageLimit = 200
+	maxListItemsPages  = 100
+)
+
+func ParseListsMode(s string) (ListsMode, error) {
+	switch m := ListsMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case ListsOff, ListsInclude, ListsOnly:
+		return m, nil
+	case "off", "none":
+		return ListsOff, nil
+	}
+	return ListsOff, fmt.Errorf("expected off, include or only")
+}
+
+func (m ListsMode) visits() bool {
+	return m != ListsOnly
+}
+
+// listPath escapes the segments of a list id; the saved and liked lists
+// have ids like 12345/todos.
+func listPath(id string) string {
+	segments := strings.Split(id, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+type fsqText struct {
+	Text string `json:"text"`
+}
+
+type fsqListItem struct {
+	Id        string   `json:"id"`
+	CreatedAt int64    `json:"createdAt"`
+	Venue     *Venue   `json:"venue"`
+	Note      *fsqText `json:"note"`
+	Tip       *fsqText `json:"tip"`
+}
+
+func (it fsqListItem) note() string {
+	if it.Note != nil && it.Note.Text != "" {
+		return it.Note.Text
+	}
+	if it.Tip != nil {
+		return it.Tip.Text
+	}
+	return ""
+}
+
+// fetchLists returns the lists created or followed by the user with their
+// venues. Items without a venue, like tips on events, are skipped.
+func fetchLists(ctx context.Context, token FSQToken, locale string, rep *progressReporter) ([]List, error) {
+	var index struct {
+		Response struct {
+			Lists struct {
+				Groups []struct {
+					Type  string `json:"type"`
+					Items []struct {
+						Id          string `json:"id"`
+						Name        string `json:"name"`
+						Description string `json:"description"`
+						ListItems   struct {
+							Count int `json:"count"`
+						} `json:"listItems"`
+					} `json:"items"`
+				} `json:"groups"`
+			} `json:"lists"`
+		} `json:"response"`
+	}
+
+	rep.stageStarted("lists")
+	if _, err := fetchPage(ctx, rep, "lists", fsqUserLists+localizedQuery(token, locale).Encode(), &index); err != nil {
+		return nil, err
+	}
+
+	var lists []List
+	seen := make(map[string]struct{})
+	for _, group := range index.Response.Lists.Groups {
+		for _, l := range group.Items {
+			if _, ok := seen[l.Id]; ok || l.Id == "" {
+				continue
+			}
+			seen[l.Id] = struct{}{}
+			lists = append(lists, List{HasId: HasId{Id: l.Id}, HasName: HasName{Name: l.Name}, Description: l.Description})
+		}
+	}
+
+	for i := range lists {
+		items, err := fetchListItems(ctx, token, lists[i].Id, locale, rep)
+		if err != nil {
+			return nil, err
+		}
+		lists[i].Items = items
+	}
+	rep.stageFinished("lists", len(lists), len(lists))
+	return lists, nil
+}
+
+func fetchListItems(ctx context.Context, token FSQToken, id string, locale string, rep *progressReporter) ([]ListItem, error) {
+	var items []ListItem
+	offset := 0
+	for page := 0; page < maxListItemsPages; page++ {
+		q := localizedQuery(token, locale)
+		q.Add("limit", strconv.Itoa(listItemsPageLimit))
+		q.Add("offset", strconv.Itoa(offset))
+
+		var fsq struct {
+			Response struct {
+				List struct {
+					ListItems struct {
+						Count int           `json:"count"`
+						Items []fsqListItem `json:"items"`
+					} `json:"listItems"`
+				} `json:"list"`
+			} `json:"response"`
+		}
+		took, err := fetchPage(ctx, rep, "lists", fsqLists+listPath(id)+"?"+q.Encode(), &fsq)
+		if err != nil {
+			return nil, err
+		}
+		listed := fsq.Response.List.ListItems
+		for _, it := range listed.Items {
+			if it.Venue == nil || it.Venue.Id == "" {
+				continue
+			}
+			items = append(items, ListItem{Id: it.Id, Venue: *it.Venue, Note: it.note(), CreatedAt: it.CreatedAt})
+		}
+		offset += len(listed.Items)
+		rep.pageFetched("lists", offset, listed.Count, took)
+		if len(listed.Items) == 0 || offset >= listed.Count {
+			break
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,143 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func TestParseListsMode(t *testing.T) {
+	for in, want := range map[string]ListsMode{"": ListsOff, "off": ListsOff, "Include": ListsInclude, "only": ListsOnly} {
+		if got, err := ParseListsMode(in); err != nil || got != want {
+			t.Fatalf("ParseListsMode(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseListsMode("all"); err == nil {
+		t.Fatal("expected an unknown mode to fail")
+	}
+}
+
+func TestFetchDatasetIncludesLists(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+
+	ds, stats, err := FetchDatasetWithOptions(context.Background(), NewToken(fsqfake.DefaultToken), ExportOptions{Lists: ListsInclude}, nil)
+	if err != nil {
+		t.Fatalf("FetchDatasetWithOptions returned error: %v", err)
+	}
+	if len(ds.Venues) == 0 || stats.ListsFetched != len(data.Lists) || len(ds.Lists) != len(data.Lists) {
+		t.Fatalf("expected venues and %d lists, got %d venues and %+v", len(data.Lists), len(ds.Venues), stats)
+	}
+	saved := ds.Lists[0]
+	if saved.Id != data.Lists[0].Id || saved.Name != data.Lists[0].Name || len(saved.Items) != len(data.Lists[0].Items) {
+		t.Fatalf("unexpected saved list: %+v", saved)
+	}
+
+	visits := make(map[string]int)
+	for _, c := range data.Checkins {
+		visits[c.VenueId]++
+	}
+	for i, it := range saved.Items {
+		want := data.Lists[0].Items[i]
+		if it.Venue.Id != want.VenueId || it.Note != want.Note {
+			t.Fatalf("unexpected item %d: %+v", i, it)
+		}
+		if len(it.Venue.VisitTimestamps) != visits[want.VenueId] {
+			t.Fatalf("expected the visits of %s attached to its list item", want.VenueId)
+		}
+	}
+}
+
+func TestListsOnlySkipsTheHistory(t *testing.T) {
+	fake := fsqfake.NewServer(fsqfake.Generate(fsqfake.DefaultGenerateOptions()))
+	var history int32
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/users/self/venuehistory") || strings.HasPrefix(r.URL.Path, "/v2/users/self/checkins") {
+			atomic.AddInt32(&history, 1)
+		}
+		fake.ServeHTTP(w, r)
+	})
+
+	var buf bytes.Buffer
+	stats, err := Export(context.Background(), NewToken(fsqfake.DefaultToken), ExportOptions{Format: FormatKML, Lists: ListsOnly}, &buf, nil)
+	if err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+	if history != 0 {
+		t.Fatalf("expected no history requests, got %d", history)
+	}
+	if stats.VenuesExported != 0 || stats.ListItemsExported != 30 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	out := buf.String()
+	for _, want := range []string{"<name>Saved places</name>", "<name>To try</name>", "<description>Places friends keep recommending</description>", `<SimpleData name="list_id">1001/todos</SimpleData>`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in the export", want)
+		}
+	}
+}
+
+func testListDataset() *Dataset {
+	ds := testDataset()
+	ds.Lists = []List{{
+		HasId:   HasId{Id: "l1"},
+		HasName: HasName{Name: "To try"},
+		Items: []ListItem{
+			{Id: "i1", Venue: Venue{HasId: HasId{Id: "v3"}, HasName: HasName{Name: "New Cafe"}, Categories: []Category{{HasId: HasId{Id: "child-coffee"}}}}, Note: "Flat white"},
+			{Id: "i2", Venue: Venue{HasId: HasId{Id: "v4"}, HasName: HasName{Name: "Bookshop"}}},
+		},
+	}}
+	return ds
+}
+
+func TestWriteDatasetListLayers(t *testing.T) {
+	var buf bytes.Buffer
+	stats, err := WriteDataset(&buf, testListDataset(), FormatGeoJSON)
+	if err != nil {
+		t.Fatalf("WriteDataset returned error: %v", err)
+	}
+	if stats.ListItemsExported != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	var doc struct {
+		Features []struct {
+			Id         string                 `json:"id"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Features) != 4 || doc.Features[0].Properties["layer"] != visitsLayer {
+		t.Fatalf("unexpected features: %+v", doc.Features)
+	}
+	if p := doc.Features[2].Properties; p["layer"] != "To try" || p["note"] != "Flat white" || p["list_id"] != "l1" {
+		t.Fatalf("unexpected list feature: %+v", p)
+	}
+
+	buf.Reset()
+	if _, err := WriteDataset(&buf, testListDataset(), FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 || rows[0][9] != "list" || rows[1][9] != "" || rows[3][9] != "To try" || rows[3][10] != "Flat white" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+func TestFilterAppliesToListItems(t *testing.T) {
+	out := testListDataset().Filter(Filter{Categories: []string{"Food"}, MinVisits: 1})
+	if len(out.Venues) != 1 || len(out.Lists) != 1 || len(out.Lists[0].Items) != 1 || out.Lists[0].Items[0].Id != "i1" {
+		t.Fatalf("expected the category but not the visit filter on list items, got %+v", out.Lists)
+	}
+}
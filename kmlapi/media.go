@@ -0,0 +1,267 @@
+package kmlapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twpayne/go-kml"
+)
+
+const (
+	tipsPageLimit   = 250
+	photosPageLimit = 200
+	maxMediaPages   = 1000
+
+	// ThumbnailSize is the photo size shown in descriptions and packed
+	// into KMZ exports.
+	ThumbnailSize = "100x100"
+)
+
+type fsqVenueRef struct {
+	Id string `json:"id"`
+}
+
+// pageMedia pages a users/self endpoint with limit and offset, handing each
+// page to decode, which returns the item count and the total.
+func pageMedia(ctx context.Context, rep *progressReporter, stage string, endpoint string, token FSQToken, limit int, decode func(json.RawMessage) (int, int, error)) error {
+	rep.stageStarted(stage)
+	offset := 0
+	for page := 0; page < maxMediaPages; page++ {
+		q := commonQuery(token)
+		q.Add("limit", strconv.Itoa(limit))
+		q.Add("offset", strconv.Itoa(offset))
+
+		var fsq struct {
+			Response json.RawMessage `json:"response"`
+		}
+		took, err := fetchPage(ctx, rep, stage, endpoint+q.Encode(), &fsq)
+		if err != nil {
+			return err
+		}
+		n, total, err := decode(fsq.Response)
+		if err != nil {
+			return err
+		}
+		offset += n
+		rep.pageFetched(stage, offset, total, took)
+		if n == 0 || offset >= total {
+			break
+		}
+	}
+	rep.stageFinished(stage, offset, offset)
+	return nil
+}
+
+// fetchTips returns the user's tips by venue id.
+func fetchTips(ctx context.Context, token FSQToken, rep *progressReporter) (map[string][]Tip, error) {
+	tips := make(map[string][]Tip)
+	err := pageMedia(ctx, rep, "tips", fsqTips, token, tipsPageLimit, func(raw json.RawMessage) (int, int, error) {
+		var r struct {
+			Tips struct {
+				Count int `json:"count"`
+				Items []struct {
+					Id        string       `json:"id"`
+					CreatedAt int64        `json:"createdAt"`
+					Text      string       `json:"text"`
+					Venue     *fsqVenueRef `json:"venue"`
+				} `json:"items"`
+			} `json:"tips"`
+		}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return 0, 0, err
+		}
+		for _, it := range r.Tips.Items {
+			if it.Venue == nil || it.Text == "" {
+				continue
+			}
+			tips[it.Venue.Id] = append(tips[it.Venue.Id], Tip{Id: it.Id, Text: it.Text, CreatedAt: it.CreatedAt})
+		}
+		return len(r.Tips.Items), r.Tips.Count, nil
+	})
+	return tips, err
+}
+
+// fetchPhotos returns the photos the user added to checkins by venue id.
+func fetchPhotos(ctx context.Context, token FSQToken, rep *progressReporter) (map[string][]Photo, error) {
+	photos := make(map[string][]Photo)
+	err := pageMedia(ctx, rep, "photos", fsqPhotos, token, photosPageLimit, func(raw json.RawMessage) (int, int, error) {
+		var r struct {
+			Photos struct {
+				Count int `json:"count"`
+				Items []struct {
+					Id        string       `json:"id"`
+					CreatedAt int64        `json:"createdAt"`
+					Prefix    string       `json:"prefix"`
+					Suffix    string       `json:"suffix"`
+					Venue     *fsqVenueRef `json:"venue"`
+				} `json:"items"`
+			} `json:"photos"`
+		}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return 0, 0, err
+		}
+		for _, it := range r.Photos.Items {
+			if it.Venue == nil || it.Prefix == "" {
+				continue
+			}
+			photos[it.Venue.Id] = append(photos[it.Venue.Id], Photo{Id: it.Id, Prefix: it.Prefix, Suffix: it.Suffix, CreatedAt: it.CreatedAt})
+		}
+		return len(r.Photos.Items), r.Photos.Count, nil
+	})
+	return photos, err
+}
+
+type venueMedia struct {
+	tips   map[string][]Tip
+	photos map[string][]Photo
+}
+
+func fetchMedia(ctx context.Context, token FSQToken, opts ExportOptions, rep *progressReporter) (venueMedia, error) {
+	var (
+		media venueMedia
+		err   error
+	)
+	if opts.Tips {
+		if media.tips, err = fetchTips(ctx, token, rep); err != nil {
+			return media, err
+		}
+	}
+	if opts.Photos {
+		if media.photos, err = fetchPhotos(ctx, token, rep); err != nil {
+			return media, err
+		}
+	}
+	return media, nil
+}
+
+// attach links the tips and photos of v, newest first, and reports how many
+// it attached.
+func (m venueMedia) attach(v *Venue) (tips int, photos int) {
+	v.Tips = append([]Tip(nil), m.tips[v.Id]...)
+	sort.SliceStable(v.Tips, func(i, j int) bool { return v.Tips[i].CreatedAt > v.Tips[j].CreatedAt })
+	v.Photos = append([]Photo(nil), m.photos[v.Id]...)
+	sort.SliceStable(v.Photos, func(i, j int) bool { return v.Photos[i].CreatedAt > v.Photos[j].CreatedAt })
+	return len(v.Tips), len(v.Photos)
+}
+
+// photoSource maps a photo to the image shown in a description: the
+// thumbnail URL, or a file packed into a KMZ.
+type photoSource func(Photo) string
+
+func remotePhoto(p Photo) string {
+	return p.URL(ThumbnailSize)
+}
+
+// buildVenueDescription is the visit description followed by the user's
+// tips. With photos it turns into HTML showing the thumbnails, each linking
+// to the original.
+func buildVenueDescription(v Venue, msg Catalog, note string, src photoSource) string {
+	text := buildVisitDescription(v.VisitTimestamps, msg)
+	if note != "" {
+		text = note + "\n\n" + text
+	}
+	if len(v.Tips) > 0 {
+		lines := []string{text, "", msg.Tips + ":"}
+		for _, t := range v.Tips {
+			lines = append(lines, "- "+t.Text)
+		}
+		text = strings.Join(lines, "\n")
+	}
+	if len(v.Photos) == 0 {
+		return text
+	}
+	if src == nil {
+		src = remotePhoto
+	}
+	var b strings.Builder
+	b.WriteString(strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>\n"))
+	b.WriteString("<br/>\n")
+	for _, p := range v.Photos {
+		fmt.Fprintf(&b, `<a href="%s"><img src="%s"/></a>`, html.EscapeString(p.URL("original")), html.EscapeString(src(p)))
+	}
+	return b.String()
+}
+
+func photoURLs(photos []Photo) []string {
+	urls := make([]string, len(photos))
+	for i, p := range photos {
+		urls[i] = p.URL("original")
+	}
+	return urls
+}
+
+func tipTexts(tips []Tip) []string {
+	texts := make([]string, len(tips))
+	for i, t := range tips {
+		texts[i] = t.Text
+	}
+	return texts
+}
+
+func hasMedia(ds *Dataset) bool {
+	for _, v := range ds.Venues {
+		if len(v.Tips) > 0 || len(v.Photos) > 0 {
+			return true
+		}
+	}
+	for _, l := range ds.Lists {
+		for _, it := range l.Items {
+			if len(it.Venue.Tips) > 0 || len(it.Venue.Photos) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mediaSchema() *kml.SharedElement {
+	return kml.Schema(
+		"media-metadata",
+		"MediaMetadata",
+		kml.SimpleField("tips", "string"),
+		kml.SimpleField("photo_urls", "string"),
+	)
+}
+
+// mediaSchemaData holds the tips and original photo URLs of v as JSON
+// arrays, or nil when it has none.
+func mediaSchemaData(v Venue) kml.Element {
+	if len(v.Tips) == 0 && len(v.Photos) == 0 {
+		return nil
+	}
+	tips, _ := json.Marshal(tipTexts(v.Tips))
+	urls, _ := json.Marshal(photoURLs(v.Photos))
+	return kml.SchemaData(
+		"#media-metadata",
+		kml.SimpleData("tips", string(tips)),
+		kml.SimpleData("photo_urls", string(urls)),
+	)
+}
+
+// fetchThumbnail downloads the thumbnail of p. Photo URLs are public, so
+// no token is sent.
+func fetchThumbnail(ctx context.Context, p Photo) ([]byte, time.Duration, error) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL(ThumbnailSize), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	return content, time.Since(start), err
+}
@@ -0,0 +1,174 @@
+package kmlapi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func TestFetchDatasetAttachesTipsAndPhotos(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+
+	ds, stats, err := FetchDatasetWithOptions(context.Background(), NewToken(fsqfake.DefaultToken), ExportOptions{Tips: true, Photos: true}, nil)
+	if err != nil {
+		t.Fatalf("FetchDatasetWithOptions returned error: %v", err)
+	}
+	if stats.TipsAttached != len(data.Tips) || stats.PhotosAttached != len(data.Photos) {
+		t.Fatalf("expected %d tips and %d photos attached, got %+v", len(data.Tips), len(data.Photos), stats)
+	}
+	byId := make(map[string]Venue)
+	for _, v := range ds.Venues {
+		byId[v.Id] = v
+	}
+	tip := data.Tips[0]
+	v := byId[tip.VenueId]
+	if len(v.Tips) == 0 || v.Tips[0].Text != tip.Text {
+		t.Fatalf("expected the newest tip on %s, got %+v", tip.VenueId, v.Tips)
+	}
+	for i := 1; i < len(v.Photos); i++ {
+		if v.Photos[i-1].CreatedAt < v.Photos[i].CreatedAt {
+			t.Fatal("expected photos newest first")
+		}
+	}
+}
+
+func TestFetchDatasetCountsMediaOfListItems(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+
+	ds, stats, err := FetchDatasetWithOptions(context.Background(), NewToken(fsqfake.DefaultToken), ExportOptions{Lists: ListsInclude, Tips: true, Photos: true}, nil)
+	if err != nil {
+		t.Fatalf("FetchDatasetWithOptions returned error: %v", err)
+	}
+	tips, photos := 0, 0
+	for _, l := range ds.Lists {
+		for _, it := range l.Items {
+			tips += len(it.Venue.Tips)
+			photos += len(it.Venue.Photos)
+		}
+	}
+	if tips == 0 {
+		t.Fatal("expected tips on list items")
+	}
+	if stats.TipsAttached != len(data.Tips)+tips || stats.PhotosAttached != len(data.Photos)+photos {
+		t.Fatalf("expected %d tips and %d photos attached, got %+v", len(data.Tips)+tips, len(data.Photos)+photos, stats)
+	}
+}
+
+func TestMediaIsNotFetchedByDefault(t *testing.T) {
+	fake := fsqfake.NewServer(fsqfake.Generate(fsqfake.DefaultGenerateOptions()))
+	withMockFSQServer(t, fake.ServeHTTP)
+
+	ds, stats, err := FetchDatasetWithOptions(context.Background(), NewToken(fsqfake.DefaultToken), ExportOptions{}, nil)
+	if err != nil {
+		t.Fatalf("FetchDatasetWithOptions returned error: %v", err)
+	}
+	if stats.TipsAttached != 0 || stats.PhotosAttached != 0 || hasMedia(ds) {
+		t.Fatalf("expected no media without the options, got %+v", stats)
+	}
+}
+
+func mediaDataset() *Dataset {
+	ds := testDataset()
+	ds.Venues[0].Tips = []Tip{{Id: "t1", Text: "Ask for <extra> foam", CreatedAt: 200}}
+	ds.Venues[0].Photos = []Photo{{Id: "p1", Prefix: "https://fastly.4sqi.net/img/general/", Suffix: "/p1.jpg", CreatedAt: 100}}
+	return ds
+}
+
+func TestVenueDescriptionShowsTipsAndPhotos(t *testing.T) {
+	msg := CatalogFor(DefaultLocale)
+	v := mediaDataset().Venues[0]
+
+	text := buildVenueDescription(Venue{Tips: v.Tips}, msg, "", nil)
+	if !strings.Contains(text, "Tips:\n- Ask for <extra> foam") {
+		t.Fatalf("expected the tips as plain text, got %q", text)
+	}
+	html := buildVenueDescription(v, msg, "", nil)
+	for _, want := range []string{
+		"Ask for &lt;extra&gt; foam",
+		`<a href="https://fastly.4sqi.net/img/general/original/p1.jpg"><img src="https://fastly.4sqi.net/img/general/100x100/p1.jpg"/></a>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %q in %q", want, html)
+		}
+	}
+}
+
+func TestExportsCarryMedia(t *testing.T) {
+	ds := mediaDataset()
+
+	var kml bytes.Buffer
+	if _, err := WriteDataset(&kml, ds, FormatKML); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<Schema id="media-metadata" name="MediaMetadata">`, `<SimpleData name="photo_urls">[&#34;https://fastly.4sqi.net/img/general/original/p1.jpg&#34;]</SimpleData>`} {
+		if !strings.Contains(kml.String(), want) {
+			t.Fatalf("expected %s in the KML", want)
+		}
+	}
+
+	var geo bytes.Buffer
+	if _, err := WriteDataset(&geo, ds, FormatGeoJSON); err != nil {
+		t.Fatal(err)
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(geo.Bytes(), &fc); err != nil {
+		t.Fatal(err)
+	}
+	props := fc.Features[0].Properties
+	if tips, ok := props["tips"].([]interface{}); !ok || len(tips) != 1 {
+		t.Fatalf("expected the tips in the GeoJSON properties, got %v", props)
+	}
+	if _, ok := fc.Features[1].Properties["photo_urls"]; ok {
+		t.Fatal("expected no photo_urls on a venue without photos")
+	}
+}
+
+func TestKMZPacksThumbnails(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+
+	var buf bytes.Buffer
+	stats, err := Export(context.Background(), NewToken(fsqfake.DefaultToken), ExportOptions{Format: FormatKMZ, Photos: true}, &buf, nil)
+	if err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+	if stats.ThumbnailsPacked != len(data.Photos) {
+		t.Fatalf("expected %d thumbnails, got %+v", len(data.Photos), stats)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("expected a zip archive: %v", err)
+	}
+	if len(zr.File) != len(data.Photos)+1 || zr.File[0].Name != "doc.kml" {
+		t.Fatalf("expected doc.kml followed by the thumbnails, got %d entries starting with %s", len(zr.File), zr.File[0].Name)
+	}
+	doc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(doc)
+	doc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `img src=&#34;files/` + data.Photos[0].Id + `.jpg&#34;`
+	if !strings.Contains(string(content), want) {
+		t.Fatalf("expected the description to reference the packed thumbnail %s", want)
+	}
+	if zr.File[1].Method != zip.Store || !strings.HasPrefix(zr.File[1].Name, "files/") {
+		t.Fatalf("unexpected thumbnail entry %s", zr.File[1].Name)
+	}
+}
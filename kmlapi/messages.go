@@ -0,0 +1,122 @@
+package kmlapi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultLocale is what Foursquare answers with when no locale is sent.
+const DefaultLocale = "en"
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// ParseLocale normalizes a language tag such as pt_BR or DE to the form
+// sent to Foursquare, pt-br or de.
+func ParseLocale(s string) (string, error) {
+	locale := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), "_", "-"))
+	if !localePattern.MatchString(locale) {
+		return "", fmt.Errorf("expected a language tag such as en, de or pt-BR")
+	}
+	return locale, nil
+}
+
+var defaultLocale = DefaultLocale
+
+// SetLocale selects the locale of exports that do not ask for one. It is
+// meant to be called once at startup.
+func SetLocale(locale string) {
+	defaultLocale = locale
+}
+
+func resolveLocale(locale string) string {
+	if locale == "" {
+		return defaultLocale
+	}
+	return locale
+}
+
+// Catalog holds the labels written into exports. Category names come
+// localized from Foursquare itself.
+type Catalog struct {
+	VisitCount   string
+	LastVisit    string
+	RecentVisits string
+	Tips         string
+	Unknown      string
+	Clusters     string
+}
+
+var catalogs = map[string]Catalog{
+	"en": {
+		VisitCount:   "Visit count",
+		LastVisit:    "Last visit (UTC)",
+		RecentVisits: "Recent visits (UTC)",
+		Tips:         "Tips",
+		Unknown:      unknownCategoryFolder,
+		Clusters:     "Clusters",
+	},
+	"de": {
+		VisitCount:   "Anzahl Besuche",
+		LastVisit:    "Letzter Besuch (UTC)",
+		RecentVisits: "Letzte Besuche (UTC)",
+		Tips:         "Tipps",
+		Unknown:      "Unbekannt",
+		Clusters:     "Cluster",
+	},
+	"es": {
+		VisitCount:   "Número de visitas",
+		LastVisit:    "Última visita (UTC)",
+		RecentVisits: "Visitas recientes (UTC)",
+		Tips:         "Consejos",
+		Unknown:      "Desconocido",
+		Clusters:     "Grupos",
+	},
+	"fr": {
+		VisitCount:   "Nombre de visites",
+		LastVisit:    "Dernière visite (UTC)",
+		RecentVisits: "Visites récentes (UTC)",
+		Tips:         "Conseils",
+		Unknown:      "Inconnu",
+		Clusters:     "Groupes",
+	},
+	"it": {
+		VisitCount:   "Numero di visite",
+		LastVisit:    "Ultima visita (UTC)",
+		RecentVisits: "Visite recenti (UTC)",
+		Tips:         "Consigli",
+		Unknown:      "Sconosciuto",
+		Clusters:     "Gruppi",
+	},
+	"pt": {
+		VisitCount:   "Número de visitas",
+		LastVisit:    "Última visita (UTC)",
+		RecentVisits: "Visitas recentes (UTC)",
+		Tips:         "Dicas",
+		Unknown:      "Desconhecido",
+		Clusters:     "Agrupamentos",
+	},
+	"ru": {
+		VisitCount:   "Число посещений",
+		LastVisit:    "Последнее посещение (UTC)",
+		RecentVisits: "Недавние посещения (UTC)",
+		Tips:         "Советы",
+		Unknown:      "Неизвестно",
+		Clusters:     "Кластеры",
+	},
+}
+
+// CatalogFor returns the catalog of locale, falling back from a regional
+// variant to its language and then to English.
+func CatalogFor(locale string) Catalog {
+	locale = resolveLocale(locale)
+	if c, ok := catalogs[locale]; ok {
+		return c
+	}
+	if lang, _, ok := strings.Cut(locale, "-"); ok {
+		if c, ok := catalogs[lang]; ok {
+			return c
+		}
+	}
+	return catalogs[DefaultLocale]
+}
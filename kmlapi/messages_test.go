@@ -0,0 +1,74 @@
+package kmlapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLocale(t *testing.T) {
+	for in, want := range map[string]string{"de": "de", "DE": "de", "pt_BR": "pt-br", " zh-Hant ": "zh-hant"} {
+		got, err := ParseLocale(in)
+		if err != nil || got != want {
+			t.Fatalf("ParseLocale(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "german", "d", "de/../x"} {
+		if _, err := ParseLocale(in); err == nil {
+			t.Fatalf("expected ParseLocale(%q) to fail", in)
+		}
+	}
+}
+
+func TestCatalogForFallsBackToLanguageAndEnglish(t *testing.T) {
+	if got := CatalogFor("pt-br").VisitCount; got != catalogs["pt"].VisitCount {
+		t.Fatalf("expected the pt catalog for pt-br, got %q", got)
+	}
+	if got := CatalogFor("ja").Unknown; got != unknownCategoryFolder {
+		t.Fatalf("expected English for a locale without catalog, got %q", got)
+	}
+}
+
+func TestExportUsesLocaleForCategoriesAndLabels(t *testing.T) {
+	cache := withCategoryCache(t, time.Hour)
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/users/self/checkins" && r.URL.Query().Get("locale") != "de" {
+			http.Error(w, "expected locale=de", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/venues/categories":
+			fmt.Fprint(w, `{"response":{"categories":[{"id":"top-food","name":"Essen","categories":[]}]}}`)
+		case "/v2/users/self/venuehistory":
+			fmt.Fprint(w, `{"response":{"venues":{"count":2,"items":[
+				{"venue":{"id":"v1","name":"Cafe","location":{"lat":1,"lng":2},"categories":[{"id":"top-food","name":"Essen"}]}},
+				{"venue":{"id":"v2","name":"Ort","location":{"lat":3,"lng":4},"categories":[]}}
+			]}}}`)
+		case "/v2/users/self/checkins":
+			fmt.Fprint(w, `{"response":{"checkins":{"count":1,"items":[{"createdAt":100,"venue":{"id":"v1"}}]}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	var buf bytes.Buffer
+	if _, err := Export(context.Background(), NewToken("token"), ExportOptions{Locale: "de"}, &buf, nil); err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"<name>Essen</name>", "<name>Unbekannt</name>", "Anzahl Besuche: 1", "Letzter Besuch (UTC)"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in the export:\n%s", want, out)
+		}
+	}
+	if _, err := cache.load(BackendV2, "de"); err != nil {
+		t.Fatalf("expected the German taxonomy cached on its own: %v", err)
+	}
+	if _, err := cache.load(BackendV2, DefaultLocale); err == nil {
+		t.Fatal("expected no English cache entry")
+	}
+}
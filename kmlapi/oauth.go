@@ -0,0 +1,165 @@
+package kmlapi
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStateTTL = 10 * time.Minute
+	// DefaultMaxStates caps the states awaiting their callback, since
+	// anyone may ask for one.
+	DefaultMaxStates = 1000
+)
+
+var (
+	ErrInvalidState  = errors.New("invalid, expired or already used OAuth state")
+	ErrTooManyStates = errors.New("too many pending sign ins, try again later")
+)
+
+type pendingState struct {
+	binding string
+	expires time.Time
+}
+
+// StateStore issues single-use OAuth state values. A state is accepted once
+// within its TTL and only with the binding it was issued with, such as a
+// cookie held by the browser that started the sign in; verifying consumes
+// it, so replayed callbacks are rejected.
+type StateStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	max    int
+	states map[string]pendingState
+	now    func() time.Time
+}
+
+func NewStateStore(ttl time.Duration) *StateStore {
+	if ttl <= 0 {
+		ttl = DefaultStateTTL
+	}
+	return &StateStore{
+		ttl:    ttl,
+		max:    DefaultMaxStates,
+		states: make(map[string]pendingState),
+		now:    time.Now,
+	}
+}
+
+// SetLimit caps the pending states at max, DefaultMaxStates when not
+// positive.
+func (s *StateStore) SetLimit(max int) {
+	if max <= 0 {
+		max = DefaultMaxStates
+	}
+	s.mu.Lock()
+	s.max = max
+	s.mu.Unlock()
+}
+
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// NewStateBinding returns a random value to bind a state to.
+func NewStateBinding() (string, error) {
+	return randomString(32)
+}
+
+func (s *StateStore) prune(now time.Time) {
+	for state, pending := range s.states {
+		if now.After(pending.expires) {
+			delete(s.states, state)
+		}
+	}
+}
+
+// Generate issues a state that only verifies with binding. An empty binding
+// suits states that never leave the process that issued them.
+func (s *StateStore) Generate(binding string) (string, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.prune(now)
+	if len(s.states) >= s.max {
+		return "", ErrTooManyStates
+	}
+	s.states[state] = pendingState{binding: binding, expires: now.Add(s.ttl)}
+	return state, nil
+}
+
+func (s *StateStore) Verify(state string, binding string) error {
+	if state == "" {
+		return ErrInvalidState
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.states[state]
+	if !ok {
+		return ErrInvalidState
+	}
+	delete(s.states, state)
+	if s.now().After(pending.expires) || subtle.ConstantTimeCompare([]byte(pending.binding), []byte(binding)) != 1 {
+		return ErrInvalidState
+	}
+	return nil
+}
+
+func PreAuthenticateWithState(clientId string, redirectUri string, state string) string {
+	q := url.Values{}
+	q.Add("client_id", clientId)
+	q.Add("redirect_uri", redirectUri)
+	q.Add("state", state)
+
+	return fsqOAuth2 + q.Encode()
+}
+
+// OAuthFlow ties the authorization URL and the code exchange together so
+// that only callbacks carrying a state issued by this flow are accepted.
+type OAuthFlow struct {
+	ClientId     string
+	ClientSecret string
+	RedirectUri  string
+	States       *StateStore
+}
+
+func NewOAuthFlow(clientId string, clientSecret string, redirectUri string, stateTTL time.Duration) *OAuthFlow {
+	return &OAuthFlow{
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		RedirectUri:  redirectUri,
+		States:       NewStateStore(stateTTL),
+	}
+}
+
+// AuthURL returns the authorization URL with a state bound to binding.
+func (f *OAuthFlow) AuthURL(binding string) (string, error) {
+	state, err := f.States.Generate(binding)
+	if err != nil {
+		return "", err
+	}
+	return PreAuthenticateWithState(f.ClientId, f.RedirectUri, state), nil
+}
+
+// Exchange verifies state against binding and trades code for an access
+// token. It returns ErrInvalidState without contacting Foursquare when the
+// state is unknown or was issued with another binding.
+func (f *OAuthFlow) Exchange(state string, binding string, code string) (string, error) {
+	if err := f.States.Verify(state, binding); err != nil {
+		return "", err
+	}
+	return Authenticate(f.ClientId, f.ClientSecret, code, f.RedirectUri)
+}
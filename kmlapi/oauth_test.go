@@ -0,0 +1,127 @@
+package kmlapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStateStoreRejectsReplayedAndExpiredStates(t *testing.T) {
+	store := NewStateStore(time.Minute)
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+
+	state, err := store.Generate("browser")
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if err := store.Verify(state, "browser"); err != nil {
+		t.Fatalf("expected fresh state to verify, got %v", err)
+	}
+	if err := store.Verify(state, "browser"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected replayed state to be rejected, got %v", err)
+	}
+
+	expired, _ := store.Generate("browser")
+	now = now.Add(2 * time.Minute)
+	if err := store.Verify(expired, "browser"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected expired state to be rejected, got %v", err)
+	}
+	if err := store.Verify("forged", ""); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected unknown state to be rejected, got %v", err)
+	}
+}
+
+func TestStateStoreRequiresTheBinding(t *testing.T) {
+	store := NewStateStore(time.Minute)
+	// A state the attacker asked for does not verify in the victim's browser.
+	state, _ := store.Generate("attacker")
+	if err := store.Verify(state, "victim"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected a state of another browser to be rejected, got %v", err)
+	}
+	if err := store.Verify(state, "attacker"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected a rejected state to be consumed, got %v", err)
+	}
+	unbound, _ := store.Generate("")
+	if err := store.Verify(unbound, "browser"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected an unbound state to require no binding, got %v", err)
+	}
+}
+
+func TestStateStoreCapsPendingStates(t *testing.T) {
+	store := NewStateStore(time.Minute)
+	now := time.Unix(1000, 0)
+	store.now = func() time.Time { return now }
+	store.SetLimit(2)
+
+	first, _ := store.Generate("a")
+	if _, err := store.Generate("b"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if _, err := store.Generate("c"); !errors.Is(err, ErrTooManyStates) {
+		t.Fatalf("expected the limit to be enforced, got %v", err)
+	}
+	if err := store.Verify(first, "a"); err != nil {
+		t.Fatalf("expected a pending state to verify, got %v", err)
+	}
+	if _, err := store.Generate("c"); err != nil {
+		t.Fatalf("expected a used state to free its slot, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := store.Generate("d"); err != nil {
+			t.Fatalf("expected expired states to free their slots, got %v", err)
+		}
+	}
+}
+
+func TestOAuthFlowExchangeVerifiesState(t *testing.T) {
+	exchanges := 0
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/access_token" {
+			http.NotFound(w, r)
+			return
+		}
+		exchanges++
+		fmt.Fprint(w, `{"access_token":"secret-token"}`)
+	})
+
+	flow := NewOAuthFlow("client", "secret", "http://localhost/cb", time.Minute)
+	authUrl, err := flow.AuthURL("cookie")
+	if err != nil {
+		t.Fatalf("AuthURL returned error: %v", err)
+	}
+	parsed, err := url.Parse(authUrl)
+	if err != nil {
+		t.Fatalf("invalid auth URL: %v", err)
+	}
+	state := parsed.Query().Get("state")
+	if state == "" || parsed.Query().Get("client_id") != "client" {
+		t.Fatalf("expected state and client_id in auth URL, got %s", authUrl)
+	}
+
+	if _, err := flow.Exchange("other", "cookie", "code"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected mismatched state to be rejected, got %v", err)
+	}
+	if exchanges != 0 {
+		t.Fatal("expected no token exchange for a mismatched state")
+	}
+
+	if _, err := flow.Exchange(state, "other-cookie", "code"); !errors.Is(err, ErrInvalidState) || exchanges != 0 {
+		t.Fatalf("expected a state of another browser to be rejected, got %v", err)
+	}
+	authUrl, _ = flow.AuthURL("cookie")
+	parsed, _ = url.Parse(authUrl)
+	state = parsed.Query().Get("state")
+
+	token, err := flow.Exchange(state, "cookie", "code")
+	if err != nil || token != "secret-token" {
+		t.Fatalf("expected token exchange to succeed, got %q, %v", token, err)
+	}
+	if _, err := flow.Exchange(state, "cookie", "code"); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("expected replayed callback to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package kmlapi
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DatePattern   = "2006-01-02"
+	DefaultWindow = 10 * Year
+)
+
+var relativeWindow = regexp.MustCompile(`^(\d+)([hdwmy])$`)
+
+// ParamError reports an invalid export parameter. Its message is meant to
+// be shown to the user as is, e.g. in a 400 response.
+type ParamError struct {
+	Param  string
+	Value  string
+	Reason string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Param, e.Value, e.Reason)
+}
+
+// ParseTime accepts a date (2006-01-02), an RFC 3339 timestamp or unix
+// seconds. Dates are interpreted as midnight UTC.
+func ParseTime(s string) (time.Time, error) {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(v, 0), nil
+	}
+	if v, err := time.Parse(DatePattern, s); err == nil {
+		return v, nil
+	}
+	if v, err := time.Parse(time.RFC3339, s); err == nil {
+		return v, nil
+	}
+	return time.Time{}, fmt.Errorf("expected %s, RFC 3339 or unix seconds", DatePattern)
+}
+
+// ParseWindow parses relative windows such as 12h, 90d, 6w, 3m or 2y.
+// Months are 30 days and years are 365 days.
+func ParseWindow(s string) (time.Duration, error) {
+	m := relativeWindow.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, fmt.Errorf("expected a number followed by h, d, w, m or y")
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("window must be positive")
+	}
+	day := 24 * time.Hour
+	unit := map[string]time.Duration{"h": time.Hour, "d": day, "w": 7 * day, "m": 30 * day, "y": Year}[m[2]]
+	return time.Duration(n) * unit, nil
+}
+
+// ExportParams are the raw, user supplied export parameters shared by the
+// REST query string and the command line flags.
+type ExportParams struct {
+	From          string
+	To            string
+	Last          string
+	Format        string
+	Categories    string
+	MinVisits     string
+	Name          string
+	Locale        string
+	Lists         string
+	Tips          string
+	Photos        string
+	Countries     string
+	Cities        string
+	GroupBy       string
+	Split         string
+	MaxPlacemarks string
+	Superoverlay  string
+	Density       string
+	CellSize      string
+	DensityBy     string
+	Cluster       string
+	ClusterRadius string
+	ClusterZooms  string
+}
+
+func ExportParamsFromQuery(q url.Values) ExportParams {
+	return ExportParams{
+		From:          q.Get("from"),
+		To:            q.Get("to"),
+		Last:          q.Get("last"),
+		Format:        q.Get("format"),
+		Categories:    strings.Join(q["category"], ","),
+		MinVisits:     q.Get("min_visits"),
+		Name:          q.Get("q"),
+		Locale:        q.Get("locale"),
+		Lists:         q.Get("lists"),
+		Tips:          q.Get("tips"),
+		Photos:        q.Get("photos"),
+		Countries:     strings.Join(q["country"], ","),
+		Cities:        strings.Join(q["city"], ","),
+		GroupBy:       q.Get("group_by"),
+		Split:         q.Get("split"),
+		MaxPlacemarks: q.Get("max_placemarks"),
+		Superoverlay:  q.Get("superoverlay"),
+		Density:       q.Get("density"),
+		CellSize:      q.Get("cell_size"),
+		DensityBy:     q.Get("density_by"),
+		Cluster:       q.Get("cluster"),
+		ClusterRadius: q.Get("cluster_radius"),
+		ClusterZooms:  strings.Join(q["cluster_zooms"], ","),
+	}
+}
+
+// Range resolves the time window. Without from or last it covers
+// DefaultWindow before the end, which itself defaults to now.
+func (p ExportParams) Range(now time.Time) (after time.Time, before time.Time, err error) {
+	before = now
+	if p.To != "" {
+		if before, err = ParseTime(p.To); err != nil {
+			return after, before, &ParamError{Param: "to", Value: p.To, Reason: err.Error()}
+		}
+	}
+
+	switch {
+	case p.From != "" && p.Last != "":
+		return after, before, &ParamError{Param: "last", Value: p.Last, Reason: "can not be combined with from"}
+	case p.From != "":
+		if after, err = ParseTime(p.From); err != nil {
+			return after, before, &ParamError{Param: "from", Value: p.From, Reason: err.Error()}
+		}
+	case p.Last != "":
+		window, err := ParseWindow(p.Last)
+		if err != nil {
+			return after, before, &ParamError{Param: "last", Value: p.Last, Reason: err.Error()}
+		}
+		after = before.Add(-window)
+	default:
+		after = before.Add(-DefaultWindow)
+	}
+
+	if !after.Before(before) {
+		return after, before, &ParamError{Param: "from", Value: p.From, Reason: "must be before to"}
+	}
+	return after, before, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func (p ExportParams) Options(now time.Time) (ExportOptions, error) {
+	after, before, err := p.Range(now)
+	if err != nil {
+		return ExportOptions{}, err
+	}
+	opts := ExportOptions{Before: &before, After: &after}
+
+	if opts.Format, err = ParseFormat(p.Format); err != nil {
+		return ExportOptions{}, &ParamError{Param: "format", Value: p.Format, Reason: err.Error()}
+	}
+	if opts.Grouping, err = ParseGrouping(p.GroupBy); err != nil {
+		return ExportOptions{}, &ParamError{Param: "group_by", Value: p.GroupBy, Reason: err.Error()}
+	}
+
+	opts.Filter.Categories = splitList(p.Categories)
+	opts.Filter.Name = strings.TrimSpace(p.Name)
+	opts.Filter.Countries = splitList(p.Countries)
+	opts.Filter.Cities = splitList(p.Cities)
+	if p.MinVisits != "" {
+		n, err := strconv.Atoi(p.MinVisits)
+		if err != nil || n < 0 {
+			return ExportOptions{}, &ParamError{Param: "min_visits", Value: p.MinVisits, Reason: "expected a non-negative integer"}
+		}
+		opts.Filter.MinVisits = n
+	}
+	if p.Locale != "" {
+		if opts.Locale, err = ParseLocale(p.Locale); err != nil {
+			return ExportOptions{}, &ParamError{Param: "locale", Value: p.Locale, Reason: err.Error()}
+		}
+	}
+	if opts.Lists, err = ParseListsMode(p.Lists); err != nil {
+		return ExportOptions{}, &ParamError{Param: "lists", Value: p.Lists, Reason: err.Error()}
+	}
+	for _, flag := range []struct {
+		name  string
+		value string
+		dst   *bool
+	}{{"tips", p.Tips, &opts.Tips}, {"photos", p.Photos, &opts.Photos}, {"split", p.Split, &opts.Split}, {"superoverlay", p.Superoverlay, &opts.Superoverlay}} {
+		if flag.value == "" {
+			continue
+		}
+		if *flag.dst, err = strconv.ParseBool(flag.value); err != nil {
+			return ExportOptions{}, &ParamError{Param: flag.name, Value: flag.value, Reason: "expected true or false"}
+		}
+	}
+	if p.MaxPlacemarks != "" {
+		n, err := strconv.Atoi(p.MaxPlacemarks)
+		if err != nil || n < 0 {
+			return ExportOptions{}, &ParamError{Param: "max_placemarks", Value: p.MaxPlacemarks, Reason: "expected a non-negative integer"}
+		}
+		opts.MaxPlacemarks = n
+		opts.Split = opts.Split || n > 0
+	}
+	opts.Split = opts.Split || opts.Superoverlay
+	if opts.split() && opts.OutputFormat() != FormatKMZ {
+		return ExportOptions{}, &ParamError{Param: "format", Value: p.Format, Reason: "split exports are KML or KMZ"}
+	}
+	if opts.Density, err = ParseDensityShape(p.Density); err != nil {
+		return ExportOptions{}, &ParamError{Param: "density", Value: p.Density, Reason: err.Error()}
+	}
+	if p.CellSize != "" {
+		size, err := strconv.ParseFloat(p.CellSize, 64)
+		if err != nil || size <= 0 || size > 90 {
+			return ExportOptions{}, &ParamError{Param: "cell_size", Value: p.CellSize, Reason: "expected a positive number of degrees up to 90"}
+		}
+		opts.CellSize = size
+	}
+	if opts.DensityBy, err = ParseDensityLayers(p.DensityBy); err != nil {
+		return ExportOptions{}, &ParamError{Param: "density_by", Value: p.DensityBy, Reason: err.Error()}
+	}
+	if opts.Density != DensityOff {
+		switch {
+		case opts.split():
+			return ExportOptions{}, &ParamError{Param: "density", Value: p.Density, Reason: "can not be combined with split or superoverlay"}
+		case opts.Format == FormatCSV:
+			return ExportOptions{}, &ParamError{Param: "format", Value: p.Format, Reason: "density exports are KML, KMZ or GeoJSON"}
+		}
+	}
+	if opts.Cluster, err = ParseClusterMethod(p.Cluster); err != nil {
+		return ExportOptions{}, &ParamError{Param: "cluster", Value: p.Cluster, Reason: err.Error()}
+	}
+	if p.ClusterRadius != "" {
+		radius, err := strconv.ParseFloat(p.ClusterRadius, 64)
+		if err != nil || radius <= 0 {
+			return ExportOptions{}, &ParamError{Param: "cluster_radius", Value: p.ClusterRadius, Reason: "expected a positive number of meters"}
+		}
+		opts.ClusterRadius = radius
+	}
+	if opts.ClusterZooms, err = ParseClusterZooms(p.ClusterZooms); err != nil {
+		return ExportOptions{}, &ParamError{Param: "cluster_zooms", Value: p.ClusterZooms, Reason: err.Error()}
+	}
+	if opts.Cluster != ClusterOff {
+		switch {
+		case opts.split() || opts.Density != DensityOff:
+			return ExportOptions{}, &ParamError{Param: "cluster", Value: p.Cluster, Reason: "can not be combined with split, superoverlay or density"}
+		case opts.Format == FormatCSV:
+			return ExportOptions{}, &ParamError{Param: "format", Value: p.Format, Reason: "clustered exports are KML, KMZ or GeoJSON"}
+		}
+	}
+	return opts, nil
+}
+
+func ParseExportOptions(q url.Values, now time.Time) (ExportOptions, error) {
+	return ExportParamsFromQuery(q).Options(now)
+}
@@ -0,0 +1,114 @@
+package kmlapi
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTimeAcceptsDatesRFC3339AndUnix(t *testing.T) {
+	cases := map[string]time.Time{
+		"2020-03-01":           time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2020-03-01T10:00:00Z": time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC),
+		"1583056800":           time.Unix(1583056800, 0),
+	}
+	for in, want := range cases {
+		got, err := ParseTime(in)
+		if err != nil {
+			t.Fatalf("ParseTime(%q) returned error: %v", in, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("ParseTime(%q) = %s, want %s", in, got, want)
+		}
+	}
+	if _, err := ParseTime("03/01/2020"); err == nil {
+		t.Fatal("expected error for unsupported date layout")
+	}
+}
+
+func TestExportParamsRange(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	after, before, err := ExportParams{Last: "90d"}.Range(now)
+	if err != nil {
+		t.Fatalf("Range returned error: %v", err)
+	}
+	if !before.Equal(now) || !after.Equal(now.Add(-90*24*time.Hour)) {
+		t.Fatalf("unexpected window %s - %s", after, before)
+	}
+
+	after, _, err = ExportParams{}.Range(now)
+	if err != nil || !after.Equal(now.Add(-DefaultWindow)) {
+		t.Fatalf("expected default window, got %s (%v)", after, err)
+	}
+
+	for _, p := range []ExportParams{
+		{From: "2024-01-01", Last: "2y"},
+		{From: "2024-07-01"},
+		{Last: "90 days"},
+		{To: "tomorrow"},
+	} {
+		_, _, err := p.Range(now)
+		var paramErr *ParamError
+		if !errors.As(err, &paramErr) {
+			t.Fatalf("expected ParamError for %+v, got %v", p, err)
+		}
+	}
+}
+
+func TestParseExportOptionsFromQuery(t *testing.T) {
+	q := url.Values{
+		"from":       {"2020-01-01"},
+		"to":         {"1609459200"},
+		"format":     {"GeoJSON"},
+		"category":   {"Food", "Nightlife Spot,Travel"},
+		"min_visits": {"2"},
+		"q":          {"cafe"},
+		"locale":     {"de_AT"},
+		"lists":      {"include"},
+		"tips":       {"true"},
+		"photos":     {"1"},
+		"country":    {"PT,de"},
+		"city":       {"Lisbon"},
+	}
+	opts, err := ParseExportOptions(q, time.Now())
+	if err != nil {
+		t.Fatalf("ParseExportOptions returned error: %v", err)
+	}
+	if opts.Format != FormatGeoJSON {
+		t.Fatalf("expected geojson format, got %q", opts.Format)
+	}
+	if len(opts.Filter.Categories) != 3 || opts.Filter.Categories[2] != "Travel" {
+		t.Fatalf("unexpected categories: %#v", opts.Filter.Categories)
+	}
+	if opts.Filter.MinVisits != 2 || opts.Filter.Name != "cafe" {
+		t.Fatalf("unexpected filter: %+v", opts.Filter)
+	}
+	if opts.Locale != "de-at" || opts.Lists != ListsInclude {
+		t.Fatalf("unexpected locale %q or lists %q", opts.Locale, opts.Lists)
+	}
+	if len(opts.Filter.Countries) != 2 || opts.Filter.Countries[1] != "de" || len(opts.Filter.Cities) != 1 {
+		t.Fatalf("unexpected location filter: %+v", opts.Filter)
+	}
+	if !opts.Tips || !opts.Photos {
+		t.Fatalf("expected tips and photos, got %+v", opts)
+	}
+	if opts.Before.Unix() != 1609459200 {
+		t.Fatalf("unexpected end: %s", opts.Before)
+	}
+
+	_, err = ParseExportOptions(url.Values{"format": {"shp"}}, time.Now())
+	var paramErr *ParamError
+	if !errors.As(err, &paramErr) || paramErr.Param != "format" {
+		t.Fatalf("expected format ParamError, got %v", err)
+	}
+	_, err = ParseExportOptions(url.Values{"locale": {"klingon"}}, time.Now())
+	if !errors.As(err, &paramErr) || paramErr.Param != "locale" {
+		t.Fatalf("expected locale ParamError, got %v", err)
+	}
+	_, err = ParseExportOptions(url.Values{"photos": {"maybe"}}, time.Now())
+	if !errors.As(err, &paramErr) || paramErr.Param != "photos" {
+		t.Fatalf("expected photos ParamError, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package kmlapi
+
+import (
+	"fmt"
+	"time"
+)
+
+type ProgressEventKind int
+
+const (
+	StageStarted ProgressEventKind = iota
+	StageFinished
+	PageFetched
+	RetryScheduled
+	Warning
+	StatsSnapshot
+)
+
+const statsStage = "stats"
+
+func (k ProgressEventKind) String() string {
+	switch k {
+	case StageStarted:
+		return "stage-started"
+	case StageFinished:
+		return "stage-finished"
+	case PageFetched:
+		return "page-fetched"
+	case RetryScheduled:
+		return "retry-scheduled"
+	case Warning:
+		return "warning"
+	case StatsSnapshot:
+		return "stats"
+	default:
+		return fmt.Sprintf("ProgressEventKind(%d)", int(k))
+	}
+}
+
+// ProgressEvent describes a single step of an export. Only the fields
+// relevant to Kind are populated: Page and Duration for PageFetched,
+// Attempt, Delay and Err for RetryScheduled, Message for Warning and
+// Stats for StatsSnapshot.
+type ProgressEvent struct {
+	Kind     ProgressEventKind
+	Stage    string
+	Time     time.Time
+	Page     int
+	Fetched  int
+	Total    int
+	Duration time.Duration
+	Elapsed  time.Duration
+	Attempt  int
+	Delay    time.Duration
+	Err      error
+	Message  string
+	Stats    *ExportStats
+}
+
+// Percent returns the completion of the stage in the [0, 100] range, or -1
+// when the total is unknown.
+func (e ProgressEvent) Percent() float64 {
+	if e.Total <= 0 {
+		return -1
+	}
+	if e.Fetched >= e.Total {
+		return 100
+	}
+	return float64(e.Fetched) * 100 / float64(e.Total)
+}
+
+// ETA estimates the remaining time of the stage from the elapsed time and
+// the fetch rate so far. It returns 0 when there is nothing to estimate.
+func (e ProgressEvent) ETA() time.Duration {
+	if e.Fetched <= 0 || e.Total <= e.Fetched || e.Elapsed <= 0 {
+		return 0
+	}
+	perItem := float64(e.Elapsed) / float64(e.Fetched)
+	return time.Duration(perItem * float64(e.Total-e.Fetched))
+}
+
+type ProgressListener interface {
+	OnProgress(ProgressEvent)
+}
+
+type ProgressListenerFunc func(ProgressEvent)
+
+func (f ProgressListenerFunc) OnProgress(e ProgressEvent) {
+	f(e)
+}
+
+// legacyStages are the stages a ProgressCallback was called for before the
+// event stream; callers may not expect any other.
+var legacyStages = map[string]bool{"venues": true, "checkins": true}
+
+// CallbackListener adapts a legacy ProgressCallback to the event stream.
+// The callback sees one (stage, fetched, total) call per fetched page and a
+// final normalized call when each stage finishes, for the venues and
+// checkins stages only.
+func CallbackListener(progress ProgressCallback) ProgressListener {
+	if progress == nil {
+		return nil
+	}
+	return ProgressListenerFunc(func(e ProgressEvent) {
+		if !legacyStages[e.Stage] {
+			return
+		}
+		switch e.Kind {
+		case PageFetched, StageFinished:
+			progress(e.Stage, e.Fetched, e.Total)
+		}
+	})
+}
+
+// ChannelListener delivers every event to ch. Sends block, so the consumer
+// must keep draining the channel until the export returns.
+func ChannelListener(ch chan<- ProgressEvent) ProgressListener {
+	return ProgressListenerFunc(func(e ProgressEvent) {
+		ch <- e
+	})
+}
+
+// MultiListener fans events out to every non-nil listener in order.
+func MultiListener(listeners ...ProgressListener) ProgressListener {
+	active := make([]ProgressListener, 0, len(listeners))
+	for _, l := range listeners {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	return ProgressListenerFunc(func(e ProgressEvent) {
+		for _, l := range active {
+			l.OnProgress(e)
+		}
+	})
+}
+
+type progressReporter struct {
+	listener ProgressListener
+	started  map[string]time.Time
+	pages    map[string]int
+}
+
+func newProgressReporter(listener ProgressListener) *progressReporter {
+	return &progressReporter{
+		listener: listener,
+		started:  make(map[string]time.Time),
+		pages:    make(map[string]int),
+	}
+}
+
+func (r *progressReporter) emit(e ProgressEvent) {
+	if r == nil || r.listener == nil {
+		return
+	}
+	e.Time = time.Now()
+	if start, ok := r.started[e.Stage]; ok {
+		e.Elapsed = e.Time.Sub(start)
+	}
+	r.listener.OnProgress(e)
+}
+
+func (r *progressReporter) stageStarted(stage string) {
+	if r == nil {
+		return
+	}
+	r.started[stage] = time.Now()
+	r.pages[stage] = 0
+	r.emit(ProgressEvent{Kind: StageStarted, Stage: stage})
+}
+
+func (r *progressReporter) pageFetched(stage string, fetched int, total int, took time.Duration) {
+	if r == nil {
+		return
+	}
+	r.pages[stage]++
+	r.emit(ProgressEvent{Kind: PageFetched, Stage: stage, Page: r.pages[stage], Fetched: fetched, Total: total, Duration: took})
+}
+
+func (r *progressReporter) stageFinished(stage string, fetched int, total int) {
+	if r == nil {
+		return
+	}
+	r.emit(ProgressEvent{Kind: StageFinished, Stage: stage, Page: r.pages[stage], Fetched: fetched, Total: total})
+}
+
+func (r *progressReporter) retryScheduled(stage string, attempt int, delay time.Duration, err error) {
+	r.emit(ProgressEvent{Kind: RetryScheduled, Stage: stage, Attempt: attempt, Delay: delay, Err: err})
+}
+
+func (r *progressReporter) warning(stage string, format string, args ...interface{}) {
+	r.emit(ProgressEvent{Kind: Warning, Stage: stage, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *progressReporter) statsSnapshot(stats ExportStats) {
+	r.emit(ProgressEvent{Kind: StatsSnapshot, Stage: statsStage, Stats: &stats})
+}
@@ -0,0 +1,149 @@
+package kmlapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBuildKMLWithListenerEmitsStructuredEvents(t *testing.T) {
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v2/venues/categories":
+			fmt.Fprint(w, `{"response":{"categories":[{"id":"top-food","name":"Food","categories":[]}]}}`)
+		case "/v2/users/self/venuehistory":
+			fmt.Fprint(w, `{"response":{"venues":{"count":1,"items":[
+				{"venue":{"id":"v1","name":"Cafe","location":{"lat":1,"lng":2},"categories":[{"id":"top-food"}]}}
+			]}}}`)
+		case "/v2/users/self/checkins":
+			fmt.Fprint(w, `{"response":{"checkins":{"count":2,"items":[
+				{"createdAt":100,"venue":{"id":"v1"}},
+				{"createdAt":0,"venue":{"id":"v1"}}
+			]}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	var events []ProgressEvent
+	_, stats, err := BuildKMLWithListener(NewToken("token"), nil, nil, ProgressListenerFunc(func(e ProgressEvent) {
+		events = append(events, e)
+	}))
+	if err != nil {
+		t.Fatalf("BuildKMLWithListener returned error: %v", err)
+	}
+
+	counts := make(map[ProgressEventKind]int)
+	var warnings []string
+	var lastStats *ExportStats
+	for _, e := range events {
+		counts[e.Kind]++
+		if e.Time.IsZero() {
+			t.Fatalf("expected event time to be set: %+v", e)
+		}
+		switch e.Kind {
+		case PageFetched:
+			if e.Page < 1 {
+				t.Fatalf("expected page number on page event, got %+v", e)
+			}
+		case Warning:
+			warnings = append(warnings, e.Message)
+		case StatsSnapshot:
+			lastStats = e.Stats
+		}
+	}
+
+	if counts[StageStarted] != 4 || counts[StageFinished] != 4 {
+		t.Fatalf("expected venues, checkins, categories and kml stages, got %v", counts)
+	}
+	if counts[PageFetched] != 2 {
+		t.Fatalf("expected one page per fetch stage, got %d", counts[PageFetched])
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning for the checkin without timestamp, got %v", warnings)
+	}
+	if lastStats == nil || *lastStats != stats {
+		t.Fatalf("expected final stats snapshot to match returned stats, got %+v vs %+v", lastStats, stats)
+	}
+}
+
+func TestCallbackListenerForwardsPagesAndCompletion(t *testing.T) {
+	type call struct {
+		stage          string
+		fetched, total int
+	}
+	var calls []call
+	listener := CallbackListener(func(stage string, fetched int, total int) {
+		calls = append(calls, call{stage, fetched, total})
+	})
+
+	rep := newProgressReporter(listener)
+	rep.stageStarted("venues")
+	rep.pageFetched("venues", 10, 20, time.Millisecond)
+	rep.warning("venues", "ignored")
+	rep.stageFinished("venues", 18, 18)
+	for _, stage := range []string{"categories", "details", "lists", "kml"} {
+		rep.stageStarted(stage)
+		rep.pageFetched(stage, 1, 2, time.Millisecond)
+		rep.stageFinished(stage, 2, 2)
+	}
+
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 callback calls, got %#v", calls)
+	}
+	if calls[0] != (call{"venues", 10, 20}) || calls[1] != (call{"venues", 18, 18}) {
+		t.Fatalf("unexpected callback calls: %#v", calls)
+	}
+	if CallbackListener(nil) != nil {
+		t.Fatal("expected nil callback to produce nil listener")
+	}
+}
+
+func TestFetchCheckinsRetriesRateLimitedPages(t *testing.T) {
+	original := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = original })
+
+	requests := 0
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"response":{"checkins":{"count":1,"items":[{"createdAt":100,"venue":{"id":"v1"}}]}}}`)
+	})
+
+	var retries []ProgressEvent
+	rep := newProgressReporter(ProgressListenerFunc(func(e ProgressEvent) {
+		if e.Kind == RetryScheduled {
+			retries = append(retries, e)
+		}
+	}))
+	byVenue, _, err := fetchCheckins(context.Background(), NewToken("token"), nil, nil, rep)
+	if err != nil {
+		t.Fatalf("fetchCheckins returned error: %v", err)
+	}
+	if len(byVenue["v1"]) != 1 {
+		t.Fatalf("expected checkin after retry, got %#v", byVenue)
+	}
+	if len(retries) != 1 || retries[0].Attempt != 1 || retries[0].Stage != "checkins" {
+		t.Fatalf("expected one retry event, got %+v", retries)
+	}
+}
+
+func TestProgressEventETA(t *testing.T) {
+	e := ProgressEvent{Fetched: 25, Total: 100, Elapsed: 10 * time.Second}
+	if e.ETA() != 30*time.Second {
+		t.Fatalf("expected 30s ETA, got %s", e.ETA())
+	}
+	if e.Percent() != 25 {
+		t.Fatalf("expected 25%%, got %.1f", e.Percent())
+	}
+	if (ProgressEvent{Fetched: 5}).Percent() != -1 {
+		t.Fatal("expected unknown percent without total")
+	}
+}
@@ -1,6 +1,7 @@
 package kmlapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/twpayne/go-kml"
@@ -26,26 +27,39 @@ type ExportStats struct {
 	UnmatchedVenueIDs             int
 	CheckinsMissingVenueOrTime    int
 	CheckinsDeduplicatedByVenueTs int
+	ListsFetched                  int
+	ListItemsExported             int
+	TipsAttached                  int
+	PhotosAttached                int
+	ThumbnailsPacked              int
 }
 
-func reportProgress(progress ProgressCallback, stage string, fetched int, total int) {
-	if progress != nil {
-		progress(stage, fetched, total)
-	}
+// CategoryTree links every category below the top level to its parent and
+// names all of them, for full category paths.
+type CategoryTree struct {
+	Parent map[string]string
+	Name   map[string]string
 }
 
 func ResolveCategories(token FSQToken) (Root, TopLevel, error) {
+	root, topLevel, _, err := resolveCategories(context.Background(), activeBackend, token, defaultLocale, nil)
+	return root, topLevel, err
+}
+
+func resolveCategories(ctx context.Context, b Backend, token FSQToken, locale string, rep *progressReporter) (Root, TopLevel, CategoryTree, error) {
 
-	cats, err := FetchCategories(token)
+	cats, err := loadCategories(ctx, b, token, locale, rep)
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, CategoryTree{}, err
 	}
 
 	root := make(map[string]string)
 
 	idToName := make(map[string]string)
 
+	tree := CategoryTree{Parent: make(map[string]string), Name: make(map[string]string)}
+
 	var walk func(*GlobalCategory, string)
 
 	walk = func(c *GlobalCategory, id string) {
@@ -53,7 +67,9 @@ func ResolveCategories(token FSQToken) (Root, TopLevel, error) {
 			return
 		}
 		for _, inner := range c.Children {
-			root[inner.Id] = c.Id
+			root[inner.Id] = id
+			tree.Parent[inner.Id] = c.Id
+			tree.Name[inner.Id] = inner.Name
 			walk(&inner, id)
 		}
 	}
@@ -61,10 +77,11 @@ func ResolveCategories(token FSQToken) (Root, TopLevel, error) {
 	for _, c := range cats {
 		idToName[c.Id] = c.Name
 		root[c.Id] = c.Id
+		tree.Name[c.Id] = c.Name
 		walk(&c, c.Id)
 	}
 
-	return root, idToName, nil
+	return root, idToName, tree, nil
 }
 
 func BuildKML(token FSQToken, before *time.Time, after *time.Time) (*kml.CompoundElement, error) {
@@ -77,37 +94,67 @@ func BuildKMLWithProgress(token FSQToken, before *time.Time, after *time.Time, p
 }
 
 func BuildKMLWithProgressAndStats(token FSQToken, before *time.Time, after *time.Time, progress ProgressCallback) (*kml.CompoundElement, ExportStats, error) {
-	stats := ExportStats{}
-	venues, err := FetchVenues(token, before, after, progress)
-	if err != nil {
-		return nil, stats, err
-	}
-	stats.VenuesFetched = len(venues)
+	return BuildKMLWithListener(token, before, after, CallbackListener(progress))
+}
+
+func BuildKMLWithListener(token FSQToken, before *time.Time, after *time.Time, listener ProgressListener) (*kml.CompoundElement, ExportStats, error) {
+	return BuildKMLContext(context.Background(), token, before, after, listener)
+}
 
-	checkinsByVenue, checkinStats, err := FetchCheckins(token, before, after, progress)
+// BuildKMLContext is BuildKMLWithListener with cancellation: every upstream
+// request and retry wait is bound to ctx.
+func BuildKMLContext(ctx context.Context, token FSQToken, before *time.Time, after *time.Time, listener ProgressListener) (*kml.CompoundElement, ExportStats, error) {
+	rep := newProgressReporter(listener)
+	ds, stats, err := fetchDataset(ctx, token, ExportOptions{Before: before, After: after}, rep)
 	if err != nil {
 		return nil, stats, err
 	}
-	stats.CheckinsRawFetched = checkinStats.RawCheckinsFetched
-	stats.CheckinsUniqueRetained = checkinStats.UniqueCheckinsRetained
-	stats.CheckinsMissingVenueOrTime = checkinStats.MissingVenueOrTimestamp
-	stats.CheckinsDeduplicatedByVenueTs = checkinStats.DeduplicatedByVenueAndTime
+	return buildKML(ds, nil, rep, &stats, nil), stats, nil
+}
 
-	venueSet := make(map[string]struct{}, len(venues))
-	for i := range venues {
-		venueSet[venues[i].Id] = struct{}{}
-		venues[i].VisitTimestamps = checkinsByVenue[venues[i].Id]
-	}
-	for venueID, timestamps := range checkinsByVenue {
-		if _, ok := venueSet[venueID]; ok {
-			stats.CheckinsMatchedToVenues += len(timestamps)
-			continue
+// BuildKMLFromDataset renders an already fetched dataset.
+func BuildKMLFromDataset(ds *Dataset) (*kml.CompoundElement, ExportStats) {
+	return BuildKMLFromDatasetGrouped(ds, nil)
+}
+
+// BuildKMLFromDatasetGrouped renders ds with the venues in the folders of g.
+func BuildKMLFromDatasetGrouped(ds *Dataset, g Grouping) (*kml.CompoundElement, ExportStats) {
+	stats := ExportStats{VenuesFetched: len(ds.Venues)}
+	return buildKML(ds, g, nil, &stats, nil), stats
+}
+
+func countExported(ds *Dataset, stats *ExportStats) {
+	stats.VenuesExported = len(ds.Venues)
+	stats.UnknownCategoryVenues = 0
+	for _, v := range ds.Venues {
+		if len(v.Categories) == 0 {
+			stats.UnknownCategoryVenues++
 		}
-		stats.UnmatchedVenueIDs++
-		stats.CheckinsUnmatchedToVenues += len(timestamps)
 	}
+	stats.ListItemsExported = 0
+	for _, l := range ds.Lists {
+		stats.ListItemsExported += len(l.Items)
+	}
+}
+
+func finishRender(stage string, ds *Dataset, rep *progressReporter, stats *ExportStats) {
+	rep.stageFinished(stage, stats.VenuesExported, len(ds.Venues))
+	if stats.UnknownCategoryVenues > 0 {
+		rep.warning(stage, "%d venues have no known category and were placed in the %q folder", stats.UnknownCategoryVenues, CatalogFor(ds.Locale).Unknown)
+	}
+	rep.statsSnapshot(*stats)
+}
 
-	folders := make(map[string]*kml.CompoundElement)
+// buildKML renders ds with the venues in the folders of g, by top-level
+// category when nil; photos shows the thumbnails, linked from their URLs
+// when nil.
+func buildKML(ds *Dataset, g Grouping, rep *progressReporter, stats *ExportStats, photos photoSource) *kml.CompoundElement {
+	msg := CatalogFor(ds.Locale)
+	rep.stageStarted("kml")
+	if g == nil {
+		g = GroupByCategory
+	}
+	var folders folderTree
 
 	k := kml.KML()
 	d := kml.Document()
@@ -120,66 +167,70 @@ func BuildKMLWithProgressAndStats(token FSQToken, before *time.Time, after *time
 			kml.SimpleField("visit_timestamps_unix", "string"),
 		),
 	)
-
-	categoriesMap, idToName, err := ResolveCategories(token)
-	if err != nil {
-		return nil, stats, err
+	if hasMedia(ds) {
+		d.Add(mediaSchema())
+	}
+	if datasetHasDetails(ds) {
+		d.Add(detailsSchema())
+	}
+	if ds.Clusters != nil {
+		d.Add(clusterSchema())
 	}
 
-	for _, item := range venues {
-		place := kml.Placemark(
-			kml.Name(item.Name),
-			kml.Description(buildVisitDescription(item.VisitTimestamps)),
-			buildVisitExtendedData(item.VisitTimestamps),
-			kml.Point(
-				kml.Coordinates(kml.Coordinate{Lon: item.Location.Lng, Lat: item.Location.Lat}),
-			),
-		)
-
-		if len(item.Categories) == 0 {
-			stats.UnknownCategoryVenues++
-			folder := folders[unknownCategoryFolder]
-			if folder == nil {
-				folder = kml.Folder(kml.Name(unknownCategoryFolder))
-				folders[unknownCategoryFolder] = folder
-			}
-			folder.Add(place)
-			stats.VenuesExported++
-			continue
+	for _, item := range ds.Venues {
+		data := buildVenueExtendedData(item)
+		var region []kml.Element
+		if zoom, ok := ds.Clusters.minZoom(item); ok {
+			data.Add(kml.SchemaData("#cluster-metadata", kml.SimpleData("min_zoom", strconv.Itoa(zoom))))
+			region = append(region, ds.Clusters.venueRegion(item, zoom))
 		}
+		place := venuePlacemark(item, buildVenueDescription(item, msg, "", photos), data, region...)
 
-		for _, c := range item.Categories {
-			topLevelName := idToName[categoriesMap[c.Id]]
-			if topLevelName == "" {
-				topLevelName = unknownCategoryFolder
-			}
-			folder := folders[topLevelName]
-			if folder == nil {
-				folder = kml.Folder(kml.Name(topLevelName))
-				folders[topLevelName] = folder
-			}
-			folder.Add(place)
+		for _, path := range g.Groups(ds, item) {
+			folders.add(path, place)
 		}
-		stats.VenuesExported++
 	}
-
-	for _, f := range folders {
-		d.Add(f)
+	countExported(ds, stats)
+
+	d.Add(folders.folders()...)
+	d.Add(folders.places...)
+	if ds.Clusters != nil {
+		clusters := kml.Folder(kml.Name(msg.Clusters))
+		for _, c := range ds.Clusters.Clusters {
+			clusters.Add(clusterPlacemark(c, msg))
+		}
+		d.Add(clusters)
+	}
+	if len(ds.Lists) > 0 {
+		d.Add(
+			kml.Schema(
+				"list-item-metadata",
+				"ListItemMetadata",
+				kml.SimpleField("list_id", "string"),
+				kml.SimpleField("note", "string"),
+				kml.SimpleField("added_unix", "int"),
+				kml.SimpleField("visit_count", "int"),
+			),
+		)
+	}
+	for _, l := range ds.Lists {
+		d.Add(buildListFolder(l, msg, photos))
 	}
+	finishRender("kml", ds, rep, stats)
 
 	k.Add(d)
-	return k, stats, nil
+	return k
 }
 
-func buildVisitDescription(timestamps []int64) string {
+func buildVisitDescription(timestamps []int64, msg Catalog) string {
 	if len(timestamps) == 0 {
-		return "Visit count: 0"
+		return msg.VisitCount + ": 0"
 	}
 
 	lines := []string{
-		fmt.Sprintf("Visit count: %d", len(timestamps)),
-		fmt.Sprintf("Last visit (UTC): %s", time.Unix(timestamps[0], 0).UTC().Format(time.RFC3339)),
-		"Recent visits (UTC):",
+		fmt.Sprintf("%s: %d", msg.VisitCount, len(timestamps)),
+		fmt.Sprintf("%s: %s", msg.LastVisit, time.Unix(timestamps[0], 0).UTC().Format(time.RFC3339)),
+		msg.RecentVisits + ":",
 	}
 
 	limit := 5
@@ -193,6 +244,14 @@ func buildVisitDescription(timestamps []int64) string {
 	return strings.Join(lines, "\n")
 }
 
+func buildVenueExtendedData(v Venue) *kml.CompoundElement {
+	data := buildVisitExtendedData(v.VisitTimestamps)
+	if media := mediaSchemaData(v); media != nil {
+		data.Add(media)
+	}
+	return data
+}
+
 func buildVisitExtendedData(timestamps []int64) *kml.CompoundElement {
 	lastVisit := int64(0)
 	if len(timestamps) > 0 {
@@ -213,3 +272,28 @@ func buildVisitExtendedData(timestamps []int64) *kml.CompoundElement {
 		),
 	)
 }
+
+// buildListFolder renders a list as its own folder, the note of every item
+// leading its description.
+func buildListFolder(l List, msg Catalog, photos photoSource) *kml.CompoundElement {
+	folder := kml.Folder(kml.Name(l.Name))
+	if l.Description != "" {
+		folder.Add(kml.Description(l.Description))
+	}
+	for _, it := range l.Items {
+		data := kml.ExtendedData(
+			kml.SchemaData(
+				"#list-item-metadata",
+				kml.SimpleData("list_id", l.Id),
+				kml.SimpleData("note", it.Note),
+				kml.SimpleData("added_unix", strconv.FormatInt(it.CreatedAt, 10)),
+				kml.SimpleData("visit_count", strconv.Itoa(len(it.Venue.VisitTimestamps))),
+			),
+		)
+		if media := mediaSchemaData(it.Venue); media != nil {
+			data.Add(media)
+		}
+		folder.Add(venuePlacemark(it.Venue, buildVenueDescription(it.Venue, msg, it.Note, photos), data))
+	}
+	return folder
+}
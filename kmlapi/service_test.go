@@ -2,6 +2,8 @@ package kmlapi
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +11,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
 )
 
 type rewriteTransport struct {
@@ -222,3 +226,55 @@ func TestBuildKMLReturnsErrorWhenVenueHistoryFails(t *testing.T) {
 		t.Fatalf("expected HTTP status in error, got: %v", err)
 	}
 }
+
+func TestBuildKMLContextStopsWhenCanceled(t *testing.T) {
+	withMockFSQServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("unexpected upstream request after cancellation: %s", r.URL.Path)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := BuildKMLContext(ctx, NewToken("token"), nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestFetchDatasetAgainstFakeAPI(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	fake := fsqfake.NewServer(data)
+	fake.HistoryLimit = 50
+	withMockFSQServer(t, fake.ServeHTTP)
+
+	visited := make(map[string]struct{})
+	shouts := 0
+	for _, c := range data.Checkins {
+		if c.VenueId == "" {
+			shouts++
+			continue
+		}
+		visited[c.VenueId] = struct{}{}
+	}
+
+	ds, stats, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("FetchDataset returned error: %v", err)
+	}
+	if stats.VenuesFetched != len(visited) || len(ds.Venues) != len(visited) {
+		t.Fatalf("expected %d venues through the paged fallback, got %+v", len(visited), stats)
+	}
+	if stats.CheckinsRawFetched != len(data.Checkins) || stats.CheckinsMissingVenueOrTime != shouts {
+		t.Fatalf("unexpected checkin stats: %+v", stats)
+	}
+	if stats.UnknownCategoryVenues != 0 {
+		t.Fatalf("expected every venue to resolve to a top-level category: %+v", stats)
+	}
+	visits := 0
+	for _, v := range ds.Venues {
+		visits += len(v.VisitTimestamps)
+	}
+	if visits != len(data.Checkins)-shouts {
+		t.Fatalf("expected %d visits, got %d", len(data.Checkins)-shouts, visits)
+	}
+}
@@ -0,0 +1,207 @@
+package kmlapi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/twpayne/go-kml"
+)
+
+// IndexName is the file name of the index of a split export written to a
+// directory. In a KMZ archive the index is doc.kml.
+const IndexName = "index.kml"
+
+// Part is one KML file of a split export.
+type Part struct {
+	// Name is the file name, relative to the index.
+	Name       string
+	Title      string
+	Placemarks int
+	KML        *kml.CompoundElement
+}
+
+// SplitKML renders ds as an index followed by one part per outermost group
+// of g, by top-level category when nil, and one per list. Parts holding
+// more than maxPlacemarks placemarks are split further; 0 means no limit.
+func SplitKML(ds *Dataset, g Grouping, maxPlacemarks int) []Part {
+	var stats ExportStats
+	return splitKML(ds, g, maxPlacemarks, nil, &stats, nil)
+}
+
+func splitKML(ds *Dataset, g Grouping, maxPlacemarks int, rep *progressReporter, stats *ExportStats, photos photoSource) []Part {
+	if g == nil {
+		g = GroupByCategory
+	}
+	rep.stageStarted("kml")
+
+	// A venue grouped at the top is filed under the unknown group.
+	pathsOf := func(v Venue) [][]string {
+		paths := g.Groups(ds, v)
+		for i, path := range paths {
+			if len(path) == 0 {
+				paths[i] = []string{ds.unknown()}
+			}
+		}
+		return paths
+	}
+
+	// Venues keep their order within a group; the parts are sorted by
+	// group like the folders of a single file.
+	var keys []string
+	members := make(map[string][]Venue)
+	for _, v := range ds.Venues {
+		seen := make(map[string]struct{})
+		for _, path := range pathsOf(v) {
+			key := path[0]
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if _, ok := members[key]; !ok {
+				keys = append(keys, key)
+			}
+			members[key] = append(members[key], v)
+		}
+	}
+
+	sort.Strings(keys)
+
+	names := make(map[string]bool)
+	var parts []Part
+	addParts := func(title string, slug string, chunks []*Dataset, inner Grouping) {
+		for i, chunk := range chunks {
+			var discard ExportStats
+			part := Part{Title: title, KML: buildKML(chunk, inner, nil, &discard, photos)}
+			part.Placemarks = placemarkCount(chunk, inner)
+			if len(chunks) > 1 {
+				part.Title = fmt.Sprintf("%s (%d/%d)", title, i+1, len(chunks))
+			}
+			part.Name = uniqueName(names, slug, i+1)
+			parts = append(parts, part)
+		}
+	}
+	for _, key := range keys {
+		key := key
+		// The outermost level is the file, the remaining levels its folders.
+		inner := GroupingFunc(func(ds *Dataset, v Venue) [][]string {
+			var groups [][]string
+			for _, path := range pathsOf(v) {
+				if path[0] == key {
+					groups = append(groups, path[1:])
+				}
+			}
+			return groups
+		})
+		var chunks []*Dataset
+		for _, venues := range chunkVenues(ds, members[key], inner, maxPlacemarks) {
+			chunks = append(chunks, &Dataset{Venues: venues, Root: ds.Root, TopLevel: ds.TopLevel, Tree: ds.Tree, Locale: ds.Locale})
+		}
+		addParts(key, slugify(key), chunks, inner)
+	}
+	for _, l := range ds.Lists {
+		size := len(l.Items)
+		if maxPlacemarks > 0 {
+			size = maxPlacemarks
+		}
+		var chunks []*Dataset
+		for start := 0; ; start += size {
+			end := min(start+size, len(l.Items))
+			chunk := l
+			chunk.Items = l.Items[start:end]
+			chunks = append(chunks, &Dataset{Lists: []List{chunk}, Root: ds.Root, TopLevel: ds.TopLevel, Tree: ds.Tree, Locale: ds.Locale})
+			if end >= len(l.Items) {
+				break
+			}
+		}
+		addParts(l.Name, "list-"+slugify(l.Name), chunks, nil)
+	}
+
+	index := kml.Document(kml.Name(fmt.Sprintf("Foursquare history (%d files)", len(parts))))
+	for _, p := range parts {
+		index.Add(kml.NetworkLink(
+			kml.Name(p.Title),
+			kml.Description(fmt.Sprintf("%d placemarks", p.Placemarks)),
+			kml.Link(kml.Href(p.Name)),
+		))
+	}
+	countExported(ds, stats)
+	finishRender("kml", ds, rep, stats)
+	return append([]Part{{Name: IndexName, Title: "Index", KML: kml.KML(index)}}, parts...)
+}
+
+// chunkVenues cuts venues into runs of at most max placemarks. A venue with
+// more placemarks than max gets a run of its own.
+func chunkVenues(ds *Dataset, venues []Venue, g Grouping, max int) [][]Venue {
+	if max <= 0 {
+		return [][]Venue{venues}
+	}
+	var (
+		chunks [][]Venue
+		start  int
+		count  int
+	)
+	for i, v := range venues {
+		n := len(g.Groups(ds, v))
+		if count > 0 && count+n > max {
+			chunks = append(chunks, venues[start:i])
+			start, count = i, 0
+		}
+		count += n
+	}
+	return append(chunks, venues[start:])
+}
+
+func placemarkCount(ds *Dataset, g Grouping) int {
+	n := 0
+	for _, v := range ds.Venues {
+		n += len(g.Groups(ds, v))
+	}
+	for _, l := range ds.Lists {
+		n += len(l.Items)
+	}
+	return n
+}
+
+// slugify keeps letters and digits of any script so names like 日本 survive.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "group"
+	}
+	return slug
+}
+
+// ReservedPartName reports whether name is kept for the index of a split
+// export, in a directory or in a KMZ archive.
+func ReservedPartName(name string) bool {
+	return name == IndexName || name == kmzDoc
+}
+
+// uniqueName numbers the chunks of a part and any names that collide, like
+// "Food & Drink" and "Food/Drink", or a group called Index with the index.
+func uniqueName(used map[string]bool, slug string, chunk int) string {
+	base := slug
+	if chunk > 1 {
+		base += "-" + strconv.Itoa(chunk)
+	}
+	name := base + ".kml"
+	for n := 2; used[name] || ReservedPartName(name); n++ {
+		name = base + "-" + strconv.Itoa(n) + ".kml"
+	}
+	used[name] = true
+	return name
+}
@@ -0,0 +1,152 @@
+package kmlapi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func renderPart(t *testing.T, p Part) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := p.KML.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestSplitKMLWritesAPartPerGroup(t *testing.T) {
+	ds := testListDataset()
+	parts := SplitKML(ds, nil, 0)
+
+	var names []string
+	for _, p := range parts {
+		names = append(names, p.Name)
+	}
+	if got := strings.Join(names, " "); got != "index.kml food.kml unknown.kml list-to-try.kml" {
+		t.Fatalf("unexpected parts %s", got)
+	}
+	index := renderPart(t, parts[0])
+	for _, p := range parts[1:] {
+		if !strings.Contains(index, "<href>"+p.Name+"</href>") {
+			t.Fatalf("expected the index to link %s: %s", p.Name, index)
+		}
+	}
+	food := renderPart(t, parts[1])
+	if !strings.Contains(food, "<name>Cafe One</name>") || strings.Contains(food, "Mystery Place") || strings.Contains(food, "<Folder>") {
+		t.Fatalf("expected the food venues at the top of their part, got %s", food)
+	}
+	if parts[3].Placemarks != len(ds.Lists[0].Items) || !strings.Contains(renderPart(t, parts[3]), "<name>To try</name>") {
+		t.Fatalf("unexpected list part %+v", parts[3])
+	}
+}
+
+func TestSplitKMLLimitsPlacemarks(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+	ds, _, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _ := ParseGrouping("country>category")
+
+	parts := SplitKML(ds, g, 25)
+	total := 0
+	seen := make(map[string]bool)
+	for _, p := range parts[1:] {
+		if p.Placemarks > 25 {
+			t.Fatalf("%s holds %d placemarks", p.Name, p.Placemarks)
+		}
+		if seen[p.Name] {
+			t.Fatalf("duplicate part %s", p.Name)
+		}
+		seen[p.Name] = true
+		total += p.Placemarks
+		if got := strings.Count(renderPart(t, p), "<Placemark>"); got != p.Placemarks {
+			t.Fatalf("%s renders %d placemarks, counted %d", p.Name, got, p.Placemarks)
+		}
+	}
+	if total != len(ds.Venues) || len(parts) < 10 {
+		t.Fatalf("expected %d venues in many parts, got %d in %d", len(ds.Venues), total, len(parts))
+	}
+	if !strings.Contains(renderPart(t, parts[0]), "<name>United States (1/3)</name>") {
+		t.Fatalf("expected numbered titles for a group split in several parts")
+	}
+}
+
+func TestSplitExportIsAKMZ(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+
+	opts := ExportOptions{Format: FormatKML, Split: true}
+	if opts.OutputFormat() != FormatKMZ {
+		t.Fatalf("expected a split KML export to be a KMZ, got %s", opts.OutputFormat())
+	}
+	var buf bytes.Buffer
+	if _, err := Export(context.Background(), NewToken(fsqfake.DefaultToken), opts, &buf, nil); err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]bool)
+	for _, f := range zr.File {
+		entries[f.Name] = true
+	}
+	doc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := io.ReadAll(doc)
+	doc.Close()
+	links := regexp.MustCompile(`<href>([^<]+)</href>`).FindAllStringSubmatch(string(index), -1)
+	if zr.File[0].Name != "doc.kml" || len(links) != len(fsqfake.DefaultCategories) {
+		t.Fatalf("expected doc.kml linking a part per category, got %s with %d links", zr.File[0].Name, len(links))
+	}
+	for _, l := range links {
+		if !entries[l[1]] {
+			t.Fatalf("the index links %s, which is not in the archive", l[1])
+		}
+	}
+}
+
+func TestParseExportOptionsSplit(t *testing.T) {
+	opts, err := ParseExportOptions(url.Values{"max_placemarks": {"500"}}, time.Now())
+	if err != nil || !opts.Split || opts.MaxPlacemarks != 500 {
+		t.Fatalf("expected max_placemarks to imply split, got %+v %v", opts, err)
+	}
+	_, err = ParseExportOptions(url.Values{"split": {"true"}, "format": {"csv"}}, time.Now())
+	var paramErr *ParamError
+	if !errors.As(err, &paramErr) || paramErr.Param != "format" {
+		t.Fatalf("expected a split CSV export to be rejected, got %v", err)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for in, want := range map[string]string{"Food & Drink": "food-drink", "日本": "日本", "???": "group", "2019": "2019"} {
+		if got := slugify(in); got != want {
+			t.Fatalf("slugify(%q) = %q, want %q", in, got, want)
+		}
+	}
+	used := make(map[string]bool)
+	if a, b := uniqueName(used, "food-drink", 1), uniqueName(used, "food-drink", 1); a == b {
+		t.Fatalf("expected colliding slugs to get distinct names, got %s", a)
+	}
+	// The second chunk of food and a group called food-2 collide as well.
+	if a, b := uniqueName(used, "food", 2), uniqueName(used, "food-2", 1); a != "food-2.kml" || b != "food-2-2.kml" {
+		t.Fatalf("expected numbered names to stay distinct, got %s and %s", a, b)
+	}
+	if a, b := uniqueName(used, slugify("Index"), 1), uniqueName(used, "doc", 1); a != "index-2.kml" || b != "doc-2.kml" {
+		t.Fatalf("expected the index names to be reserved, got %s and %s", a, b)
+	}
+}
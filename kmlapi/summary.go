@@ -0,0 +1,96 @@
+package kmlapi
+
+import (
+	"sort"
+	"time"
+)
+
+type NamedCount struct {
+	Name  string
+	Count int
+}
+
+type HistorySummary struct {
+	Venues          int
+	VisitedVenues   int
+	Checkins        int
+	FirstVisit      time.Time
+	LastVisit       time.Time
+	CheckinsPerYear map[int]int
+	TopCategories   []NamedCount
+	TopCountries    []NamedCount
+	TopCities       []NamedCount
+	TopVenues       []NamedCount
+}
+
+func topCounts(counts map[string]int, limit int) []NamedCount {
+	out := make([]NamedCount, 0, len(counts))
+	for name, count := range counts {
+		out = append(out, NamedCount{Name: name, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// Summarize computes visit statistics over the dataset. Category, country,
+// city and venue rankings are by checkin count and keep at most limit
+// entries.
+func Summarize(ds *Dataset, limit int) HistorySummary {
+	summary := HistorySummary{
+		Venues:          len(ds.Venues),
+		CheckinsPerYear: make(map[int]int),
+	}
+	categories := make(map[string]int)
+	countries := make(map[string]int)
+	cities := make(map[string]int)
+	// Venues are counted by id, as chains share their name.
+	venues := make(map[string]int)
+	venueNames := make(map[string]string)
+
+	for _, v := range ds.Venues {
+		visits := len(v.VisitTimestamps)
+		if visits == 0 {
+			continue
+		}
+		summary.VisitedVenues++
+		summary.Checkins += visits
+		venues[v.Id] += visits
+		venueNames[v.Id] = v.Name
+		for _, name := range ds.TopLevelNames(v) {
+			categories[name] += visits
+		}
+		if country := v.Location.CountryName(); country != "" {
+			countries[country] += visits
+			if v.Location.City != "" {
+				cities[v.Location.City+", "+country] += visits
+			}
+		}
+		for _, ts := range v.VisitTimestamps {
+			t := time.Unix(ts, 0).UTC()
+			summary.CheckinsPerYear[t.Year()]++
+			if summary.FirstVisit.IsZero() || t.Before(summary.FirstVisit) {
+				summary.FirstVisit = t
+			}
+			if t.After(summary.LastVisit) {
+				summary.LastVisit = t
+			}
+		}
+	}
+
+	summary.TopCategories = topCounts(categories, limit)
+	summary.TopCountries = topCounts(countries, limit)
+	summary.TopCities = topCounts(cities, limit)
+	summary.TopVenues = topCounts(venues, limit)
+	for i := range summary.TopVenues {
+		summary.TopVenues[i].Name = venueNames[summary.TopVenues[i].Name]
+	}
+	return summary
+}
@@ -0,0 +1,54 @@
+package kmlapi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarizeRanksCategoriesAndVenues(t *testing.T) {
+	ds := testDataset()
+	ds.Venues = append(ds.Venues, Venue{
+		HasId:           HasId{Id: "v3"},
+		HasName:         HasName{Name: "Never Visited"},
+		Categories:      []Category{{HasId: HasId{Id: "top-food"}}},
+		VisitTimestamps: nil,
+	})
+	first := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC).Unix()
+	last := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC).Unix()
+	ds.Venues[0].VisitTimestamps = []int64{last, first}
+
+	summary := Summarize(ds, 1)
+
+	if summary.Venues != 3 || summary.VisitedVenues != 2 || summary.Checkins != 3 {
+		t.Fatalf("unexpected counts: %+v", summary)
+	}
+	if !summary.FirstVisit.Equal(time.Unix(300, 0).UTC()) || !summary.LastVisit.Equal(time.Unix(last, 0).UTC()) {
+		t.Fatalf("unexpected first/last visit: %s / %s", summary.FirstVisit, summary.LastVisit)
+	}
+	if summary.CheckinsPerYear[2019] != 1 || summary.CheckinsPerYear[2021] != 1 || summary.CheckinsPerYear[1970] != 1 {
+		t.Fatalf("unexpected checkins per year: %v", summary.CheckinsPerYear)
+	}
+	if len(summary.TopCategories) != 1 || summary.TopCategories[0] != (NamedCount{Name: "Food", Count: 2}) {
+		t.Fatalf("unexpected top categories: %v", summary.TopCategories)
+	}
+	if len(summary.TopVenues) != 1 || summary.TopVenues[0].Name != "Cafe One" {
+		t.Fatalf("unexpected top venues: %v", summary.TopVenues)
+	}
+}
+
+func TestSummarizeKeepsVenuesOfTheSameNameApart(t *testing.T) {
+	ds := testDataset()
+	ds.Venues[1].Name = "Cafe One"
+	ds.Venues = append(ds.Venues, Venue{
+		HasId:           HasId{Id: "v3"},
+		HasName:         HasName{Name: "Busy Bar"},
+		VisitTimestamps: []int64{400, 500, 600},
+	})
+
+	summary := Summarize(ds, 0)
+	want := []NamedCount{{Name: "Busy Bar", Count: 3}, {Name: "Cafe One", Count: 2}, {Name: "Cafe One", Count: 1}}
+	if !reflect.DeepEqual(summary.TopVenues, want) {
+		t.Fatalf("unexpected top venues: %v", summary.TopVenues)
+	}
+}
@@ -0,0 +1,204 @@
+package kmlapi
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/twpayne/go-kml"
+)
+
+// DefaultTilePlacemarks is the most placemarks a superoverlay tile holds
+// when no MaxPlacemarks is given.
+const DefaultTilePlacemarks = 500
+
+const (
+	// tileLodPixels is the size a tile reaches on screen before its
+	// venues, or its own tiles, replace the count shown by its parent.
+	tileLodPixels = 256
+	// maxTileDepth ends the quadtree under venues sharing a spot, which no
+	// split separates.
+	maxTileDepth = 18
+)
+
+type bounds struct {
+	north, south, east, west float64
+}
+
+func venueBounds(venues []Venue) bounds {
+	b := bounds{north: -90, south: 90, east: -180, west: 180}
+	for _, v := range venues {
+		b.north = math.Max(b.north, v.Location.Lat)
+		b.south = math.Min(b.south, v.Location.Lat)
+		b.east = math.Max(b.east, v.Location.Lng)
+		b.west = math.Min(b.west, v.Location.Lng)
+	}
+	// A single spot still needs an area for its Region to show.
+	const pad = 0.001
+	return bounds{north: math.Min(b.north+pad, 90), south: math.Max(b.south-pad, -90), east: math.Min(b.east+pad, 180), west: math.Max(b.west-pad, -180)}
+}
+
+// quadrant is the index of the child of b holding lat, lng: 0 north-west,
+// 1 north-east, 2 south-west and 3 south-east.
+func (b bounds) quadrant(lat float64, lng float64) int {
+	q := 0
+	if lat < (b.north+b.south)/2 {
+		q += 2
+	}
+	if lng >= (b.east+b.west)/2 {
+		q++
+	}
+	return q
+}
+
+func (b bounds) child(q int) bounds {
+	midLat, midLng := (b.north+b.south)/2, (b.east+b.west)/2
+	c := b
+	if q < 2 {
+		c.south = midLat
+	} else {
+		c.north = midLat
+	}
+	if q%2 == 0 {
+		c.east = midLng
+	} else {
+		c.west = midLng
+	}
+	return c
+}
+
+func compound(name string, children ...kml.Element) *kml.CompoundElement {
+	e := &kml.CompoundElement{StartElement: xml.StartElement{Name: xml.Name{Local: name}}}
+	return e.Add(children...)
+}
+
+// region shows its feature while b takes between minPixels and maxPixels
+// on screen, -1 meaning no upper limit.
+func region(b bounds, minPixels int, maxPixels int) *kml.CompoundElement {
+	return kml.Region(
+		compound("LatLonAltBox", kml.North(b.north), kml.South(b.south), kml.East(b.east), kml.West(b.west)),
+		compound("Lod", kml.MinLodPixel(minPixels), kml.MaxLodPixel(maxPixels)),
+	)
+}
+
+type tile struct {
+	key    string
+	bounds bounds
+	venues []Venue
+}
+
+func (t tile) name() string {
+	if t.key == "" {
+		return "tile.kml"
+	}
+	return "tile-" + t.key + ".kml"
+}
+
+func (t tile) children() []tile {
+	var quads [4][]Venue
+	for _, v := range t.venues {
+		q := t.bounds.quadrant(v.Location.Lat, v.Location.Lng)
+		quads[q] = append(quads[q], v)
+	}
+	var children []tile
+	for q, venues := range quads {
+		if len(venues) > 0 {
+			children = append(children, tile{key: t.key + strconv.Itoa(q), bounds: t.bounds.child(q), venues: venues})
+		}
+	}
+	return children
+}
+
+// SuperoverlayKML renders the venues of ds as a quadtree of tiles: a tile
+// with more than maxPlacemarks placemarks, DefaultTilePlacemarks when not
+// positive, shows the venue count of each quarter until the viewer zooms
+// in and loads it. The venues of a tile are in the folders of g. The index
+// comes first and also links a file per list.
+func SuperoverlayKML(ds *Dataset, g Grouping, maxPlacemarks int) []Part {
+	var stats ExportStats
+	return superoverlayKML(ds, g, maxPlacemarks, nil, &stats, nil)
+}
+
+func superoverlayKML(ds *Dataset, g Grouping, maxPlacemarks int, rep *progressReporter, stats *ExportStats, photos photoSource) []Part {
+	if g == nil {
+		g = GroupByCategory
+	}
+	if maxPlacemarks <= 0 {
+		maxPlacemarks = DefaultTilePlacemarks
+	}
+	msg := CatalogFor(ds.Locale)
+	rep.stageStarted("kml")
+
+	subset := func(venues []Venue, lists []List) *Dataset {
+		return &Dataset{Venues: venues, Lists: lists, Root: ds.Root, TopLevel: ds.TopLevel, Tree: ds.Tree, Locale: ds.Locale}
+	}
+	var parts []Part
+	var render func(t tile)
+	render = func(t tile) {
+		sub := subset(t.venues, nil)
+		part := Part{Name: t.name(), Title: fmt.Sprintf("%d venues", len(t.venues)), Placemarks: placemarkCount(sub, g)}
+		if part.Placemarks <= maxPlacemarks || len(t.key) >= maxTileDepth {
+			var discard ExportStats
+			part.KML = buildKML(sub, g, nil, &discard, photos)
+			parts = append(parts, part)
+			return
+		}
+		d := kml.Document(kml.Name(part.Title))
+		children := t.children()
+		part.Placemarks = len(children)
+		for _, c := range children {
+			d.Add(tileCount(c, msg), kml.NetworkLink(
+				kml.Name(fmt.Sprintf("%d venues", len(c.venues))),
+				region(c.bounds, tileLodPixels, -1),
+				kml.Link(kml.Href(c.name()), kml.ViewRefreshMode("onRegion")),
+			))
+		}
+		part.KML = kml.KML(d)
+		parts = append(parts, part)
+		for _, c := range children {
+			render(c)
+		}
+	}
+
+	var links []kml.Element
+	if len(ds.Venues) > 0 {
+		root := tile{bounds: venueBounds(ds.Venues), venues: ds.Venues}
+		render(root)
+		links = append(links, kml.NetworkLink(
+			kml.Name(fmt.Sprintf("%d venues", len(ds.Venues))),
+			kml.Link(kml.Href(root.name())),
+		))
+	}
+	names := make(map[string]bool)
+	for _, l := range ds.Lists {
+		name := uniqueName(names, "list-"+slugify(l.Name), 1)
+		var discard ExportStats
+		parts = append(parts, Part{Name: name, Title: l.Name, Placemarks: len(l.Items), KML: buildKML(subset(nil, []List{l}), nil, nil, &discard, photos)})
+		links = append(links, kml.NetworkLink(kml.Name(l.Name), kml.Link(kml.Href(name))))
+	}
+
+	index := kml.Document(kml.Name(fmt.Sprintf("Foursquare history (%d files)", len(parts))))
+	index.Add(links...)
+	countExported(ds, stats)
+	finishRender("kml", ds, rep, stats)
+	return append([]Part{{Name: IndexName, Title: "Index", KML: kml.KML(index)}}, parts...)
+}
+
+// tileCount stands for the venues of t until it loads, at their centroid.
+func tileCount(t tile, msg Catalog) *kml.CompoundElement {
+	var lat, lng float64
+	visits := 0
+	for _, v := range t.venues {
+		lat += v.Location.Lat
+		lng += v.Location.Lng
+		visits += len(v.VisitTimestamps)
+	}
+	n := float64(len(t.venues))
+	return kml.Placemark(
+		kml.Name(strconv.Itoa(len(t.venues))),
+		kml.Description(fmt.Sprintf("%d venues\n%s: %d", len(t.venues), msg.VisitCount, visits)),
+		region(t.bounds, 0, tileLodPixels),
+		kml.Point(kml.Coordinates(kml.Coordinate{Lon: lng / n, Lat: lat / n})),
+	)
+}
@@ -0,0 +1,112 @@
+package kmlapi
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdevelop/fs4map/fsqfake"
+)
+
+func TestSuperoverlayOfFewVenuesIsOneTile(t *testing.T) {
+	parts := SuperoverlayKML(testListDataset(), nil, 0)
+
+	var names []string
+	for _, p := range parts {
+		names = append(names, p.Name)
+	}
+	if got := strings.Join(names, " "); got != "index.kml tile.kml list-to-try.kml" {
+		t.Fatalf("unexpected parts %s", got)
+	}
+	tile := renderPart(t, parts[1])
+	if !strings.Contains(tile, "<name>Cafe One</name>") || strings.Contains(tile, "<Region>") {
+		t.Fatalf("expected the venues in a single tile, got %s", tile)
+	}
+}
+
+func TestSuperoverlayTiles(t *testing.T) {
+	data := fsqfake.Generate(fsqfake.DefaultGenerateOptions())
+	withMockFSQServer(t, fsqfake.NewServer(data).ServeHTTP)
+	ds, _, err := FetchDataset(context.Background(), NewToken(fsqfake.DefaultToken), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := SuperoverlayKML(ds, nil, 20)
+	byName := make(map[string]string)
+	for _, p := range parts {
+		byName[p.Name] = renderPart(t, p)
+	}
+	hrefs := regexp.MustCompile(`<href>([^<]+)</href>`)
+	counts := regexp.MustCompile(`<Placemark>\s*<name>(\d+)</name>`)
+	linked := map[string]bool{IndexName: true}
+	leaves := 0
+	for _, p := range parts {
+		doc := byName[p.Name]
+		for _, m := range hrefs.FindAllStringSubmatch(doc, -1) {
+			if _, ok := byName[m[1]]; !ok {
+				t.Fatalf("%s links %s, which was not rendered", p.Name, m[1])
+			}
+			linked[m[1]] = true
+		}
+		if !strings.HasPrefix(p.Name, "tile") {
+			continue
+		}
+		if strings.Contains(doc, "<NetworkLink>") {
+			// The counts of the quarters add up to the venues of the tile.
+			total := 0
+			for _, m := range counts.FindAllStringSubmatch(doc, -1) {
+				n, _ := strconv.Atoi(m[1])
+				total += n
+			}
+			if want := strings.TrimSuffix(p.Title, " venues"); strconv.Itoa(total) != want {
+				t.Fatalf("%s counts %d venues, want %s", p.Name, total, want)
+			}
+			if !strings.Contains(doc, "<minLodPixels>256</minLodPixels>") || !strings.Contains(doc, "<viewRefreshMode>onRegion</viewRefreshMode>") {
+				t.Fatalf("expected the quarters of %s to load by region", p.Name)
+			}
+			continue
+		}
+		if p.Placemarks > 20 {
+			t.Fatalf("%s holds %d placemarks", p.Name, p.Placemarks)
+		}
+		leaves += strings.Count(doc, "<Placemark>")
+	}
+	if len(linked) != len(parts) {
+		t.Fatalf("expected every part to be linked, %d of %d are", len(linked), len(parts))
+	}
+	if want := placemarkCount(ds, GroupByCategory); leaves != want {
+		t.Fatalf("expected the %d venue placemarks across the tiles, got %d", want, leaves)
+	}
+}
+
+func TestBoundsQuadrants(t *testing.T) {
+	b := bounds{north: 10, south: 0, east: 20, west: 0}
+	for q, want := range []bounds{
+		{north: 10, south: 5, east: 10, west: 0},
+		{north: 10, south: 5, east: 20, west: 10},
+		{north: 5, south: 0, east: 10, west: 0},
+		{north: 5, south: 0, east: 20, west: 10},
+	} {
+		if got := b.child(q); got != want {
+			t.Fatalf("child %d = %+v, want %+v", q, got, want)
+		}
+		if got := b.quadrant((want.north+want.south)/2, (want.east+want.west)/2); got != q {
+			t.Fatalf("expected the middle of quarter %d in it, got %d", q, got)
+		}
+	}
+}
+
+func TestParseExportOptionsSuperoverlay(t *testing.T) {
+	opts, err := ParseExportOptions(url.Values{"superoverlay": {"true"}}, time.Now())
+	if err != nil || !opts.Superoverlay || !opts.Split || opts.OutputFormat() != FormatKMZ {
+		t.Fatalf("expected a superoverlay KMZ, got %+v %v", opts, err)
+	}
+	if _, err := ParseExportOptions(url.Values{"superoverlay": {"true"}, "format": {"geojson"}}, time.Now()); err == nil {
+		t.Fatal("expected a GeoJSON superoverlay to be rejected")
+	}
+}
@@ -0,0 +1,228 @@
+package kmlapi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const (
+	tokenFileVersion   = 1
+	tokenKDFIterations = 210000
+	// A stored file may only ask for a work factor between these, so an
+	// edited file can neither weaken the key nor hang the KDF.
+	tokenKDFMinIterations = 100000
+	tokenKDFMaxIterations = 10000000
+	tokenFilePermission   = 0600
+)
+
+var (
+	ErrNoToken          = errors.New("no stored token")
+	ErrTokenDecryption  = errors.New("can not decrypt stored token, wrong passphrase?")
+	ErrEmptyPassphrase  = errors.New("token store passphrase is empty")
+	errInsecureFileMode = errors.New("token file is readable by other users")
+)
+
+type StoredToken struct {
+	Token   FSQToken  `json:"token"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// Expired reports whether the token is older than maxAge. A zero maxAge
+// never expires.
+func (t StoredToken) Expired(maxAge time.Duration, now time.Time) bool {
+	return maxAge > 0 && now.Sub(t.SavedAt) > maxAge
+}
+
+type TokenStore interface {
+	Load() (StoredToken, error)
+	Save(token FSQToken) error
+	Clear() error
+}
+
+type tokenFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// FileTokenStore keeps the access token in a file readable only by the
+// owner, encrypted with AES-GCM under a key derived from a passphrase.
+// Every Save uses a fresh salt and nonce, so rotating the token also
+// rotates the key material.
+type FileTokenStore struct {
+	Path       string
+	Passphrase []byte
+}
+
+func NewFileTokenStore(path string, passphrase string) *FileTokenStore {
+	return &FileTokenStore{Path: path, Passphrase: []byte(passphrase)}
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	key := make([]byte, 0, blocks*hashLen)
+	buf := make([]byte, 4)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, uint32(block))
+		prf.Write(buf)
+		u := prf.Sum(nil)
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func (s *FileTokenStore) aead(salt []byte, iterations int) (cipher.AEAD, error) {
+	if len(s.Passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+	block, err := aes.NewCipher(pbkdf2SHA256(s.Passphrase, salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *FileTokenStore) Load() (StoredToken, error) {
+	info, err := os.Stat(s.Path)
+	if os.IsNotExist(err) {
+		return StoredToken{}, ErrNoToken
+	}
+	if err != nil {
+		return StoredToken{}, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return StoredToken{}, fmt.Errorf("%w: chmod 600 %s", errInsecureFileMode, s.Path)
+	}
+
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	var f tokenFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return StoredToken{}, fmt.Errorf("corrupted token file %s: %w", s.Path, err)
+	}
+	if f.Version != tokenFileVersion {
+		return StoredToken{}, fmt.Errorf("unsupported token file version %d", f.Version)
+	}
+	if f.Iterations < tokenKDFMinIterations || f.Iterations > tokenKDFMaxIterations {
+		return StoredToken{}, fmt.Errorf("corrupted token file %s: %d KDF iterations, expected %d to %d", s.Path, f.Iterations, tokenKDFMinIterations, tokenKDFMaxIterations)
+	}
+
+	aead, err := s.aead(f.Salt, f.Iterations)
+	if err != nil {
+		return StoredToken{}, err
+	}
+	plain, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return StoredToken{}, ErrTokenDecryption
+	}
+	var stored StoredToken
+	if err := json.Unmarshal(plain, &stored); err != nil {
+		return StoredToken{}, err
+	}
+	if stored.Token == "" {
+		return StoredToken{}, ErrNoToken
+	}
+	return stored, nil
+}
+
+func (s *FileTokenStore) Save(token FSQToken) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := s.aead(salt, tokenKDFIterations)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	plain, err := json.Marshal(StoredToken{Token: token, SavedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(tokenFile{
+		Version:    tokenFileVersion,
+		KDF:        "pbkdf2-sha256",
+		Iterations: tokenKDFIterations,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plain, nil),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(tokenFilePermission); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// Clear overwrites the token file before removing it.
+func (s *FileTokenStore) Clear() error {
+	info, err := os.Stat(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.Path, make([]byte, info.Size()), tokenFilePermission); err != nil {
+		return err
+	}
+	return os.Remove(s.Path)
+}
@@ -0,0 +1,118 @@
+package kmlapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256MatchesRFC7914Vector(t *testing.T) {
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Fatalf("unexpected PBKDF2 output %s", got)
+	}
+}
+
+func TestFileTokenStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "token.enc")
+	store := NewFileTokenStore(path, "correct horse")
+
+	if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("expected ErrNoToken for a missing file, got %v", err)
+	}
+	if err := store.Save(NewToken("secret-token")); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read token file: %v", err)
+	}
+	if strings.Contains(string(content), "secret-token") {
+		t.Fatal("expected token to be encrypted on disk")
+	}
+	if runtime.GOOS != "windows" {
+		info, _ := os.Stat(path)
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("expected 0600 permissions, got %v", info.Mode().Perm())
+		}
+	}
+
+	stored, err := store.Load()
+	if err != nil || stored.Token != "secret-token" {
+		t.Fatalf("expected token round trip, got %q, %v", stored.Token, err)
+	}
+	if stored.Expired(time.Hour, time.Now()) || !stored.Expired(time.Hour, time.Now().Add(2*time.Hour)) {
+		t.Fatalf("unexpected expiry for token saved at %s", stored.SavedAt)
+	}
+
+	if _, err := NewFileTokenStore(path, "wrong").Load(); !errors.Is(err, ErrTokenDecryption) {
+		t.Fatalf("expected decryption error for wrong passphrase, got %v", err)
+	}
+
+	if err := store.Save(NewToken("rotated-token")); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	rotated, _ := os.ReadFile(path)
+	if string(rotated) == string(content) {
+		t.Fatal("expected a fresh salt and nonce on rotation")
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear returned error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected token file to be removed, got %v", err)
+	}
+}
+
+func TestFileTokenStoreRejectsWorldReadableFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+	path := filepath.Join(t.TempDir(), "token.enc")
+	store := NewFileTokenStore(path, "passphrase")
+	if err := store.Save(NewToken("token")); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, errInsecureFileMode) {
+		t.Fatalf("expected insecure mode error, got %v", err)
+	}
+}
+
+func TestFileTokenStoreRejectsOutOfRangeIterations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.enc")
+	store := NewFileTokenStore(path, "correct horse")
+	if err := store.Save(NewToken("secret-token")); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f tokenFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		t.Fatal(err)
+	}
+	for _, iterations := range []int{0, 1, tokenKDFMaxIterations + 1} {
+		f.Iterations = iterations
+		edited, _ := json.Marshal(f)
+		if err := os.WriteFile(path, edited, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Load(); err == nil || !strings.Contains(err.Error(), "KDF iterations") {
+			t.Fatalf("expected %d iterations to be rejected, got %v", iterations, err)
+		}
+	}
+}
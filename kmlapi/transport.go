@@ -1,7 +1,9 @@
 package kmlapi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -25,15 +27,33 @@ var defaultHTTPClient = &http.Client{
 	Timeout: 15 * time.Second,
 }
 
-const (
-	fsqBase       = "https://api.foursquare.com/v2"
-	fsqHistory    = fsqBase + "/users/self/venuehistory?"
-	fsqCategories = fsqBase + "/venues/categories?"
-	fsqCheckins   = fsqBase + "/users/self/checkins?"
+var (
+	maxRetries     = 3
+	retryBaseDelay = time.Second
+)
+
+type statusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("request failed with status %s", e.Status)
+	}
+	return fmt.Sprintf("request failed with status %s: %s", e.Status, e.Body)
+}
 
-	fsqOAuth2Base  = "https://foursquare.com/oauth2"
-	fsqOAuth2      = fsqOAuth2Base + "/authenticate?response_type=code&"
-	fsqOAuth2Token = fsqOAuth2Base + "/access_token?grant_type=authorization_code&"
+func (e *statusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+const (
+	DefaultAPIBase    = "https://api.foursquare.com/v2"
+	DefaultOAuth2Base = "https://foursquare.com/oauth2"
+	DefaultPlacesBase = "https://api.foursquare.com/v3"
 
 	checkinsPageLimit = 250
 	maxCheckinsPages  = 1000
@@ -41,6 +61,49 @@ const (
 	maxVenuesPages    = 1000
 )
 
+var (
+	fsqHistory     string
+	fsqCategories  string
+	fsqCheckins    string
+	fsqVenues      string
+	fsqUserLists   string
+	fsqLists       string
+	fsqTips        string
+	fsqPhotos      string
+	fsqOAuth2      string
+	fsqOAuth2Token string
+	fsqPlaces      = DefaultPlacesBase
+)
+
+func init() {
+	SetEndpoints(DefaultAPIBase, DefaultOAuth2Base)
+}
+
+// SetEndpoints points the client at another implementation of the API, such
+// as an fsqfake server. It is meant to be called once at startup.
+func SetEndpoints(apiBase string, oauth2Base string) {
+	apiBase = strings.TrimSuffix(apiBase, "/")
+	oauth2Base = strings.TrimSuffix(oauth2Base, "/")
+	fsqHistory = apiBase + "/users/self/venuehistory?"
+	fsqCategories = apiBase + "/venues/categories?"
+	fsqCheckins = apiBase + "/users/self/checkins?"
+	fsqVenues = apiBase + "/venues/"
+	fsqUserLists = apiBase + "/users/self/lists?"
+	fsqLists = apiBase + "/lists/"
+	fsqTips = apiBase + "/users/self/tips?"
+	fsqPhotos = apiBase + "/users/self/photos?"
+	fsqOAuth2 = oauth2Base + "/authenticate?response_type=code&"
+	fsqOAuth2Token = oauth2Base + "/access_token?grant_type=authorization_code&"
+}
+
+// SetBaseURL serves the API, Places API and OAuth endpoints from one host,
+// under /v2, /v3 and /oauth2.
+func SetBaseURL(base string) {
+	base = strings.TrimSuffix(base, "/")
+	SetEndpoints(base+"/v2", base+"/oauth2")
+	fsqPlaces = base + "/v3"
+}
+
 func commonQuery(token FSQToken) url.Values {
 	q := url.Values{}
 
@@ -50,35 +113,99 @@ func commonQuery(token FSQToken) url.Values {
 	return q
 }
 
-func getJSON(urlStr string, out interface{}) error {
-	resp, err := defaultHTTPClient.Get(urlStr)
+// localizedQuery is commonQuery asking for names in locale. The default
+// locale is left out, as Foursquare answers in it anyway.
+func localizedQuery(token FSQToken, locale string) url.Values {
+	q := commonQuery(token)
+	if locale != "" && locale != DefaultLocale {
+		q.Add("locale", locale)
+	}
+	return q
+}
+
+func getJSON(ctx context.Context, urlStr string, out interface{}) error {
+	return getJSONWithHeader(ctx, urlStr, nil, out)
+}
+
+func getJSONWithHeader(ctx context.Context, urlStr string, header http.Header, out interface{}) error {
+	_, err := getJSONConditional(ctx, urlStr, header, out)
+	return err
+}
+
+var errNotModified = errors.New("not modified")
+
+// getJSONConditional is getJSONWithHeader returning the response headers,
+// and errNotModified when a conditional request is answered with 304.
+func getJSONConditional(ctx context.Context, urlStr string, header http.Header, out interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return resp.Header, errNotModified
+	}
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		content, readErr := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		if readErr != nil {
-			return fmt.Errorf("request failed with status %s", resp.Status)
+		statusErr := &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			statusErr.RetryAfter = time.Duration(secs) * time.Second
 		}
-		msg := strings.TrimSpace(string(content))
-		if msg == "" {
-			return fmt.Errorf("request failed with status %s", resp.Status)
+		if content, readErr := io.ReadAll(io.LimitReader(resp.Body, 4096)); readErr == nil {
+			statusErr.Body = strings.TrimSpace(string(content))
 		}
-		return fmt.Errorf("request failed with status %s: %s", resp.Status, msg)
+		return nil, statusErr
 	}
 
 	content, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := json.Unmarshal(content, out); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return resp.Header, nil
+}
+
+// fetchPage performs getJSON for a paged stage, retrying rate limited and
+// temporarily unavailable responses with exponential backoff.
+func fetchPage(ctx context.Context, rep *progressReporter, stage string, urlStr string, out interface{}) (time.Duration, error) {
+	return fetchPageWithHeader(ctx, rep, stage, urlStr, nil, out)
+}
+
+func fetchPageWithHeader(ctx context.Context, rep *progressReporter, stage string, urlStr string, header http.Header, out interface{}) (time.Duration, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := getJSONWithHeader(ctx, urlStr, header, out)
+		if err == nil {
+			return time.Since(start), nil
+		}
+		statusErr, ok := err.(*statusError)
+		if !ok || !statusErr.retryable() || attempt > maxRetries {
+			return 0, err
+		}
+		delay := statusErr.RetryAfter
+		if delay == 0 {
+			delay = retryBaseDelay << (attempt - 1)
+		}
+		rep.retryScheduled(stage, attempt, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
 }
 
 func NewToken(s string) FSQToken {
@@ -86,6 +213,10 @@ func NewToken(s string) FSQToken {
 }
 
 func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress ProgressCallback) ([]Venue, error) {
+	return fetchVenues(context.Background(), token, before, after, defaultLocale, newProgressReporter(CallbackListener(progress)))
+}
+
+func fetchVenues(ctx context.Context, token FSQToken, before *time.Time, after *time.Time, locale string, rep *progressReporter) ([]Venue, error) {
 	type fsqResponse struct {
 		Response struct {
 			Venues struct {
@@ -101,7 +232,7 @@ func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress P
 	seen := make(map[string]struct{})
 	// First request without paging params. This endpoint historically returns
 	// far more records in this mode than with forced limit/offset.
-	base := commonQuery(token)
+	base := localizedQuery(token, locale)
 	if before != nil {
 		base.Add("beforeTimestamp", strconv.FormatInt(before.Unix(), 10))
 	}
@@ -109,8 +240,10 @@ func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress P
 		base.Add("afterTimestamp", strconv.FormatInt(after.Unix(), 10))
 	}
 
+	rep.stageStarted("venues")
 	first := fsqResponse{}
-	if err := getJSON(fsqHistory+base.Encode(), &first); err != nil {
+	took, err := fetchPage(ctx, rep, "venues", fsqHistory+base.Encode(), &first)
+	if err != nil {
 		return nil, err
 	}
 
@@ -124,13 +257,13 @@ func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress P
 		seen[item.Venue.Id] = struct{}{}
 		venues = append(venues, item.Venue)
 	}
-	reportProgress(progress, "venues", len(venues), first.Response.Venues.Count)
+	rep.pageFetched("venues", len(venues), first.Response.Venues.Count, took)
 
 	// If count claims more than returned, attempt paged fallback.
 	if first.Response.Venues.Count > len(first.Response.Venues.Items) {
 		offset := len(first.Response.Venues.Items)
 		for page := 0; page < maxVenuesPages; page++ {
-			q := commonQuery(token)
+			q := localizedQuery(token, locale)
 			q.Add("limit", strconv.Itoa(venuesPageLimit))
 			q.Add("offset", strconv.Itoa(offset))
 			if before != nil {
@@ -141,7 +274,8 @@ func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress P
 			}
 
 			var fsq fsqResponse
-			if err := getJSON(fsqHistory+q.Encode(), &fsq); err != nil {
+			took, err := fetchPage(ctx, rep, "venues", fsqHistory+q.Encode(), &fsq)
+			if err != nil {
 				return nil, err
 			}
 
@@ -164,7 +298,7 @@ func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress P
 			}
 
 			offset += len(items)
-			reportProgress(progress, "venues", len(venues), first.Response.Venues.Count)
+			rep.pageFetched("venues", len(venues), first.Response.Venues.Count, took)
 			if first.Response.Venues.Count > 0 && offset >= first.Response.Venues.Count {
 				break
 			}
@@ -179,16 +313,28 @@ func FetchVenues(token FSQToken, before *time.Time, after *time.Time, progress P
 
 	// Some upstream counts can include entries not returned in items.
 	// Emit a final normalized progress event to mark completion.
-	reportProgress(progress, "venues", len(venues), len(venues))
+	rep.stageFinished("venues", len(venues), len(venues))
 	return venues, nil
 }
 
+// FetchCategories returns the category tree of the configured backend,
+// served from the category cache while it is fresh.
 func FetchCategories(token FSQToken) ([]GlobalCategory, error) {
-	q := commonQuery(token)
+	return FetchCategoriesLocale(token, "")
+}
+
+// FetchCategoriesLocale is FetchCategories with names in locale, or the
+// default locale when empty.
+func FetchCategoriesLocale(token FSQToken, locale string) ([]GlobalCategory, error) {
+	return loadCategories(context.Background(), activeBackend, token, resolveLocale(locale), nil)
+}
+
+func fetchCategories(ctx context.Context, token FSQToken, locale string) ([]GlobalCategory, error) {
+	q := localizedQuery(token, locale)
 	urlStr := fsqCategories + q.Encode()
 
 	var fsq fsqCategory
-	if err := getJSON(urlStr, &fsq); err != nil {
+	if err := getJSON(ctx, urlStr, &fsq); err != nil {
 		return nil, err
 	}
 
@@ -196,6 +342,10 @@ func FetchCategories(token FSQToken) ([]GlobalCategory, error) {
 }
 
 func FetchCheckins(token FSQToken, before *time.Time, after *time.Time, progress ProgressCallback) (map[string][]int64, CheckinFetchStats, error) {
+	return fetchCheckins(context.Background(), token, before, after, newProgressReporter(CallbackListener(progress)))
+}
+
+func fetchCheckins(ctx context.Context, token FSQToken, before *time.Time, after *time.Time, rep *progressReporter) (map[string][]int64, CheckinFetchStats, error) {
 	type checkinItem struct {
 		CreatedAt int64 `json:"createdAt"`
 		Venue     struct {
@@ -217,6 +367,7 @@ func FetchCheckins(token FSQToken, before *time.Time, after *time.Time, progress
 	offset := 0
 	stats := CheckinFetchStats{}
 
+	rep.stageStarted("checkins")
 	for page := 0; page < maxCheckinsPages; page++ {
 		q := commonQuery(token)
 		q.Add("limit", strconv.Itoa(checkinsPageLimit))
@@ -229,7 +380,8 @@ func FetchCheckins(token FSQToken, before *time.Time, after *time.Time, progress
 		}
 
 		var fsq fsqResponse
-		if err := getJSON(fsqCheckins+q.Encode(), &fsq); err != nil {
+		took, err := fetchPage(ctx, rep, "checkins", fsqCheckins+q.Encode(), &fsq)
+		if err != nil {
 			return nil, stats, err
 		}
 
@@ -259,7 +411,7 @@ func FetchCheckins(token FSQToken, before *time.Time, after *time.Time, progress
 		}
 
 		offset += len(items)
-		reportProgress(progress, "checkins", offset, fsq.Response.Checkins.Count)
+		rep.pageFetched("checkins", offset, fsq.Response.Checkins.Count, took)
 		if offset >= fsq.Response.Checkins.Count {
 			break
 		}
@@ -270,7 +422,7 @@ func FetchCheckins(token FSQToken, before *time.Time, after *time.Time, progress
 			return checkinsByVenue[venueID][i] > checkinsByVenue[venueID][j]
 		})
 	}
-	reportProgress(progress, "checkins", offset, offset)
+	rep.stageFinished("checkins", offset, offset)
 
 	return checkinsByVenue, stats, nil
 }
@@ -295,7 +447,7 @@ func Authenticate(clientId string, clientSecret string, code string, redirectUri
 	}
 
 	var tokenResponse AuthResponse
-	if err := getJSON(fsqOAuth2Token+q.Encode(), &tokenResponse); err != nil {
+	if err := getJSON(context.Background(), fsqOAuth2Token+q.Encode(), &tokenResponse); err != nil {
 		return "", err
 	}
 
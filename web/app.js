@@ -40,6 +40,9 @@
   var categoryOverlays = {};
   var categoryOrder = [];
   var colorCursor = 0;
+  // Layers shown only between zoom levels, e.g. clusters and the venues
+  // they stand for.
+  var zoomedLayers = [];
 
   var layerControl = L.control.layers(baseLayers, {}, { collapsed: true }).addTo(map);
 
@@ -68,6 +71,9 @@
       feature.properties.layerType = layerType;
       feature.properties.visitCount = item ? item.visitCount : null;
       feature.properties.lastVisitUtc = item ? item.lastVisitUtc : null;
+      feature.properties.minZoom = item ? item.minZoom : null;
+      feature.properties.maxZoom = item ? item.maxZoom : null;
+      feature.properties.clusterCount = item ? item.clusterCount : null;
     });
 
     return geoJson;
@@ -96,7 +102,10 @@
         queues[placemarkName].push({
           folderName: folderName,
           visitCount: Number.isFinite(parsedVisitCount) ? parsedVisitCount : null,
-          lastVisitUtc: lastVisitUtc
+          lastVisitUtc: lastVisitUtc,
+          minZoom: numberOrNull(simpleDataText(placemark, "min_zoom")),
+          maxZoom: numberOrNull(simpleDataText(placemark, "max_zoom")),
+          clusterCount: numberOrNull(simpleDataText(placemark, "venue_count"))
         });
       }
     }
@@ -128,6 +137,14 @@
     return "";
   }
 
+  function numberOrNull(value) {
+    if (value === "") {
+      return null;
+    }
+    var parsed = Number(value);
+    return Number.isFinite(parsed) ? parsed : null;
+  }
+
   function unixToUtcString(unixValue) {
     if (!unixValue) {
       return "";
@@ -155,6 +172,7 @@
     categoryOverlays = {};
     categoryOrder = [];
     colorCursor = 0;
+    zoomedLayers = [];
   }
 
   function ensureCategoryOverlay(typeName) {
@@ -165,6 +183,7 @@
         label: typeName,
         color: color,
         count: 0,
+        clusters: 0,
         group: group
       };
       categoryOrder.push(typeName);
@@ -175,6 +194,25 @@
 
   function featureLayer(feature, color) {
     var type = feature.geometry && feature.geometry.type;
+    var clusterCount = feature.properties ? feature.properties.clusterCount : null;
+
+    if (type === "Point" && clusterCount != null) {
+      return L.geoJSON(feature, {
+        pointToLayer: function (_, latlng) {
+          return L.circleMarker(latlng, {
+            radius: Math.min(8 + Math.sqrt(clusterCount) * 2, 30),
+            color: "#d5deef",
+            weight: 2,
+            fillColor: color,
+            fillOpacity: 0.7
+          }).bindTooltip(String(clusterCount), {
+            permanent: true,
+            direction: "center",
+            className: "cluster-count"
+          });
+        }
+      });
+    }
 
     if (type === "Point" || type === "MultiPoint") {
       return L.geoJSON(feature, {
@@ -219,6 +257,11 @@
   }
 
   function bindPopup(layer, feature) {
+    if (feature.properties && feature.properties.clusterCount != null) {
+      var lines = String(feature.properties.description || "").split("\n");
+      layer.bindPopup("<strong>" + escapeHtml(lines[0]) + "</strong><br>" + lines.slice(1).map(escapeHtml).join("<br>"));
+      return;
+    }
     var name = feature.properties && feature.properties.name ? feature.properties.name : "Unnamed feature";
     var typeName = feature.properties && feature.properties.layerType ? feature.properties.layerType : "Uncategorized";
     var visits = feature.properties && feature.properties.visitCount != null ? String(feature.properties.visitCount) : "n/a";
@@ -261,8 +304,36 @@
 
     overlay.group.addLayer(layer);
     overlay.count += 1;
+    if (feature.properties.clusterCount != null) {
+      overlay.clusters += 1;
+    }
+    if (feature.properties.minZoom != null || feature.properties.maxZoom != null) {
+      zoomedLayers.push({
+        layer: layer,
+        group: overlay.group,
+        minZoom: feature.properties.minZoom,
+        maxZoom: feature.properties.maxZoom
+      });
+    }
   }
 
+  // applyZoom shows the layers whose zoom range holds the map zoom, from
+  // minZoom up to but not including maxZoom.
+  function applyZoom() {
+    var zoom = map.getZoom();
+    zoomedLayers.forEach(function (entry) {
+      var visible = (entry.minZoom == null || zoom >= entry.minZoom) && (!entry.maxZoom || zoom < entry.maxZoom);
+      var shown = entry.group.hasLayer(entry.layer);
+      if (visible && !shown) {
+        entry.group.addLayer(entry.layer);
+      } else if (!visible && shown) {
+        entry.group.removeLayer(entry.layer);
+      }
+    });
+  }
+
+  map.on("zoomend", applyZoom);
+
   function updateLegend() {
     legendItemsEl.innerHTML = "";
 
@@ -356,12 +427,25 @@
         geoJson.features.forEach(routeFeature);
         updateLegend();
         fitAllVisibleLayers();
+        applyZoom();
 
         var rendered = 0;
+        var clusters = 0;
+        var types = 0;
         categoryOrder.forEach(function (typeName) {
-          rendered += categoryOverlays[typeName].count;
+          var overlay = categoryOverlays[typeName];
+          rendered += overlay.count;
+          clusters += overlay.clusters;
+          // The clusters folder is not a venue type.
+          if (overlay.count > overlay.clusters) {
+            types += 1;
+          }
         });
-        setStatus("Loaded " + categoryOrder.length + " type(s) and " + rendered + " venue(s).", false);
+        var status = "Loaded " + types + " type(s) and " + (rendered - clusters) + " venue(s)";
+        if (clusters > 0) {
+          status += " in " + clusters + " cluster(s)";
+        }
+        setStatus(status + ".", false);
       })
       .catch(function (error) {
         resetCategoryOverlays();